@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+)
+
+// runExportCommand streams the songs page by page, so the catalog is never kept in memory
+func runExportCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: expected a single file or - for stdout", errUsage)
+	}
+
+	path := args[0]
+	logger = logger.With(slog.String("catalog", path))
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Couldn`t create the catalog")
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	buffered := bufio.NewWriter(out)
+	count, err := exportCatalog(ctx, app, buffered, logger)
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t export the catalog")
+		if path != "-" {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d songs\n", count)
+	logger.With(slog.Int("songs", count)).Info("Catalog was exported successfully")
+	return nil
+}
+
+func exportCatalog(ctx context.Context, app *app, out io.Writer, logger *slog.Logger) (int, error) {
+	const pageSize = 500
+
+	writer, err := internal.NewCatalogWriter(out, internal.NewCatalogHeader())
+	if err != nil {
+		return 0, err
+	}
+
+	query := internal.SongsQuery{
+		Sort:  internal.SortSongsById,
+		Page:  1,
+		Limit: pageSize,
+	}
+
+	count := 0
+	for {
+		dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+		page, err := app.db.GetSongsPagination(dbCtx, query, logger)
+		cancel()
+		if err != nil {
+			return count, err
+		}
+
+		for _, song := range page {
+			dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+			fingerprints, err := app.db.GetSongFingerprints(dbCtx, song.SongId, logger)
+			cancel()
+			if err != nil {
+				return count, err
+			}
+
+			err = writer.WriteSong(song, fingerprints)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if len(page) < pageSize {
+			return count, writer.Close()
+		}
+
+		cursor := internal.NewSongsCursor(page[len(page)-1])
+		query.After = &cursor
+	}
+}
+
+// runImportCommand adds the songs of the catalog under new ids, the songs whose url
+// already exists are skipped and their duplicates in the catalog are linked to the existing song,
+// the duplicate links are restored after all songs are added
+func runImportCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: expected a single file or - for stdin", errUsage)
+	}
+
+	path := args[0]
+	logger = logger.With(slog.String("catalog", path))
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Couldn`t open the catalog")
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	reader, err := internal.NewCatalogReader(bufio.NewReader(in), logger)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header := reader.Header()
+	logger.With(
+		slog.Int("fingerprint_version", header.FingerprintVersion),
+		slog.Time("exported_at", header.ExportedAt),
+	).Info("Importing the catalog")
+
+	err = header.CheckCompatible(logger)
+	if err != nil {
+		return err
+	}
+
+	imported, skipped := 0, 0
+	// the ids of the catalog to the new ids
+	songIds := make(map[int]int)
+	duplicates := make(map[int]int)
+
+	for {
+		catalogSong, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Couldn`t read the catalog")
+			return err
+		}
+
+		song := catalogSong.Song
+		songLogger := logger.With(slog.Int("catalog_song_id", song.SongId))
+
+		dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+		songId, err := importSong(dbCtx, app.db, catalogSong, songLogger)
+		cancel()
+		if errors.Is(err, internal.ErrSongUrlExists) {
+			dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+			existingId, err := existingOriginalId(dbCtx, app.db, song.SongUrl, songLogger)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("song %d: %w", song.SongId, err)
+			}
+
+			songIds[song.SongId] = existingId
+			skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("song %d: %w", song.SongId, err)
+		}
+
+		songIds[song.SongId] = songId
+		if song.DuplicateOf != -1 {
+			duplicates[songId] = song.DuplicateOf
+		}
+		imported++
+	}
+
+	for songId, duplicateOf := range duplicates {
+		originalId, ok := songIds[duplicateOf]
+		if !ok {
+			logger.With(slog.Int("song_id", songId), slog.Int("catalog_duplicate_of", duplicateOf)).
+				Warn("Original of the duplicate wasn`t imported, the link is dropped")
+			continue
+		}
+
+		// the similarity isn`t part of the catalog
+		dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+		err = app.db.InsertSongDuplicate(dbCtx, songId, originalId, 0, logger)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("song %d: %w", songId, err)
+		}
+	}
+
+	fmt.Printf("imported %d, skipped %d with an existing url\n", imported, skipped)
+	logger.With(slog.Int("imported", imported), slog.Int("skipped", skipped)).Info("Catalog was imported successfully")
+	return nil
+}
+
+// existingOriginalId returns the id of the song with the url, or of its original when it is a duplicate,
+// so the duplicates of a skipped song don`t link to another duplicate
+func existingOriginalId(ctx context.Context, db internal.DB, songUrl string, logger *slog.Logger) (int, error) {
+	songId, err := db.GetSongIdByUrl(ctx, songUrl, logger)
+	if err != nil {
+		return -1, err
+	}
+
+	song, err := db.GetSongById(ctx, songId, logger)
+	if err != nil {
+		return -1, err
+	}
+
+	if song.DuplicateOf != -1 {
+		return song.DuplicateOf, nil
+	}
+	return songId, nil
+}
+
+// importSong returns ErrSongUrlExists when the url is already in the db,
+// a song which fails after it was inserted is deleted again, so a later import retries it
+func importSong(ctx context.Context, db internal.DB, catalogSong internal.CatalogSong, logger *slog.Logger) (int, error) {
+	song := catalogSong.Song
+
+	exists, err := db.CheckSongByUrl(ctx, song.SongUrl, logger)
+	if err != nil {
+		return -1, err
+	}
+	if exists {
+		logger.With(slog.String("song_url", song.SongUrl)).Debug("Song already exists, it is skipped")
+		return -1, internal.ErrSongUrlExists
+	}
+
+	songId, err := db.InsertSong(ctx, song.SongTitle, song.SongArtist, song.SongUrl, logger)
+	if err != nil {
+		return -1, err
+	}
+
+	err = importSongData(ctx, db, songId, catalogSong, logger)
+	if err != nil {
+		_, deleteErr := db.DeleteSong(ctx, songId, logger)
+		if deleteErr != nil {
+			logger.With(
+				slog.Int("song_id", songId),
+				slog.String("err", deleteErr.Error()),
+			).Error("Couldn`t delete the partially imported song, delete it before importing again")
+		}
+		return -1, err
+	}
+
+	return songId, nil
+}
+
+func importSongData(ctx context.Context, db internal.DB, songId int, catalogSong internal.CatalogSong, logger *slog.Logger) error {
+	song := catalogSong.Song
+
+	// zero for the songs added before the time was tracked, they keep the time of the import
+	if !song.AddedAt.IsZero() {
+		err := db.SetSongAddedAt(ctx, songId, song.AddedAt, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(catalogSong.Fingerprints) > 0 {
+		err := db.InsertFingerprints(ctx, songId, catalogSong.Fingerprints, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	if song.FingerprintVersion > 0 {
+		err := db.SetSongIndexed(ctx, songId, song.FingerprintVersion, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
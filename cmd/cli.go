@@ -0,0 +1,574 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+)
+
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, app *app, args []string, logger *slog.Logger) error
+}
+
+// the commands share the DB and the pipeline with the server,
+// they are run after the global flags, e.g. ./main -db mysql list
+var commands = []command{
+	{"serve", "serve", nil},
+	{"ingest", "ingest [-title title] [-artist artist] <file|url|dir>", runIngestCommand},
+	{"ingest-dir", "ingest-dir [-workers n] [-checkpoint file] <dir>", runIngestDirCommand},
+	{"match", "match [-top n] <file>", runMatchCommand},
+	{"list", "list [-q search] [-sort id|title|added_at] [-desc]", runListCommand},
+	{"delete", "delete <id>...", runDeleteCommand},
+	{"reindex", "reindex [--all] [<id>...]", runReindexCommand},
+	{"stats", "stats", runStatsCommand},
+	{"storage", "storage", runStorageCommand},
+	{"export", "export <file|->", runExportCommand},
+	{"import", "import <file|->", runImportCommand},
+	{"build-index", "build-index", runBuildIndexCommand},
+	{"migrate", "migrate [status]", nil},
+}
+
+func isCommand(name string) bool {
+	return slices.ContainsFunc(commands, func(command command) bool {
+		return command.name == name
+	})
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nCommands (serve by default):\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(out, "  %s\n", command.usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand returns the exit code of the command, SIGINT and SIGTERM cancel the command
+func runCommand(ctx context.Context, app *app, name string, args []string, logger *slog.Logger) int {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	index := slices.IndexFunc(commands, func(command command) bool {
+		return command.name == name
+	})
+	command := commands[index]
+
+	err := command.run(ctx, app, args, logger.With(slog.String("command", name)))
+	app.close(logger)
+
+	return commandExitCode(name, err)
+}
+
+// commandExitCode prints the error of the command and returns 2 on an invalid usage and 1 when the command failed
+func commandExitCode(name string, err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if errors.Is(err, errUsage) {
+		index := slices.IndexFunc(commands, func(command command) bool {
+			return command.name == name
+		})
+		fmt.Fprintf(os.Stderr, "%s\nUsage: %s [flags] %s\n", err, os.Args[0], commands[index].usage)
+		return 2
+	}
+
+	fmt.Fprintf(os.Stderr, "%s failed: %s\n", name, err)
+	return 1
+}
+
+func newCommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	return flags
+}
+
+func parseSongIds(args []string) ([]int, error) {
+	songIds := make([]int, len(args))
+	for i, arg := range args {
+		songId, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid song id %q", errUsage, arg)
+		}
+		songIds[i] = songId
+	}
+	return songIds, nil
+}
+
+func runIngestCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	flags := newCommandFlags("ingest")
+	title := flags.String("title", "", "Set the title of a file (default read from the tags or the file name)")
+	artist := flags.String("artist", "", "Set the artist of a file (default read from the tags or the file name)")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%w: expected a single file, url or directory", errUsage)
+	}
+	target := flags.Arg(0)
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return ingestUrlCommand(ctx, app, target, logger)
+	}
+
+	st, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	if !st.IsDir() {
+		tags := internal.ReadAudioTags(ctx, app.config.Tools.FfprobePath, target, logger)
+		return ingestFileCommand(ctx, app, target, cmp.Or(*title, tags.Title), cmp.Or(*artist, tags.Artist), logger)
+	}
+
+	// a directory is ingested without a checkpoint, ingest-dir can resume
+	return ingestDir(ctx, app, target, ingestDirOptions{Workers: runtime.NumCPU()}, logger)
+}
+
+func ingestUrlCommand(ctx context.Context, app *app, rawUrl string, logger *slog.Logger) error {
+	if !internal.ValidateUrl(rawUrl) {
+		return fmt.Errorf("%w: only youtu.be urls are supported", errUsage)
+	}
+
+	songUrl, _ := internal.StripUrl(rawUrl)
+	logger = logger.With(slog.String("url", songUrl))
+
+	found, err := checkSongUrl(ctx, app, songUrl, logger)
+	if err != nil || found {
+		return err
+	}
+
+	result, err := ingestUrl(ctx, app.downloader, app.ingester, app.audioStore, songUrl, app.config.Timeouts, logger)
+	if err != nil {
+		return err
+	}
+
+	printIngestResult(songUrl, result)
+	return nil
+}
+
+func ingestFileCommand(ctx context.Context, app *app, filePath string, title string, artist string, logger *slog.Logger) error {
+	logger = logger.With(slog.String("file_path", filePath))
+
+	songUrl, err := fileUrl(filePath)
+	if err != nil {
+		return err
+	}
+
+	found, err := checkSongUrl(ctx, app, songUrl, logger)
+	if err != nil || found {
+		return err
+	}
+
+	result, err := ingestFile(ctx, app.config.Tools.FfmpegPath, app.config.Paths.UploadsDir, app.ingester, app.audioStore, filePath, title, artist, app.config.Timeouts, logger)
+	if err != nil {
+		return err
+	}
+
+	printIngestResult(filePath, result)
+	return nil
+}
+
+// checkSongUrl prints the songs which are already in the catalog
+func checkSongUrl(ctx context.Context, app *app, songUrl string, logger *slog.Logger) (bool, error) {
+	dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+	defer cancel()
+
+	found, err := app.db.CheckSongByUrl(dbCtx, songUrl, logger)
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		fmt.Printf("%s: already exists\n", songUrl)
+	}
+
+	return found, nil
+}
+
+func printIngestResult(target string, result internal.IngestResult) {
+	if result.DuplicateOf != -1 {
+		fmt.Printf("%s: song %d, duplicate of %d (similarity %.2f)\n", target, result.SongId, result.DuplicateOf, result.Similarity)
+		return
+	}
+	fmt.Printf("%s: song %d\n", target, result.SongId)
+}
+
+func runMatchCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	flags := newCommandFlags("match")
+	top := flags.Int("top", 5, "Set the count of printed candidates")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%w: expected a single file", errUsage)
+	}
+
+	if *top < 1 {
+		return fmt.Errorf("%w: -top must be at least 1", errUsage)
+	}
+
+	logger = logger.With(slog.String("file_path", flags.Arg(0)))
+
+	wavPath, err := convertFile(ctx, app.config.Tools.FfmpegPath, app.config.Paths.UploadsDir, flags.Arg(0), app.config.Timeouts, logger)
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(wavPath, logger)
+
+	candidates, err := matchWav(ctx, app.db, wavPath, *top, app.config.Search.IDFWeighting, app.config.Timeouts, logger)
+	if err != nil {
+		return err
+	}
+
+	if len(candidates) == 0 {
+		return errors.New("no matching song found")
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "RANK\tSCORE\tID\tTITLE\tARTIST")
+	for i, candidate := range candidates {
+		song := candidate.Song
+		fmt.Fprintf(out, "%d\t%.1f\t%d\t%s\t%s\n", i+1, candidate.Score, song.SongId, song.SongTitle, song.SongArtist)
+	}
+	return out.Flush()
+}
+
+func runListCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	flags := newCommandFlags("list")
+	search := flags.String("q", "", "Search the songs by title and artist")
+	sortBy := flags.String("sort", string(internal.SortSongsById), "Sort the songs by id, title or added_at")
+	descending := flags.Bool("desc", false, "Sort in descending order")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	sort, ok := internal.ParseSongsSort(*sortBy)
+	if !ok {
+		return fmt.Errorf("%w: invalid sort %q", errUsage, *sortBy)
+	}
+
+	songs, err := listSongs(ctx, app, internal.SongsQuery{Search: *search, Sort: sort, Descending: *descending}, logger)
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tTITLE\tARTIST\tVERSION\tDUPLICATE_OF\tADDED_AT\tURL")
+	for _, song := range songs {
+		duplicateOf := "-"
+		if song.DuplicateOf != -1 {
+			duplicateOf = strconv.Itoa(song.DuplicateOf)
+		}
+
+		addedAt := "-"
+		if !song.AddedAt.IsZero() {
+			addedAt = song.AddedAt.UTC().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(out, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n", song.SongId, song.SongTitle, song.SongArtist, song.FingerprintVersion, duplicateOf, addedAt, song.SongUrl)
+	}
+	return out.Flush()
+}
+
+// listSongs pages through all songs matching the query with the keyset cursor
+func listSongs(ctx context.Context, app *app, query internal.SongsQuery, logger *slog.Logger) ([]internal.Song, error) {
+	const pageSize = 500
+
+	query.Page = 1
+	query.Limit = pageSize
+
+	songs := make([]internal.Song, 0)
+	for {
+		dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+		page, err := app.db.GetSongsPagination(dbCtx, query, logger)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		songs = append(songs, page...)
+		if len(page) < pageSize {
+			return songs, nil
+		}
+
+		cursor := internal.NewSongsCursor(page[len(page)-1])
+		query.After = &cursor
+	}
+}
+
+func runDeleteCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: expected song ids", errUsage)
+	}
+
+	songIds, err := parseSongIds(args)
+	if err != nil {
+		return err
+	}
+
+	for _, songId := range songIds {
+		logger := logger.With(slog.Int("song_id", songId))
+
+		dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+		promotedId, err := app.db.DeleteSong(dbCtx, songId, logger)
+		if err == nil {
+			app.audioStore.Delete(dbCtx, songId, logger)
+		}
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("song %d: %w", songId, err)
+		}
+
+		if promotedId != -1 {
+			fmt.Printf("song %d: deleted, its duplicate %d is the original now\n", songId, promotedId)
+			continue
+		}
+		fmt.Printf("song %d: deleted\n", songId)
+	}
+
+	return nil
+}
+
+func runReindexCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	flags := newCommandFlags("reindex")
+	all := flags.Bool("all", false, "Reindex every song")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	if *all == (flags.NArg() > 0) {
+		return fmt.Errorf("%w: expected either --all or song ids", errUsage)
+	}
+
+	var songs []internal.Song
+	if *all {
+		songs, err = listSongs(ctx, app, internal.SongsQuery{Sort: internal.SortSongsById}, logger)
+		if err != nil {
+			return err
+		}
+	} else {
+		songIds, err := parseSongIds(flags.Args())
+		if err != nil {
+			return err
+		}
+
+		for _, songId := range songIds {
+			dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+			song, err := app.db.GetSongById(dbCtx, songId, logger)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("song %d: %w", songId, err)
+			}
+			songs = append(songs, song)
+		}
+	}
+
+	failed := 0
+	for _, song := range songs {
+		logger := logger.With(slog.Int("song_id", song.SongId), slog.String("url", song.SongUrl))
+
+		result, err := reindexSong(ctx, app.downloader, app.ingester, app.audioStore, app.config.Paths.DownloadsDir, song, app.config.Timeouts, logger)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Printf("song %d: failed: %s\n", song.SongId, err)
+			failed++
+			continue
+		}
+
+		if result.DuplicateOf != -1 {
+			fmt.Printf("song %d: reindexed, duplicate of %d (similarity %.2f)\n", song.SongId, result.DuplicateOf, result.Similarity)
+			continue
+		}
+		fmt.Printf("song %d: reindexed\n", song.SongId)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d songs failed", failed)
+	}
+
+	return nil
+}
+
+// runBuildIndexCommand rebuilds the fingerprint index from the DB,
+// which is needed after the DB was changed by a process without the index
+func runBuildIndexCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%w: unexpected arguments", errUsage)
+	}
+
+	if app.index == nil {
+		return fmt.Errorf("%w: the fingerprint index is disabled, set -fingerprint-index", errUsage)
+	}
+
+	err := app.index.Rebuild(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("fingerprint index %s: built\n", app.config.FingerprintIndex.Path)
+	return nil
+}
+
+func runStatsCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%w: unexpected arguments", errUsage)
+	}
+
+	songs, err := listSongs(ctx, app, internal.SongsQuery{Sort: internal.SortSongsById}, logger)
+	if err != nil {
+		return err
+	}
+
+	dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+	defer cancel()
+
+	fingerprintsCount, err := app.db.GetFingerprintsCount(dbCtx, logger)
+	if err != nil {
+		return err
+	}
+
+	duplicates := 0
+	outdated := 0
+	versions := make(map[int]int)
+	for _, song := range songs {
+		if song.DuplicateOf != -1 {
+			duplicates++
+		}
+		if song.FingerprintVersion != internal.FingerprintVersion {
+			outdated++
+		}
+		versions[song.FingerprintVersion]++
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(out, "db backend\t%s\n", app.config.DB.Backend)
+	fmt.Fprintf(out, "songs\t%d\n", len(songs))
+	fmt.Fprintf(out, "duplicates\t%d\n", duplicates)
+	fmt.Fprintf(out, "fingerprints\t%d\n", fingerprintsCount)
+	fmt.Fprintf(out, "fingerprint version\t%d\n", internal.FingerprintVersion)
+	fmt.Fprintf(out, "outdated songs\t%d\n", outdated)
+	for _, version := range slices.Sorted(maps.Keys(versions)) {
+		fmt.Fprintf(out, "songs of version %d\t%d\n", version, versions[version])
+	}
+	return out.Flush()
+}
+
+// runStorageCommand prints the footprint of the tables and the bytes per row,
+// e.g. to compare the fingerprints before and after a schema change
+func runStorageCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%w: unexpected arguments", errUsage)
+	}
+
+	dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+	defer cancel()
+
+	tables, err := app.db.GetStorageStats(dbCtx, logger)
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(out, "TABLE\tROWS\tDATA\tINDEX\tTOTAL\tBYTES/ROW\n")
+	for _, table := range tables {
+		total := table.DataBytes + max(table.IndexBytes, 0)
+		if table.DataBytes < 0 {
+			total = -1
+		}
+
+		bytesPerRow := "-"
+		if total >= 0 && table.Rows > 0 {
+			bytesPerRow = fmt.Sprintf("%.1f", float64(total)/float64(table.Rows))
+		}
+
+		fmt.Fprintf(out, "%s\t%d\t%s\t%s\t%s\t%s\n", table.Table, table.Rows,
+			formatBytes(table.DataBytes), formatBytes(table.IndexBytes), formatBytes(total), bytesPerRow)
+	}
+	return out.Flush()
+}
+
+// formatBytes prints - for an unknown size
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < 0 {
+		return "-"
+	}
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value := float64(bytes)
+	for _, suffix := range []string{"KiB", "MiB", "GiB"} {
+		value /= unit
+		if value < unit || suffix == "GiB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return ""
+}
+
+// runMigrateCommand applies the pending migrations or with "status" lists them
+func runMigrateCommand(ctx context.Context, db internal.DB, args []string, logger *slog.Logger) error {
+	if len(args) > 1 || len(args) == 1 && args[0] != "status" {
+		return fmt.Errorf("%w: unexpected arguments %q", errUsage, args)
+	}
+
+	if len(args) == 1 {
+		statuses, err := db.MigrationsStatus(ctx, logger)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Failed to get the migrations status")
+			return err
+		}
+
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+			} else if status.Unsupported {
+				appliedAt = "pending, the db build lacks " + status.Requires
+			}
+			if status.Backend != "" {
+				fmt.Printf("%-9s ", status.Backend)
+			}
+			fmt.Printf("%04d %-40s %s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	}
+
+	err := db.SetupDB(ctx, logger)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Failed to migrate the DB")
+		return err
+	}
+	return nil
+}
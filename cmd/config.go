@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+)
+
+// loadConfig layers the defaults, the config file, the env variables and the flags,
+// the later ones override the fields set by the earlier ones
+func loadConfig() (internal.Config, error) {
+	config := internal.DefaultConfig()
+
+	var configPath string
+	flag.StringVar(&configPath, "config", os.Getenv("CONFIG_FILE"), "Set the YAML config file (env CONFIG_FILE)")
+	registerFlags(&config)
+
+	flag.Usage = usage
+	flag.Parse()
+
+	// the file and the env are loaded into the same struct the flags are bound to,
+	// so the set flags are applied again on top of them
+	setFlags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	if configPath != "" {
+		err := internal.LoadConfigFile(configPath, &config)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err := internal.ApplyEnv(&config, os.LookupEnv)
+	if err != nil {
+		return config, err
+	}
+
+	for name, value := range setFlags {
+		err = flag.Set(name, value)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	config.ResolveDefaults()
+
+	return config, config.Validate()
+}
+
+func registerFlags(config *internal.Config) {
+	flag.BoolVar(&config.Production, "prod", config.Production, "Set environments to production")
+	flag.StringVar(&config.AWS.Region, "region", config.AWS.Region, "Set the aws region")
+	flag.StringVar(&config.Secrets.Provider, "secrets-provider", config.Secrets.Provider, "Set where the DB connection options are read from: ssm, env, file or http (default env, ssm in production)")
+	flag.StringVar(&config.Secrets.SSMPrefix, "secrets-ssm-prefix", config.Secrets.SSMPrefix, "Set the path prefix of the SSM parameters")
+	flag.StringVar(&config.Secrets.EnvPrefix, "secrets-env-prefix", config.Secrets.EnvPrefix, "Set the prefix of the env variables holding the secrets")
+	flag.StringVar(&config.Secrets.FilePath, "secrets-file", config.Secrets.FilePath, "Set the YAML or JSON file holding the secrets")
+	flag.StringVar(&config.Secrets.HTTPUrl, "secrets-http-url", config.Secrets.HTTPUrl, "Set the base url of the local parameter store")
+
+	flag.StringVar(&config.Server.Addr, "addr", config.Server.Addr, "Set the listen address (default :3000, :80 in production)")
+	flag.DurationVar(&config.Server.ShutdownTimeout, "shutdown-timeout", config.Server.ShutdownTimeout, "Set how long the shutdown waits for the in-flight requests and ingestions before cancelling them")
+	flag.Int64Var(&config.Server.MaxUploadBytes, "max-upload-bytes", config.Server.MaxUploadBytes, "Set the memory limit of an uploaded recording, the rest is buffered in temp files")
+	flag.IntVar(&config.Server.DefaultPageSize, "default-page-size", config.Server.DefaultPageSize, "Set the count of songs of a page when the limit is not given")
+
+	flag.StringVar(&config.Paths.DownloadsDir, "downloads-dir", config.Paths.DownloadsDir, "Set the directory of the downloaded songs")
+	flag.StringVar(&config.Paths.UploadsDir, "uploads-dir", config.Paths.UploadsDir, "Set the directory of the uploaded recordings")
+	flag.StringVar(&config.Paths.WebDir, "web-dir", config.Paths.WebDir, "Set the directory of the frontend served outside production")
+
+	flag.StringVar(&config.AudioStore.Backend, "audio-store", config.AudioStore.Backend, "Set where the audio of the songs is archived for reindexing: none, local or s3")
+	flag.StringVar(&config.AudioStore.LocalDir, "audio-store-dir", config.AudioStore.LocalDir, "Set the directory of the local audio store")
+	flag.StringVar(&config.AudioStore.S3Endpoint, "audio-store-s3-endpoint", config.AudioStore.S3Endpoint, "Set the endpoint of an S3 compatible audio store like MinIO")
+	flag.StringVar(&config.AudioStore.S3Bucket, "audio-store-s3-bucket", config.AudioStore.S3Bucket, "Set the bucket of the S3 audio store")
+
+	flag.StringVar(&config.Tools.YtDlpPath, "yt-dlp", config.Tools.YtDlpPath, "Set the path of yt-dlp")
+	flag.StringVar(&config.Tools.CookiesPath, "cookies", config.Tools.CookiesPath, "Set the cookies file of yt-dlp (empty downloads without cookies)")
+	flag.StringVar(&config.Tools.FfmpegPath, "ffmpeg", config.Tools.FfmpegPath, "Set the path of ffmpeg")
+	flag.StringVar(&config.Tools.FfprobePath, "ffprobe", config.Tools.FfprobePath, "Set the path of ffprobe, which reads the tags of the ingested files")
+
+	flag.StringVar(&config.DB.Backend, "db", config.DB.Backend, "Set the DB backend: sqlite, mysql, postgres or memory (default sqlite, mysql in production)")
+	flag.StringVar(&config.DB.SqlitePath, "sqlite-path", config.DB.SqlitePath, "Set the sqlite db file")
+	flag.StringVar(&config.DB.PostgresUrl, "postgres-url", config.DB.PostgresUrl, "Set the postgres connection url (default resolved through the secrets provider)")
+	flag.IntVar(&config.DB.MySql.MaxOpenConns, "mysql-max-open-conns", config.DB.MySql.MaxOpenConns, "Set the max open MySql connections, 0 is unlimited")
+	flag.IntVar(&config.DB.MySql.MaxIdleConns, "mysql-max-idle-conns", config.DB.MySql.MaxIdleConns, "Set the max idle MySql connections")
+	flag.DurationVar(&config.DB.MySql.ConnMaxLifetime, "mysql-conn-max-lifetime", config.DB.MySql.ConnMaxLifetime, "Set after how long a MySql connection is recycled, 0 keeps it forever")
+	flag.DurationVar(&config.DB.MySql.ConnMaxIdleTime, "mysql-conn-max-idle-time", config.DB.MySql.ConnMaxIdleTime, "Set after how long an idle MySql connection is closed, 0 keeps it forever")
+	flag.StringVar(&config.DB.MySql.TLS, "mysql-tls", config.DB.MySql.TLS, "Set the MySql TLS mode: false, true, skip-verify or preferred")
+	flag.StringVar(&config.DB.MySql.TLSCAPath, "mysql-tls-ca", config.DB.MySql.TLSCAPath, "Set the PEM file of the CA which verifies the MySql server")
+	flag.IntVar(&config.DB.MySql.ConnectRetries, "mysql-connect-retries", config.DB.MySql.ConnectRetries, "Set how many times the MySql connection is retried at startup")
+	flag.StringVar(&config.DB.Shards, "db-shards", config.DB.Shards, "Set the comma separated DBs which hold the fingerprints by hash range (empty keeps them on the primary)")
+	flag.StringVar(&config.DB.SnapshotPath, "snapshot", config.DB.SnapshotPath, "Set the snapshot file of the memory DB (empty disables the persistence)")
+	flag.DurationVar(&config.DB.SnapshotInterval, "snapshot-interval", config.DB.SnapshotInterval, "Set how long after a change the memory DB snapshot is saved (0 saves it only at exit)")
+
+	flag.IntVar(&config.Search.ChunkSize, "search-chunk-size", config.Search.ChunkSize, "Set the count of hashes looked up by a single query")
+	flag.IntVar(&config.Search.Concurrency, "search-concurrency", config.Search.Concurrency, "Set the count of hash lookup queries run at the same time")
+	flag.IntVar(&config.Search.MaxPostingsPerHash, "max-postings-per-hash", config.Search.MaxPostingsPerHash, "Set the count of songs above which a hash is ignored when matching (0 disables the cap)")
+	flag.BoolVar(&config.Search.IDFWeighting, "idf-weighting", config.Search.IDFWeighting, "Weight the matches of a hash by how rare the hash is in the songs")
+	flag.StringVar(&config.FingerprintIndex.Path, "fingerprint-index", config.FingerprintIndex.Path, "Set the memory mapped index file which serves the hash lookups instead of the DB (empty disables it)")
+	flag.DurationVar(&config.FingerprintIndex.MergeDelay, "fingerprint-index-merge-delay", config.FingerprintIndex.MergeDelay, "Set how long the ingested songs are collected before they are merged into the index file")
+
+	flag.DurationVar(&config.Timeouts.Download, "download-timeout", config.Timeouts.Download, "Set the time limit of downloading a song (0 disables the limit)")
+	flag.DurationVar(&config.Timeouts.Convert, "convert-timeout", config.Timeouts.Convert, "Set the time limit of converting a recording to .wav (0 disables the limit)")
+	flag.DurationVar(&config.Timeouts.Analysis, "analysis-timeout", config.Timeouts.Analysis, "Set the time limit of computing the spectrogram of a song or a recording (0 disables the limit)")
+	flag.DurationVar(&config.Timeouts.DB, "db-timeout", config.Timeouts.DB, "Set the time limit of the DB queries of a single request or ingestion (0 disables the limit)")
+
+	flag.Float64Var(&config.DuplicateThreshold, "duplicate-threshold", config.DuplicateThreshold, "Set the share of aligned fingerprints above which a new song is stored as a duplicate (0 disables the check)")
+
+	flag.StringVar(&config.Log.Format, "log-format", config.Log.Format, "Set the log format: text or json")
+	flag.StringVar(&config.Log.Level, "log-level", config.Log.Level, "Set the log level: debug, info, warn or error (default debug, info in production)")
+	flag.StringVar(&config.Log.FilePath, "log-file", config.Log.FilePath, "Set the log file, which is rotated by size, instead of stdout")
+	flag.IntVar(&config.Log.FileMaxSizeMB, "log-file-max-size", config.Log.FileMaxSizeMB, "Set the size in MB at which the log file is rotated")
+	flag.IntVar(&config.Log.FileMaxBackups, "log-file-max-backups", config.Log.FileMaxBackups, "Set the count of rotated log files which are kept")
+	flag.IntVar(&config.Log.FileMaxAgeDays, "log-file-max-age", config.Log.FileMaxAgeDays, "Set the days for which the rotated log files are kept")
+	flag.IntVar(&config.Log.DebugSampling, "log-debug-sampling", config.Log.DebugSampling, "Set to keep only every n-th debug line with the same message")
+
+	flag.StringVar(&config.Tracing.Exporter, "trace-exporter", config.Tracing.Exporter, "Set the trace exporter: none, stdout, file or otlp (configured by the OTEL_EXPORTER_OTLP_* env variables)")
+	flag.StringVar(&config.Tracing.FilePath, "trace-file", config.Tracing.FilePath, "Set the file of the file trace exporter")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = ""
+
+// buildVersion falls back to the vcs revision stamped by go build
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+
+	return "unknown"
+}
+
+type HealthDTO struct {
+	Status string `json:"status"`
+	// the failed checks with their errors, only set by the readiness check
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func createHealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, HealthDTO{Status: "ok"}, http.StatusOK)
+	}
+}
+
+func createReadyzHandler(db internal.DB, audioStore internal.AudioStore, config internal.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		failed := make(map[string]string)
+
+		ctx, cancel := internal.WithStageTimeout(r.Context(), config.Timeouts.DB)
+		defer cancel()
+
+		err := db.Ping(ctx, logger)
+		if err != nil {
+			failed["db"] = err.Error()
+		}
+
+		err = audioStore.Ping(ctx, logger)
+		if err != nil {
+			failed["audio_store"] = err.Error()
+		}
+
+		for _, binary := range []string{config.Tools.FfmpegPath, config.Tools.YtDlpPath} {
+			err = internal.CheckBinary(binary, logger)
+			if err != nil {
+				failed[binary] = err.Error()
+			}
+		}
+
+		for _, dir := range []string{config.Paths.DownloadsDir, config.Paths.UploadsDir} {
+			err = internal.CheckWritableDir(dir, logger)
+			if err != nil {
+				failed[dir] = err.Error()
+			}
+		}
+
+		if len(failed) > 0 {
+			sendJSON(w, HealthDTO{Status: "unavailable", Checks: failed}, http.StatusServiceUnavailable)
+			return
+		}
+
+		sendJSON(w, HealthDTO{Status: "ok"}, http.StatusOK)
+	}
+}
+
+type VersionDTO struct {
+	Version            string `json:"version"`
+	FingerprintVersion int    `json:"fingerprint_version"`
+	DBBackend          string `json:"db_backend"`
+}
+
+func createVersionHandler(dbBackend string) http.HandlerFunc {
+	dto := VersionDTO{
+		Version:            buildVersion(),
+		FingerprintVersion: internal.FingerprintVersion,
+		DBBackend:          dbBackend,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, dto, http.StatusOK)
+	}
+}
+
+func sendJSON(w http.ResponseWriter, body any, status int) {
+	resp, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+)
+
+type ingestDirOptions struct {
+	Workers int
+	// CheckpointPath is empty when the run can`t be resumed
+	CheckpointPath string
+}
+
+type ingestDirStats struct {
+	ingested   int
+	duplicates int
+	existing   int
+	resumed    int
+	failed     int
+}
+
+// analysedFile is the work of a worker, the wav is kept until the song is stored
+type analysedFile struct {
+	path         string
+	songUrl      string
+	exists       bool
+	tags         internal.AudioTags
+	wavPath      string
+	fingerprints map[uint64]uint32
+	err          error
+}
+
+func runIngestDirCommand(ctx context.Context, app *app, args []string, logger *slog.Logger) error {
+	flags := newCommandFlags("ingest-dir")
+	workers := flags.Int("workers", runtime.NumCPU(), "Set the count of files fingerprinted at the same time")
+	checkpointPath := flags.String("checkpoint", "ingest.checkpoint", "Set the file recording the ingested files, so an interrupted run resumes (empty disables it)")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%w: expected a single directory", errUsage)
+	}
+
+	if *workers < 1 {
+		return fmt.Errorf("%w: workers must be positive", errUsage)
+	}
+
+	return ingestDir(ctx, app, flags.Arg(0), ingestDirOptions{Workers: *workers, CheckpointPath: *checkpointPath}, logger)
+}
+
+// ingestDir fingerprints the audio files of the tree in parallel,
+// the songs are stored one by one, so the duplicate check sees every song stored before
+func ingestDir(ctx context.Context, app *app, dir string, options ingestDirOptions, logger *slog.Logger) error {
+	logger = logger.With(slog.String("dir", dir), slog.Int("workers", options.Workers))
+
+	checkpoint, err := openCheckpoint(options.CheckpointPath, logger)
+	if err != nil {
+		return err
+	}
+	defer checkpoint.Close()
+
+	var stats ingestDirStats
+
+	paths := make(chan string)
+	var walkErr error
+	go func() {
+		defer close(paths)
+		walkErr = walkAudioFiles(ctx, dir, checkpoint, &stats, paths, logger)
+	}()
+
+	analysed := make(chan analysedFile)
+	var wg sync.WaitGroup
+	for range options.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				analysed <- analyseFile(ctx, app, path, logger)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(analysed)
+	}()
+
+	for file := range analysed {
+		storeAnalysedFile(ctx, app, file, checkpoint, &stats, logger)
+	}
+
+	fmt.Printf("ingested %d, duplicates %d, already existing %d, resumed %d, failed %d\n",
+		stats.ingested, stats.duplicates, stats.existing, stats.resumed, stats.failed)
+
+	logger.With(
+		slog.Int("ingested", stats.ingested),
+		slog.Int("duplicates", stats.duplicates),
+		slog.Int("failed", stats.failed),
+	).Info("Directory ingestion finished")
+
+	if walkErr != nil {
+		return walkErr
+	}
+
+	if stats.failed > 0 {
+		return fmt.Errorf("%d files failed", stats.failed)
+	}
+
+	return nil
+}
+
+// walkAudioFiles sends the audio files which aren`t in the checkpoint
+func walkAudioFiles(ctx context.Context, dir string, checkpoint *checkpoint, stats *ingestDirStats, paths chan<- string, logger *slog.Logger) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			logger.With(slog.String("path", path), slog.String("err", err.Error())).Warn("Couldn`t read a path, it is skipped")
+			return nil
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		if checkpoint.Done(absPath) {
+			stats.resumed++
+			return nil
+		}
+
+		isAudio, err := internal.IsAudioFile(absPath)
+		if err != nil {
+			logger.With(slog.String("path", path), slog.String("err", err.Error())).Warn("Couldn`t read a file, it is skipped")
+			return nil
+		}
+
+		if !isAudio {
+			return nil
+		}
+
+		select {
+		case paths <- absPath:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+func analyseFile(ctx context.Context, app *app, filePath string, logger *slog.Logger) analysedFile {
+	logger = logger.With(slog.String("file_path", filePath))
+	file := analysedFile{path: filePath}
+
+	file.songUrl, file.err = fileUrl(filePath)
+	if file.err != nil {
+		return file
+	}
+
+	dbCtx, cancel := internal.WithStageTimeout(ctx, app.config.Timeouts.DB)
+	file.exists, file.err = app.db.CheckSongByUrl(dbCtx, file.songUrl, logger)
+	cancel()
+	if file.err != nil || file.exists {
+		return file
+	}
+
+	file.tags = internal.ReadAudioTags(ctx, app.config.Tools.FfprobePath, filePath, logger)
+	file.wavPath, file.fingerprints, file.err = fileFingerprints(ctx, app.config.Tools.FfmpegPath, app.config.Paths.UploadsDir, filePath, app.config.Timeouts, logger)
+	return file
+}
+
+func storeAnalysedFile(ctx context.Context, app *app, file analysedFile, checkpoint *checkpoint, stats *ingestDirStats, logger *slog.Logger) {
+	logger = logger.With(slog.String("file_path", file.path))
+
+	if file.err != nil {
+		fmt.Printf("%s: failed: %s\n", file.path, file.err)
+		stats.failed++
+		return
+	}
+
+	if file.exists {
+		fmt.Printf("%s: already exists\n", file.path)
+		stats.existing++
+		checkpoint.Record(file.path, -1, logger)
+		return
+	}
+	defer removeTempFile(file.wavPath, logger)
+
+	result, err := storeSong(ctx, app.ingester, app.audioStore, file.tags.Title, file.tags.Artist, file.songUrl, file.wavPath, file.fingerprints, app.config.Timeouts, logger)
+	if err != nil {
+		fmt.Printf("%s: failed: %s\n", file.path, err)
+		stats.failed++
+		return
+	}
+
+	if result.DuplicateOf != -1 {
+		stats.duplicates++
+	} else {
+		stats.ingested++
+	}
+
+	printIngestResult(file.path, result)
+	checkpoint.Record(file.path, result.SongId, logger)
+}
+
+// checkpoint is a JSON line per finished file, the failed files are not recorded,
+// so a resumed run tries them again
+type checkpoint struct {
+	file *os.File
+	done map[string]bool
+}
+
+type checkpointEntry struct {
+	Path string `json:"path"`
+	// -1 when the song already existed
+	SongId int `json:"song_id"`
+}
+
+func openCheckpoint(path string, logger *slog.Logger) (*checkpoint, error) {
+	checkpoint := &checkpoint{
+		done: make(map[string]bool),
+	}
+
+	if path == "" {
+		return checkpoint, nil
+	}
+
+	logger = logger.With(slog.String("checkpoint", path))
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t read the checkpoint")
+		return nil, err
+	}
+
+	for line := range bytes.Lines(content) {
+		var entry checkpointEntry
+		// the last line is cut when the previous run was killed in the middle of a write
+		if json.Unmarshal(line, &entry) == nil {
+			checkpoint.done[entry.Path] = true
+		}
+	}
+
+	checkpoint.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t open the checkpoint")
+		return nil, err
+	}
+
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		checkpoint.file.Write([]byte("\n"))
+	}
+
+	if len(checkpoint.done) > 0 {
+		logger.With(slog.Int("done", len(checkpoint.done))).Info("Resuming from the checkpoint")
+	}
+
+	return checkpoint, nil
+}
+
+func (checkpoint *checkpoint) Done(path string) bool {
+	return checkpoint.done[path]
+}
+
+func (checkpoint *checkpoint) Record(path string, songId int, logger *slog.Logger) {
+	if checkpoint.file == nil {
+		return
+	}
+
+	line, _ := json.Marshal(checkpointEntry{Path: path, SongId: songId})
+	_, err := checkpoint.file.Write(append(line, '\n'))
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t write the checkpoint")
+	}
+}
+
+func (checkpoint *checkpoint) Close() error {
+	if checkpoint.file == nil {
+		return nil
+	}
+	return checkpoint.file.Close()
+}
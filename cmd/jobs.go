@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// backgroundJobs tracks the ingestions which outlive their requests,
+// so the shutdown can wait for them before the process exits
+type backgroundJobs struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// mu orders wg.Add before wg.Wait, no job is added once draining is set
+	mu       sync.Mutex
+	draining bool
+}
+
+func newBackgroundJobs() *backgroundJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundJobs{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Go runs the job in its own goroutine with a context which is cancelled
+// only when the jobs couldn`t finish before the shutdown deadline,
+// the span of requestCtx is carried over so the job is traced as part of the request,
+// it returns false without running the job once the drain has started
+func (jobs *backgroundJobs) Go(requestCtx context.Context, job func(ctx context.Context)) bool {
+	ctx := detachedContext(jobs.ctx, requestCtx)
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if jobs.draining {
+		return false
+	}
+
+	jobs.wg.Add(1)
+	ingestQueueDepth.Inc()
+	go func() {
+		defer jobs.wg.Done()
+		defer ingestQueueDepth.Dec()
+		job(ctx)
+	}()
+
+	return true
+}
+
+// Drain waits for the running jobs until ctx is done and then cancels the rest
+func (jobs *backgroundJobs) Drain(ctx context.Context, logger *slog.Logger) {
+	jobs.mu.Lock()
+	jobs.draining = true
+	jobs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jobs.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("Background jobs were drained")
+	case <-ctx.Done():
+		logger.Warn("Background jobs didn`t finish in time, cancelling them")
+		jobs.cancel()
+		<-done
+	}
+
+	jobs.cancel()
+}
@@ -1,89 +1,346 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lastvoidtemplar/song_recognition/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
-	var production bool
-	var region string
-	flag.BoolVar(&production, "prod", false, "Set environments to production")
-	flag.StringVar(&region, "region", "eu-central-1", "Set the aws region")
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%s\n", err)
+		os.Exit(2)
+	}
+
+	command := "serve"
+	args := flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
 
-	logger := internal.NewLogger()
+	if !isCommand(command) {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	flag.Parse()
+	// the commands print their output to stdout, so it isn`t mixed with the logs
+	if command != "serve" {
+		config.Log.Output = os.Stderr
+	}
 
-	var db internal.DB
-	var err error
-	if !production {
-		db, err = internal.NewDBSqlite("db.sqlite", logger)
+	logger, logOutput, err := internal.NewLogger(config.Log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the logger: %s\n", err)
+		os.Exit(2)
+	}
+
+	// the code which logs without a logger at hand follows the same config
+	slog.SetDefault(logger)
+
+	ctx := context.Background()
+
+	code := run(ctx, config, command, args, logger)
+	logOutput.Close()
+	os.Exit(code)
+}
+
+// run returns the exit code of the command, 1 when the DB or the app can`t be set up
+func run(ctx context.Context, config internal.Config, command string, args []string, logger *slog.Logger) int {
+	db, err := openDB(ctx, config, logger)
+	if err != nil {
+		return 1
+	}
+
+	if command == "migrate" {
+		err = runMigrateCommand(ctx, db, args, logger)
+		return commandExitCode(command, err)
+	}
+
+	err = db.SetupDB(ctx, logger)
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Failed to setup a DB")
+		return 1
+	}
+
+	app, err := newApp(ctx, config, db, logger)
+	if err != nil {
+		return 1
+	}
+
+	if command == "serve" {
+		err = serve(ctx, app, logger)
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	return runCommand(ctx, app, command, args, logger)
+}
+
+// app holds the DB and the pipeline shared by the server and the CLI commands
+type app struct {
+	config     internal.Config
+	db         internal.DB
+	downloader internal.YouTubeDownloader
+	audioStore internal.AudioStore
+	ingester   *internal.Ingester
+	// index is nil when the fingerprint index is disabled, otherwise it is the db
+	index *internal.IndexedDB
+}
+
+func newApp(ctx context.Context, config internal.Config, db internal.DB, logger *slog.Logger) (*app, error) {
+	downloader, err := internal.NewYtDlpDownloader(config.Tools.YtDlpPath, config.Tools.CookiesPath, config.Paths.DownloadsDir, logger)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Failed to create a youtube downloader")
+		return nil, err
+	}
+
+	audioStore, err := internal.NewAudioStore(config.AudioStore, config.AWS.Region, logger)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Failed to create the audio store")
+		return nil, err
+	}
+
+	var index *internal.IndexedDB
+	if config.FingerprintIndex.Path != "" {
+		index, err = internal.NewIndexedDB(ctx, db, config.FingerprintIndex, config.Search, logger)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Failed to open the fingerprint index")
+			return nil, err
+		}
+		db = index
+	}
+
+	return &app{
+		config:     config,
+		db:         db,
+		downloader: downloader,
+		audioStore: audioStore,
+		ingester:   internal.NewIngester(db, config.DuplicateThreshold, logger),
+		index:      index,
+	}, nil
+}
+
+// close merges the pending changes of the fingerprint index and saves the memory DB
+func (app *app) close(logger *slog.Logger) {
+	if closer, ok := app.db.(internal.Closer); ok {
+		closer.Close(logger)
+	}
+}
+
+// openDB opens the primary DB and wraps it in a ShardedDB with the shards of db.shards
+func openDB(ctx context.Context, config internal.Config, logger *slog.Logger) (internal.DB, error) {
+	db, err := openBackend(ctx, config, "", logger)
+	if err != nil || config.DB.Shards == "" {
+		return db, err
+	}
+
+	locations := strings.Split(config.DB.Shards, ",")
+	shards := make([]internal.DB, len(locations))
+	for i, location := range locations {
+		shards[i], err = openBackend(ctx, config, strings.TrimSpace(location), logger.With(slog.Int("shard", i)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sharded, err := internal.NewShardedDB(db, shards, logger)
+	if err != nil {
+		return nil, err
+	}
+	return sharded, nil
+}
+
+// openBackend opens the DB at location in the terms of the backend (a sqlite file, a postgres url
+// or a mysql host:port/dbname with the credentials of the primary), an empty location is the primary
+func openBackend(ctx context.Context, config internal.Config, location string, logger *slog.Logger) (internal.DB, error) {
+	switch config.DB.Backend {
+	case "sqlite":
+		db, err := internal.NewDBSqlite(cmp.Or(location, config.DB.SqlitePath), config.Search, logger)
 		if err != nil {
 			logger.With(slog.String("err", err.Error())).Error("Failed to create a DB")
-			return
 		}
-	} else {
-		awsClient, err := internal.NewAWSClient(region, logger)
+		return db, err
+	case "mysql":
+		options, err := loadDBConnectionOptions(ctx, config, logger)
 		if err != nil {
-			logger.With(slog.String("err", err.Error())).Error("Failed to create a AWS client")
-			return
+			logger.With(slog.String("err", err.Error())).Error("Failed to resolve the MySql connection options")
+			return nil, err
+		}
+
+		if location != "" {
+			options, err = mysqlShardOptions(options, location)
+			if err != nil {
+				logger.With(slog.String("shard_location", location), slog.String("err", err.Error())).Error("Invalid MySql shard")
+				return nil, err
+			}
 		}
 
-		options, err := awsClient.LoadMysqlDBParameters(logger)
+		db, err := internal.NewDBMysql(options, config.DB.MySql, config.Search, logger)
 		if err != nil {
-			logger.With(slog.String("err", err.Error())).Error("Failed to extracting MySql connection options")
-			return
+			logger.With(slog.String("err", err.Error())).Error("Failed to create a DB")
+		}
+		return db, err
+	case "postgres":
+		postgresUrl := cmp.Or(location, config.DB.PostgresUrl)
+		if postgresUrl == "" {
+			options, err := loadDBConnectionOptions(ctx, config, logger)
+			if err != nil {
+				logger.With(slog.String("err", err.Error())).Error("Failed to resolve the Postgres connection options")
+				return nil, err
+			}
+			postgresUrl = options.PostgresUrl()
 		}
 
-		db, err = internal.NewDBMysql(options, logger)
+		db, err := internal.NewDBPostgres(postgresUrl, config.Search, logger)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Failed to create a DB")
+		}
+		return db, err
+	default:
+		db, err := internal.NewDBMemory(config.DB.SnapshotPath, config.DB.SnapshotInterval, config.Search, logger)
 		if err != nil {
 			logger.With(slog.String("err", err.Error())).Error("Failed to create a DB")
-			return
 		}
+		return db, err
 	}
+}
 
-	err = db.SetupDB(logger)
+// mysqlShardOptions points the connection options at the host:port/dbname of a shard
+func mysqlShardOptions(options internal.DBConnectionOptions, location string) (internal.DBConnectionOptions, error) {
+	addr, dbName, found := strings.Cut(location, "/")
+	if !found || dbName == "" {
+		return options, fmt.Errorf("expected host:port/dbname, got %q", location)
+	}
 
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		logger.With(slog.String("err", err.Error())).Error("Failed to setup a DB")
-		return
+		return options, err
+	}
+
+	options.Host = host
+	options.Port = port
+	options.DBName = dbName
+	return options, nil
+}
+
+// orphanedTempFileAge is the age after which serve removes a temp file at startup,
+// the younger ones can be in use by a CLI command running next to the server
+const orphanedTempFileAge = time.Hour
+
+// serve returns an error when the server couldn`t start or failed, the error is already logged
+func serve(ctx context.Context, app *app, logger *slog.Logger) error {
+	config := app.config
+	db := app.db
+
+	// the early returns close the app as well
+	defer app.close(logger)
+
+	// a previous process could have been killed in the middle of a download or a match
+	for _, dir := range []string{config.Paths.DownloadsDir, config.Paths.UploadsDir} {
+		err := internal.RemoveTempFiles(dir, orphanedTempFileAge, logger)
+		if err != nil {
+			return err
+		}
 	}
 
-	downloader, err := internal.NewYtDlpDownloader("downloads", logger)
+	tracingOptions := config.Tracing
+	tracingOptions.ServiceName = "song_recognition"
+	tracingOptions.Version = buildVersion()
+
+	tracing, err := internal.NewTracing(tracingOptions, logger)
 	if err != nil {
-		logger.With(slog.String("err", err.Error())).Error("Failed to create a youtube downloader")
-		return
+		return err
 	}
 
+	jobs := newBackgroundJobs()
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("GET /songs", createGetSongsPaginationHandler(db, logger))
-	mux.HandleFunc("POST /songs", createAddSongHandler(downloader, db, logger))
-	mux.HandleFunc("POST /match", createMatchSongHandler("uploads", db, logger))
+	timeouts := config.Timeouts
+
+	mux.HandleFunc("GET /songs", createGetSongsPaginationHandler(db, config.Server.DefaultPageSize, timeouts, logger))
+	mux.HandleFunc("POST /songs", createAddSongHandler(jobs, app.downloader, app.ingester, app.audioStore, db, timeouts, logger))
+	mux.HandleFunc("GET /songs/{id}", createGetSongHandler(db, timeouts, logger))
+	mux.HandleFunc("DELETE /songs/{id}", createDeleteSongHandler(app.audioStore, db, timeouts, logger))
+	mux.HandleFunc("POST /songs/{id}/reindex", createReindexSongHandler(jobs, app.downloader, app.ingester, app.audioStore, config.Paths.DownloadsDir, db, timeouts, logger))
+	mux.HandleFunc("POST /match", createMatchSongHandler(config.Paths.UploadsDir, config.Tools.FfmpegPath, config.Server.MaxUploadBytes, db, config.Search.IDFWeighting, timeouts, logger))
+	mux.HandleFunc("GET /healthz", createHealthzHandler())
+	mux.HandleFunc("GET /readyz", createReadyzHandler(db, app.audioStore, config, logger))
+	mux.HandleFunc("GET /version", createVersionHandler(config.DB.Backend))
+	mux.Handle("GET /metrics", promhttp.Handler())
 
-	logger.Debug(fmt.Sprint(production))
+	prometheus.MustRegister(newFingerprintsCollector(db, timeouts.DB, logger))
 
-	if !production {
-		fs := http.FileServer(http.Dir("web"))
+	if !config.Production {
+		fs := http.FileServer(http.Dir(config.Paths.WebDir))
 		mux.Handle("/", http.StripPrefix("/", fs))
 	}
 
 	handler := withCORS(mux)
 	handler = createLoggingMiddleware(handler, logger)
 
-	if !production {
-		http.ListenAndServe(":3000", handler)
-	} else {
-		err := http.ListenAndServe(":80", handler)
-		if err != nil {
-			logger.Error(err.Error())
-		}
+	addr := config.Server.Addr
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	signalCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.With(slog.String("addr", addr)).Info("Server is listening")
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
+		logger.With(slog.String("err", err.Error())).Error("Server failed")
+		return err
+	case <-signalCtx.Done():
+		stop()
 	}
+
+	logger.With(slog.Duration("shutdown_timeout", config.Server.ShutdownTimeout)).Info("Shutting down the server")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, config.Server.ShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("The in-flight requests didn`t finish in time")
+	}
+
+	jobs.Drain(shutdownCtx, logger)
+
+	tracing.Shutdown(shutdownCtx, logger)
+
+	logger.Info("Server was shut down")
+	return nil
 }
 
 func withCORS(next http.Handler) http.Handler {
@@ -102,8 +359,48 @@ func withCORS(next http.Handler) http.Handler {
 }
 func createLoggingMiddleware(next http.Handler, logger *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug(fmt.Sprintf("Request Path: %s, Query Params: %s", r.URL.Path, r.URL.RawQuery))
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
 
-		next.ServeHTTP(w, r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		// the mux sets the matched pattern on this request
+		r = r.WithContext(ctx)
+		next.ServeHTTP(recorder, r)
+
+		observeRequest(r, recorder.status, time.Since(start))
+		span.SetName(r.Method + " " + routeOf(r))
+		span.SetAttributes(
+			attribute.String("http.route", routeOf(r)),
+			attribute.Int("http.status_code", recorder.status),
+		)
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+
+		level := slog.LevelDebug
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+
+		logger.LogAttrs(ctx, level, "Request was handled",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("query", r.URL.RawQuery),
+			slog.Int("status", recorder.status),
+			slog.Int("size", recorder.size),
+			slog.Duration("duration", time.Since(start)),
+		)
 	})
 }
+
+func loadDBConnectionOptions(ctx context.Context, config internal.Config, logger *slog.Logger) (internal.DBConnectionOptions, error) {
+	provider, err := internal.NewSecretProvider(config.Secrets, config.AWS.Region, logger)
+	if err != nil {
+		return internal.DBConnectionOptions{}, err
+	}
+
+	return internal.LoadDBConnectionOptions(ctx, provider, logger)
+}
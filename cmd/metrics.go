@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// the stages take from milliseconds (scoring) to minutes (downloading)
+var stageBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "song_recognition_http_requests_total",
+		Help: "Count of the handled HTTP requests by route, method and status code",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "song_recognition_http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests by route and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "song_recognition_stage_duration_seconds",
+		Help:    "Duration of the ingestion and matching stages: download, convert, stft, fingerprint, db_search, score and db_ingest",
+		Buckets: stageBuckets,
+	}, []string{"stage"})
+
+	ingestQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "song_recognition_ingest_queue_depth",
+		Help: "Count of the background ingestions and reindexes which haven`t finished yet",
+	})
+
+	matchOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "song_recognition_match_outcomes_total",
+		Help: "Count of the match requests by outcome: match, no_match or error",
+	}, []string{"outcome"})
+)
+
+// responseRecorder keeps the status code and the size of the body written by the handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(body []byte) (int, error) {
+	n, err := recorder.ResponseWriter.Write(body)
+	recorder.size += n
+	return n, err
+}
+
+// routeOf is the path of the pattern matched by the mux,
+// so the path values like song ids don`t become labels
+func routeOf(r *http.Request) string {
+	route := r.Pattern
+	if route == "" {
+		return "unmatched"
+	}
+
+	// the method is already a label
+	if _, path, found := strings.Cut(route, " "); found {
+		return path
+	}
+
+	return route
+}
+
+func observeRequest(r *http.Request, status int, duration time.Duration) {
+	route := routeOf(r)
+	httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(route, r.Method).Observe(duration.Seconds())
+}
+
+// fingerprintsCollector asks the DB for the size of the fingerprint index on every scrape
+type fingerprintsCollector struct {
+	db      internal.DB
+	timeout time.Duration
+	logger  *slog.Logger
+	desc    *prometheus.Desc
+}
+
+func newFingerprintsCollector(db internal.DB, timeout time.Duration, logger *slog.Logger) *fingerprintsCollector {
+	return &fingerprintsCollector{
+		db:      db,
+		timeout: timeout,
+		logger:  logger,
+		desc: prometheus.NewDesc(
+			"song_recognition_fingerprints",
+			"Count of the stored fingerprints, an estimate with MySQL and PostgreSQL",
+			nil, nil,
+		),
+	}
+}
+
+func (collector *fingerprintsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.desc
+}
+
+func (collector *fingerprintsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := internal.WithStageTimeout(context.Background(), collector.timeout)
+	defer cancel()
+
+	count, err := collector.db.GetFingerprintsCount(ctx, collector.logger)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(collector.desc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(collector.desc, prometheus.GaugeValue, float64(count))
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/lastvoidtemplar/song_recognition/internal"
+)
+
+// the pipeline stages shared by the handlers and the CLI commands
+
+type matchCandidate struct {
+	Song  internal.Song
+	Score float64
+}
+
+// ingestUrl downloads, fingerprints, stores and archives a YouTube song
+func ingestUrl(ctx context.Context, downloader internal.YouTubeDownloader, ingester *internal.Ingester, audioStore internal.AudioStore, songUrl string, timeouts internal.StageTimeouts, logger *slog.Logger) (internal.IngestResult, error) {
+	audio, fingerprints, err := downloadFingerprints(ctx, downloader, songUrl, timeouts, logger)
+	if err != nil {
+		return internal.IngestResult{SongId: -1, DuplicateOf: -1}, err
+	}
+	defer removeTempFile(audio.WavPath, logger)
+
+	return storeSong(ctx, ingester, audioStore, audio.Title, audio.Artist, songUrl, audio.WavPath, fingerprints, timeouts, logger)
+}
+
+// ingestFile ingests a local file in any format ffmpeg reads, it is converted in tempDir
+func ingestFile(ctx context.Context, ffmpegPath string, tempDir string, ingester *internal.Ingester, audioStore internal.AudioStore, filePath string, title string, artist string, timeouts internal.StageTimeouts, logger *slog.Logger) (internal.IngestResult, error) {
+	wavPath, fingerprints, err := fileFingerprints(ctx, ffmpegPath, tempDir, filePath, timeouts, logger)
+	if err != nil {
+		return internal.IngestResult{SongId: -1, DuplicateOf: -1}, err
+	}
+	defer removeTempFile(wavPath, logger)
+
+	songUrl, err := fileUrl(filePath)
+	if err != nil {
+		return internal.IngestResult{SongId: -1, DuplicateOf: -1}, err
+	}
+
+	return storeSong(ctx, ingester, audioStore, title, artist, songUrl, wavPath, fingerprints, timeouts, logger)
+}
+
+// fileFingerprints keeps the converted wav for the audio store, the caller removes it
+func fileFingerprints(ctx context.Context, ffmpegPath string, tempDir string, filePath string, timeouts internal.StageTimeouts, logger *slog.Logger) (string, map[uint64]uint32, error) {
+	wavPath, err := convertFile(ctx, ffmpegPath, tempDir, filePath, timeouts, logger)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fingerprints, err := wavFingerprints(ctx, wavPath, timeouts, logger)
+	if err != nil {
+		removeTempFile(wavPath, logger)
+		return "", nil, err
+	}
+
+	return wavPath, fingerprints, nil
+}
+
+// fileUrl is the song url of a local file, so the same file isn`t ingested twice
+func fileUrl(filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	u := url.URL{
+		Scheme: "file",
+		Path:   filepath.ToSlash(absPath),
+	}
+	return u.String(), nil
+}
+
+func storeSong(ctx context.Context, ingester *internal.Ingester, audioStore internal.AudioStore, title string, artist string, songUrl string, wavPath string, fingerprints map[uint64]uint32, timeouts internal.StageTimeouts, logger *slog.Logger) (internal.IngestResult, error) {
+	dbCtx, cancel := internal.WithStageTimeout(ctx, timeouts.DB)
+	defer cancel()
+
+	dbCtx, stage := startStage(dbCtx, "db_ingest")
+	result, err := ingester.Ingest(dbCtx, title, artist, songUrl, fingerprints, logger)
+	stage.end(err)
+	if err != nil {
+		return result, err
+	}
+
+	archiveAudio(ctx, audioStore, result.SongId, wavPath, timeouts, logger)
+	return result, nil
+}
+
+// reindexSong replaces the fingerprints of the song with the ones of the current algorithm
+func reindexSong(ctx context.Context, downloader internal.YouTubeDownloader, ingester *internal.Ingester, audioStore internal.AudioStore, downloadsDir string, song internal.Song, timeouts internal.StageTimeouts, logger *slog.Logger) (internal.IngestResult, error) {
+	fingerprints, err := reindexFingerprints(ctx, downloader, audioStore, downloadsDir, song, timeouts, logger)
+	if err != nil {
+		return internal.IngestResult{SongId: song.SongId, DuplicateOf: -1}, err
+	}
+
+	dbCtx, cancel := internal.WithStageTimeout(ctx, timeouts.DB)
+	defer cancel()
+
+	dbCtx, stage := startStage(dbCtx, "db_ingest")
+	result, err := ingester.Reindex(dbCtx, song.SongId, fingerprints, logger)
+	stage.end(err)
+
+	return result, err
+}
+
+// matchWav returns up to top songs sharing time aligned fingerprints with the recording, the best first,
+// with idfWeighting the matches of the hashes common to many songs count less
+func matchWav(ctx context.Context, db internal.DB, wavPath string, top int, idfWeighting bool, timeouts internal.StageTimeouts, logger *slog.Logger) ([]matchCandidate, error) {
+	recordingFingerprints, err := wavFingerprints(ctx, wavPath, timeouts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	dbCtx, cancel := internal.WithStageTimeout(ctx, timeouts.DB)
+	defer cancel()
+
+	searchCtx, stage := startStage(dbCtx, "db_search")
+	dbFingerprints, err := db.SearchFingerprints(searchCtx, slices.Collect(maps.Keys(recordingFingerprints)), logger)
+	stage.end(err)
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Failed to search the database for fingerprints")
+		return nil, err
+	}
+
+	var weights map[uint64]float64
+	if idfWeighting {
+		songsCount, err := db.GetSongsCount(dbCtx, "", logger)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Failed to count the songs for the IDF weights")
+			return nil, err
+		}
+		weights = internal.IDFWeights(dbFingerprints, songsCount)
+	}
+
+	_, stage = startStage(ctx, "score")
+	scores := internal.ScoreFingerprints(recordingFingerprints, dbFingerprints, weights)
+
+	type scoredSong struct {
+		songId int
+		score  float64
+	}
+
+	scored := make([]scoredSong, 0, len(scores))
+	for songId, score := range scores {
+		scored = append(scored, scoredSong{songId: songId, score: score})
+	}
+
+	slices.SortFunc(scored, func(a, b scoredSong) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(a.songId, b.songId))
+	})
+	stage.end(nil)
+
+	candidates := make([]matchCandidate, 0, top)
+	for _, candidate := range scored {
+		if len(candidates) == top {
+			break
+		}
+
+		song, err := db.GetSongById(dbCtx, candidate.songId, logger)
+		// the fingerprints of a song deleted by another process stay in a stale index until it is built again
+		if errors.Is(err, internal.ErrSongNotFound) {
+			logger.With(slog.Int("song_id", candidate.songId)).Warn("Matched song doesn`t exist, it is skipped")
+			continue
+		}
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Failed to get the matched song")
+			return nil, err
+		}
+
+		candidates = append(candidates, matchCandidate{Song: song, Score: candidate.score})
+	}
+
+	return candidates, nil
+}
+
+// convertFile converts a copy of the file in tempDir, so ffmpeg never writes next to the original
+func convertFile(ctx context.Context, ffmpegPath string, tempDir string, filePath string, timeouts internal.StageTimeouts, logger *slog.Logger) (string, error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Failed to open the audio file")
+		return "", err
+	}
+	defer src.Close()
+
+	// ffmpeg detects the format from the content, the extension only has to be there
+	copyFile, err := os.CreateTemp(tempDir, "file-*"+cmp.Or(filepath.Ext(filePath), ".audio"))
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Failed to create the copy of the audio file")
+		return "", err
+	}
+
+	_, err = io.Copy(copyFile, src)
+	copyFile.Close()
+	if err != nil {
+		removeTempFile(copyFile.Name(), logger)
+		logger.With(slog.String("err", err.Error())).Warn("Failed to copy the audio file")
+		return "", err
+	}
+
+	return convertToWav(ctx, ffmpegPath, copyFile.Name(), timeouts, logger)
+}
+
+// convertToWav converts the file with ffmpeg and removes it
+func convertToWav(ctx context.Context, ffmpegPath string, filePath string, timeouts internal.StageTimeouts, logger *slog.Logger) (string, error) {
+	defer removeTempFile(filePath, logger)
+
+	convertCtx, cancel := internal.WithStageTimeout(ctx, timeouts.Convert)
+	defer cancel()
+
+	convertCtx, stage := startStage(convertCtx, "convert")
+	wavPath, err := internal.ConvertWebmToWav(convertCtx, ffmpegPath, filePath, logger)
+	stage.end(err)
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Failed to convert the audio to .wav")
+		return "", err
+	}
+
+	return wavPath, nil
+}
+
+// downloadFingerprints keeps the downloaded wav for the audio store, the caller removes it
+func downloadFingerprints(ctx context.Context, downloader internal.YouTubeDownloader, url string, timeouts internal.StageTimeouts, logger *slog.Logger) (internal.DownloadedAudio, map[uint64]uint32, error) {
+	downloadCtx, cancel := internal.WithStageTimeout(ctx, timeouts.Download)
+	defer cancel()
+
+	downloadCtx, stage := startStage(downloadCtx, "download")
+	audio, err := downloader.DownloadWav(downloadCtx, url, logger)
+	stage.end(err)
+	if err != nil {
+		return audio, nil, err
+	}
+
+	fingerprints, err := wavFingerprints(ctx, audio.WavPath, timeouts, logger)
+	if err != nil {
+		removeTempFile(audio.WavPath, logger)
+		return audio, nil, err
+	}
+
+	return audio, fingerprints, nil
+}
+
+// reindexFingerprints reads the song from the audio store,
+// it is downloaded and archived only when the store doesn`t have it
+func reindexFingerprints(ctx context.Context, downloader internal.YouTubeDownloader, audioStore internal.AudioStore, downloadsDir string, song internal.Song, timeouts internal.StageTimeouts, logger *slog.Logger) (map[uint64]uint32, error) {
+	fetchCtx, cancel := internal.WithStageTimeout(ctx, timeouts.Download)
+	defer cancel()
+
+	fetchCtx, stage := startStage(fetchCtx, "fetch_audio")
+	wavPath, err := audioStore.Fetch(fetchCtx, song.SongId, downloadsDir, logger)
+	if errors.Is(err, internal.ErrAudioNotFound) {
+		stage.end(nil)
+
+		audio, fingerprints, err := downloadFingerprints(ctx, downloader, song.SongUrl, timeouts, logger)
+		if err != nil {
+			return nil, err
+		}
+		defer removeTempFile(audio.WavPath, logger)
+
+		archiveAudio(ctx, audioStore, song.SongId, audio.WavPath, timeouts, logger)
+		return fingerprints, nil
+	}
+	stage.end(err)
+
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempFile(wavPath, logger)
+
+	return wavFingerprints(ctx, wavPath, timeouts, logger)
+}
+
+func wavFingerprints(ctx context.Context, wavPath string, timeouts internal.StageTimeouts, logger *slog.Logger) (map[uint64]uint32, error) {
+	analysisCtx, cancel := internal.WithStageTimeout(ctx, timeouts.Analysis)
+	defer cancel()
+
+	analysisCtx, stage := startStage(analysisCtx, "stft")
+	spectrogram, timePerColm, err := internal.STFT(analysisCtx, wavPath, logger)
+	stage.end(err)
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Failed to analyse the .wav")
+		return nil, err
+	}
+
+	_, stage = startStage(ctx, "fingerprint")
+	fingerprints := internal.GenerateFingerprints(spectrogram, timePerColm)
+	stage.end(nil)
+
+	return fingerprints, nil
+}
+
+// archiveAudio is best effort, a song which isn`t archived is downloaded again by its reindex
+func archiveAudio(ctx context.Context, audioStore internal.AudioStore, songId int, wavPath string, timeouts internal.StageTimeouts, logger *slog.Logger) {
+	archiveCtx, cancel := internal.WithStageTimeout(ctx, timeouts.Download)
+	defer cancel()
+
+	archiveCtx, stage := startStage(archiveCtx, "archive_audio")
+	err := audioStore.Put(archiveCtx, songId, wavPath, logger)
+	stage.end(err)
+}
+
+func removeTempFile(path string, logger *slog.Logger) {
+	err := os.Remove(path)
+	if err != nil {
+		logger.With(slog.String("path", path), slog.String("err", err.Error())).Warn("Failed to delete a temp file")
+	}
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"hash/fnv"
 	"io"
 	"log/slog"
-	"maps"
 	"net/http"
 	"os"
 	"path"
-	"slices"
 	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lastvoidtemplar/song_recognition/internal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const InternalServerErrorMsg = "Internal error occured"
@@ -22,65 +27,139 @@ type ViewSongsDTO struct {
 	Page  int           `json:"page"`
 	Limit int           `json:"limit"`
 	Total int           `json:"total"`
+	// passed as the cursor query param to get the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type ViewSongDTO struct {
-	SongId    int    `json:"song_id"`
-	SongTitle string `json:"song_title"`
-	SongUrl   string `json:"song_url"`
+	SongId      int        `json:"song_id"`
+	SongTitle   string     `json:"song_title"`
+	SongArtist  string     `json:"song_artist"`
+	SongUrl     string     `json:"song_url"`
+	AddedAt     *time.Time `json:"added_at,omitempty"`
+	DuplicateOf *int       `json:"duplicate_of,omitempty"`
 }
 
-func createGetSongsPaginationHandler(db internal.DB, logger *slog.Logger) http.HandlerFunc {
+func newViewSongDTO(song internal.Song) ViewSongDTO {
+	dto := ViewSongDTO{
+		SongId:     song.SongId,
+		SongTitle:  song.SongTitle,
+		SongArtist: song.SongArtist,
+		SongUrl:    song.SongUrl,
+	}
+
+	if !song.AddedAt.IsZero() {
+		addedAt := song.AddedAt.UTC()
+		dto.AddedAt = &addedAt
+	}
+
+	if song.DuplicateOf != -1 {
+		duplicateOf := song.DuplicateOf
+		dto.DuplicateOf = &duplicateOf
+	}
+
+	return dto
+}
+
+func createGetSongsPaginationHandler(db internal.DB, defaultPageSize int, timeouts internal.StageTimeouts, logger *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		reqId := generateReqId()
+		reqId := generateReqId(r.Context())
 		logger := logger.With(slog.String("request_id", reqId))
 
 		query := r.URL.Query()
-		page := 1
-		limit := 14
+		songsQuery := internal.SongsQuery{
+			Search: query.Get("q"),
+			Sort:   internal.SortSongsById,
+			Page:   1,
+			Limit:  defaultPageSize,
+		}
 
 		if t := query.Get("page"); t != "" {
 			i, err := strconv.Atoi(t)
 			if err == nil && 0 < i {
-				page = i
+				songsQuery.Page = i
 			}
 		}
 
 		if t := query.Get("limit"); t != "" {
 			i, err := strconv.Atoi(t)
 			if err == nil && 0 < i {
-				limit = i
+				songsQuery.Limit = i
 			}
 		}
 
-		count, err := db.GetSongsCount(logger)
+		if t := query.Get("sort"); t != "" {
+			sort, ok := internal.ParseSongsSort(t)
+			if !ok {
+				logger.With(slog.String("sort", t)).Debug("Invalid sort")
+				sendError(w, "Invalid sort, expected title, added_at or id", http.StatusBadRequest)
+				return
+			}
+			songsQuery.Sort = sort
+		}
+
+		switch t := query.Get("order"); t {
+		case "", "asc":
+		case "desc":
+			songsQuery.Descending = true
+		default:
+			logger.With(slog.String("order", t)).Debug("Invalid order")
+			sendError(w, "Invalid order, expected asc or desc", http.StatusBadRequest)
+			return
+		}
+
+		if t := query.Get("cursor"); t != "" {
+			cursor, err := decodeSongsCursor(t, songsQuery)
+			if errors.Is(err, errSongsCursorMismatch) {
+				logger.With(slog.String("cursor", t)).Debug("Cursor of another listing")
+				sendError(w, "Invalid cursor, it belongs to another sort, order or search", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				logger.With(slog.String("cursor", t), slog.String("err", err.Error())).Debug("Invalid cursor")
+				sendError(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
+			songsQuery.After = &cursor
+		}
+		songsQuery.LookAhead = true
+
+		ctx, cancel := internal.WithStageTimeout(r.Context(), timeouts.DB)
+		defer cancel()
+
+		count, err := db.GetSongsCount(ctx, songsQuery.Search, logger)
 		if err != nil {
 			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
 			return
 		}
 
-		songs, err := db.GetSongsPagination(page, limit, logger)
+		songs, err := db.GetSongsPagination(ctx, songsQuery, logger)
 		if err != nil {
 			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
 			return
 		}
 
+		hasNext := len(songs) > songsQuery.Limit
+		songs = songs[:min(len(songs), songsQuery.Limit)]
+
 		dto := ViewSongsDTO{
 			Songs: make([]ViewSongDTO, len(songs)),
-			Page:  page,
-			Limit: limit,
+			Page:  songsQuery.Page,
+			Limit: songsQuery.Limit,
 			Total: count,
 		}
 
 		for i, song := range songs {
-			dto.Songs[i].SongId = song.SongId
-			dto.Songs[i].SongTitle = song.SongTitle
-			dto.Songs[i].SongUrl = song.SongUrl
+			dto.Songs[i] = newViewSongDTO(song)
+		}
+
+		if hasNext {
+			dto.NextCursor = encodeSongsCursor(newSongsPageCursor(songs[len(songs)-1], songsQuery))
 		}
 
 		logger.With(
-			slog.Int("page", page),
-			slog.Int("limit", limit),
+			slog.Int("page", songsQuery.Page),
+			slog.Int("limit", songsQuery.Limit),
 		).Debug("Get paginated songs successfully")
 
 		respBody, err := json.Marshal(dto)
@@ -96,13 +175,145 @@ func createGetSongsPaginationHandler(db internal.DB, logger *slog.Logger) http.H
 	}
 }
 
+var errSongsCursorMismatch = errors.New("cursor of another sort, order or search")
+
+// songsPageCursor binds the position to the listing it was returned for,
+// under another sort, order or search it would skip or repeat songs
+type songsPageCursor struct {
+	internal.SongsCursor
+	Sort       internal.SongsSort `json:"sort"`
+	Descending bool               `json:"desc,omitempty"`
+	// the search itself can be long and isn`t needed to check the cursor
+	SearchHash uint64 `json:"q"`
+}
+
+func newSongsPageCursor(song internal.Song, query internal.SongsQuery) songsPageCursor {
+	return songsPageCursor{
+		SongsCursor: internal.NewSongsCursor(song),
+		Sort:        query.Sort,
+		Descending:  query.Descending,
+		SearchHash:  songsSearchHash(query.Search),
+	}
+}
+
+func songsSearchHash(search string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(search))
+	return hash.Sum64()
+}
+
+func encodeSongsCursor(cursor songsPageCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeSongsCursor returns errSongsCursorMismatch when the cursor was returned for another listing than the query
+func decodeSongsCursor(encoded string, query internal.SongsQuery) (internal.SongsCursor, error) {
+	var cursor songsPageCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor.SongsCursor, err
+	}
+
+	err = json.Unmarshal(raw, &cursor)
+	if err != nil {
+		return cursor.SongsCursor, err
+	}
+
+	if cursor.Sort != query.Sort || cursor.Descending != query.Descending || cursor.SearchHash != songsSearchHash(query.Search) {
+		return cursor.SongsCursor, errSongsCursorMismatch
+	}
+	return cursor.SongsCursor, nil
+}
+
+type ViewSongDetailsDTO struct {
+	ViewSongDTO
+	FingerprintsCount int `json:"fingerprints_count"`
+	// seconds of the song covered by the fingerprints
+	DurationCovered    float64 `json:"duration_covered"`
+	FingerprintVersion int     `json:"fingerprint_version"`
+	// omitted when the song was indexed with an older fingerprint version
+	AnalysisConfig *internal.AnalysisConfig `json:"analysis_config,omitempty"`
+	IndexedAt      *time.Time               `json:"indexed_at,omitempty"`
+}
+
+func createGetSongHandler(db internal.DB, timeouts internal.StageTimeouts, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqId := generateReqId(r.Context())
+		logger := logger.With(slog.String("request_id", reqId))
+
+		songId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			logger.With(slog.String("id", r.PathValue("id"))).Debug("Invalid song id")
+			sendError(w, "Invalid song id", http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.With(slog.Int("song_id", songId))
+
+		ctx, cancel := internal.WithStageTimeout(r.Context(), timeouts.DB)
+		defer cancel()
+
+		song, err := db.GetSongById(ctx, songId, logger)
+
+		if errors.Is(err, internal.ErrSongNotFound) {
+			sendError(w, "Song not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		stats, err := db.GetSongStats(ctx, songId, logger)
+		if err != nil {
+			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		dto := ViewSongDetailsDTO{
+			ViewSongDTO:        newViewSongDTO(song),
+			FingerprintsCount:  stats.FingerprintsCount,
+			DurationCovered:    float64(stats.LastTimestamp-stats.FirstTimestamp) / 1000,
+			FingerprintVersion: song.FingerprintVersion,
+		}
+
+		if song.FingerprintVersion == internal.FingerprintVersion {
+			config := internal.CurrentAnalysisConfig()
+			dto.AnalysisConfig = &config
+		}
+
+		if !song.IndexedAt.IsZero() {
+			indexedAt := song.IndexedAt.UTC()
+			dto.IndexedAt = &indexedAt
+		}
+
+		logger.Debug("Get song successfully")
+
+		respBody, err := json.Marshal(dto)
+		if err != nil {
+			logger.With(
+				slog.String("err", err.Error()),
+			).Warn("Error while marshaling the response of the get song")
+			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(respBody)
+	}
+}
+
 type AddSongDTO struct {
 	SongUrl string `json:"song_url"`
 }
 
-func createAddSongHandler(downloader internal.YouTubeDownloader, db internal.DB, logger *slog.Logger) http.HandlerFunc {
+// the song is downloaded and ingested as a background job,
+// so it outlives the request and is drained on shutdown
+func createAddSongHandler(jobs *backgroundJobs, downloader internal.YouTubeDownloader, ingester *internal.Ingester, audioStore internal.AudioStore, db internal.DB, timeouts internal.StageTimeouts, logger *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		reqId := generateReqId()
+		reqId := generateReqId(r.Context())
 		logger := logger.With(slog.String("request_id", reqId))
 
 		var dto AddSongDTO
@@ -123,7 +334,10 @@ func createAddSongHandler(downloader internal.YouTubeDownloader, db internal.DB,
 
 		url, _ := internal.StripUrl(dto.SongUrl)
 
-		found, err := db.CheckSongByUrl(url, logger)
+		ctx, cancel := internal.WithStageTimeout(r.Context(), timeouts.DB)
+		defer cancel()
+
+		found, err := db.CheckSongByUrl(ctx, url, logger)
 
 		if err != nil {
 			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
@@ -141,49 +355,119 @@ func createAddSongHandler(downloader internal.YouTubeDownloader, db internal.DB,
 			return
 		}
 
+		started := jobs.Go(r.Context(), func(jobCtx context.Context) {
+			logger := logger.With(slog.String("url", url))
+			ingestUrl(jobCtx, downloader, ingester, audioStore, url, timeouts, logger)
+		})
+		if !started {
+			logger.With(slog.String("url", url)).Debug("Server is shutting down, the song isn`t added")
+			sendError(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
 		w.WriteHeader(http.StatusCreated)
+	}
+}
 
-		go func() {
-			logger = logger.With(slog.String("url", url))
-			title, wavPath, err := downloader.DownloadWav(url, logger)
-			if err != nil {
-				return
-			}
+func createDeleteSongHandler(audioStore internal.AudioStore, db internal.DB, timeouts internal.StageTimeouts, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqId := generateReqId(r.Context())
+		logger := logger.With(slog.String("request_id", reqId))
+
+		songId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			logger.With(slog.String("id", r.PathValue("id"))).Debug("Invalid song id")
+			sendError(w, "Invalid song id", http.StatusBadRequest)
+			return
+		}
 
-			spectrogram, timePerColm := internal.STFT(wavPath, logger)
+		logger = logger.With(slog.Int("song_id", songId))
 
-			err = os.Remove(wavPath)
-			if err != nil {
-				logger.With(slog.String("wav_path", wavPath), slog.String("err", err.Error())).Warn("Failed to delete the .wav")
-			}
+		ctx, cancel := internal.WithStageTimeout(r.Context(), timeouts.DB)
+		defer cancel()
 
-			fingerprints := internal.GenerateFingerprints(spectrogram, timePerColm)
+		promotedId, err := db.DeleteSong(ctx, songId, logger)
 
-			songId, err := db.InsertSong(title, url, logger)
+		if errors.Is(err, internal.ErrSongNotFound) {
+			sendError(w, "Song not found", http.StatusNotFound)
+			return
+		}
 
-			if err != nil {
-				return
-			}
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Error while deleting a song")
+			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		// a leftover archive only costs storage, so the song stays deleted
+		audioStore.Delete(ctx, songId, logger)
 
-			logger = logger.With(slog.Int("song_id", songId))
+		if promotedId != -1 {
+			logger.With(slog.Int("promoted_song_id", promotedId)).Info("Duplicate of the deleted song was promoted to the original")
+		}
 
-			for hash, timestamp := range fingerprints {
-				err = db.InsertFingerprint(hash, songId, timestamp, logger)
+		logger.Debug("Delete song successfully")
 
-				if err != nil {
-					return
-				}
-			}
-		}()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func createReindexSongHandler(jobs *backgroundJobs, downloader internal.YouTubeDownloader, ingester *internal.Ingester, audioStore internal.AudioStore, downloadsDir string, db internal.DB, timeouts internal.StageTimeouts, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqId := generateReqId(r.Context())
+		logger := logger.With(slog.String("request_id", reqId))
+
+		songId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			logger.With(slog.String("id", r.PathValue("id"))).Debug("Invalid song id")
+			sendError(w, "Invalid song id", http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.With(slog.Int("song_id", songId))
+
+		ctx, cancel := internal.WithStageTimeout(r.Context(), timeouts.DB)
+		defer cancel()
+
+		song, err := db.GetSongById(ctx, songId, logger)
+
+		if errors.Is(err, internal.ErrSongNotFound) {
+			sendError(w, "Song not found", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Error while reindexing a song")
+			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		started := jobs.Go(r.Context(), func(jobCtx context.Context) {
+			logger := logger.With(slog.String("url", song.SongUrl))
+			reindexSong(jobCtx, downloader, ingester, audioStore, downloadsDir, song, timeouts, logger)
+		})
+		if !started {
+			logger.With(slog.Int("song_id", song.SongId)).Debug("Server is shutting down, the song isn`t reindexed")
+			sendError(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-func createMatchSongHandler(uploadPath string, db internal.DB, logger *slog.Logger) http.HandlerFunc {
+func createMatchSongHandler(uploadPath string, ffmpegPath string, maxUploadBytes int64, db internal.DB, idfWeighting bool, timeouts internal.StageTimeouts, logger *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		reqId := generateReqId()
+		reqId := generateReqId(r.Context())
 		logger := logger.With(slog.String("request_id", reqId))
 
-		r.ParseMultipartForm(10 << 20)
+		// every return before a song is found is an error
+		outcome := "error"
+		defer func() {
+			matchOutcomes.WithLabelValues(outcome).Inc()
+		}()
+
+		r.ParseMultipartForm(maxUploadBytes)
 
 		audio, headers, err := r.FormFile("audio")
 		if err != nil {
@@ -213,63 +497,35 @@ func createMatchSongHandler(uploadPath string, db internal.DB, logger *slog.Logg
 			return
 		}
 
-		wavPath, err := internal.ConvertWebmToWav(webmPath, logger)
-
+		// the stages are bound to the request, so an aborted request stops ffmpeg, STFT and SQL
+		wavPath, err := convertToWav(r.Context(), ffmpegPath, webmPath, timeouts, logger)
 		if err != nil {
-			logger.With(slog.String("err", err.Error())).Warn("Failed to convert the .webm to .wav")
 			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
 			return
 		}
+		defer removeTempFile(wavPath, logger)
 
-		err = os.Remove(webmPath)
-		if err != nil {
-			logger.With(slog.String("webm_path", webmPath), slog.String("err", err.Error())).Warn("Failed to delete the .webm")
-		}
-
-		spectrogram, timePerColm := internal.STFT(wavPath, logger)
-
-		err = os.Remove(wavPath)
-		if err != nil {
-			logger.With(slog.String("wav_path", wavPath), slog.String("err", err.Error())).Warn("Failed to delete the .wav")
-		}
-
-		recordingFingerprints := internal.GenerateFingerprints(spectrogram, timePerColm)
-
-		dbFingerprints, err := db.SearchFingerprints(slices.Collect(maps.Keys(recordingFingerprints)), logger)
-
+		candidates, err := matchWav(r.Context(), db, wavPath, 1, idfWeighting, timeouts, logger)
 		if err != nil {
-			logger.With(slog.String("err", err.Error())).Warn("Failed to search the database for fingerprints")
 			sendError(w, InternalServerErrorMsg, http.StatusInternalServerError)
 			return
 		}
 
-		scores := internal.ScoreFingerprints(recordingFingerprints, dbFingerprints)
-
-		maxScore := -1
-		matchSongId := -1
-		for songId, score := range scores {
-			if maxScore < score {
-				matchSongId = songId
-				maxScore = score
-			}
-		}
-
-		song, err := db.GetSongById(matchSongId, logger)
-
-		if err != nil {
-			logger.With(slog.String("err", err.Error())).Warn("Failed to get song url from song id")
-			http.Error(w, InternalServerErrorMsg, http.StatusInternalServerError)
+		if len(candidates) == 0 {
+			outcome = "no_match"
+			logger.Debug("No song matches the recording")
+			sendError(w, "No matching song found", http.StatusNotFound)
 			return
 		}
-		var dto ViewSongDTO
 
-		dto.SongId = song.SongId
-		dto.SongTitle = song.SongTitle
-		dto.SongUrl = song.SongUrl
+		song := candidates[0].Song
+		maxScore := candidates[0].Score
+		dto := newViewSongDTO(song)
 
+		outcome = "match"
 		logger.With(
-			slog.Int("song_id", matchSongId),
-			slog.Int("score", maxScore),
+			slog.Int("song_id", song.SongId),
+			slog.Float64("score", maxScore),
 		).Debug("Match recording successfully")
 
 		respBody, err := json.Marshal(dto)
@@ -285,8 +541,12 @@ func createMatchSongHandler(uploadPath string, db internal.DB, logger *slog.Logg
 	}
 }
 
-func generateReqId() string {
-	return uuid.NewString()
+// generateReqId also tags the span of the request,
+// so the trace can be found by the request_id from the logs
+func generateReqId(ctx context.Context) string {
+	reqId := uuid.NewString()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("request_id", reqId))
+	return reqId
 }
 
 type ErrorResponse struct {
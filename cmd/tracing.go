@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/lastvoidtemplar/song_recognition")
+
+// stage is a single step of an ingestion or a match,
+// it is both a span and an observation of the stage duration histogram
+type stage struct {
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+func startStage(ctx context.Context, name string) (context.Context, *stage) {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attribute.String("stage", name)))
+	return ctx, &stage{
+		name:  name,
+		start: time.Now(),
+		span:  span,
+	}
+}
+
+func (stage *stage) end(err error) {
+	stageDuration.WithLabelValues(stage.name).Observe(time.Since(stage.start).Seconds())
+
+	if err != nil {
+		stage.span.RecordError(err)
+		stage.span.SetStatus(codes.Error, err.Error())
+	}
+	stage.span.End()
+}
+
+// detachedContext keeps the span of the request in the context of a background job,
+// so the spans of the job are part of the request trace even after the request has finished
+func detachedContext(jobCtx context.Context, requestCtx context.Context) context.Context {
+	return trace.ContextWithSpanContext(jobCtx, trace.SpanContextFromContext(requestCtx))
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// AudioExtensions are the files which are taken as audio without reading them
+var AudioExtensions = []string{".wav", ".mp3", ".flac", ".ogg", ".opus", ".m4a", ".aac", ".webm", ".mka", ".wma"}
+
+// IsAudioFile detects the audio by the extension
+// or by the magic bytes of the common containers when the extension is unknown
+func IsAudioFile(path string) (bool, error) {
+	if slices.Contains(AudioExtensions, strings.ToLower(filepath.Ext(path))) {
+		return true, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 12)
+	_, err = io.ReadFull(file, header)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return hasAudioMagic(header), nil
+}
+
+func hasAudioMagic(header []byte) bool {
+	switch {
+	case bytes.HasPrefix(header, []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return true
+	case bytes.HasPrefix(header, []byte("ID3")), // mp3 with ID3v2 tags
+		bytes.HasPrefix(header, []byte("fLaC")),
+		bytes.HasPrefix(header, []byte("OggS")),
+		bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}): // matroska and webm
+		return true
+	case bytes.Equal(header[4:8], []byte("ftyp")): // mp4 and m4a
+		return true
+	case header[0] == 0xFF && header[1]&0xE0 == 0xE0: // the frame sync of mp3 and aac
+		return true
+	}
+	return false
+}
+
+type AudioTags struct {
+	Title  string
+	Artist string
+}
+
+// ReadAudioTags reads the title and the artist from the tags with ffprobe,
+// the missing ones are taken from the file name
+func ReadAudioTags(ctx context.Context, ffprobePath string, path string, logger *slog.Logger) AudioTags {
+	logger = logger.With(slog.String("file_path", path))
+
+	fromName := AudioTagsFromFileName(path)
+
+	cmd := exec.CommandContext(ctx, ffprobePath, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", path)
+	output, err := cmd.Output()
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Debug("Couldn`t read the tags with ffprobe")
+		return fromName
+	}
+
+	var probe struct {
+		Format struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal(output, &probe)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Debug("Couldn`t parse the output of ffprobe")
+		return fromName
+	}
+
+	// the ogg containers keep the tags in the stream and the tag names differ in case
+	tags := []map[string]string{probe.Format.Tags}
+	for _, stream := range probe.Streams {
+		tags = append(tags, stream.Tags)
+	}
+
+	return AudioTags{
+		Title:  cmp.Or(findTag(tags, "title"), fromName.Title),
+		Artist: cmp.Or(findTag(tags, "artist"), fromName.Artist),
+	}
+}
+
+func findTag(tags []map[string]string, name string) string {
+	for _, tagMap := range tags {
+		for key, value := range tagMap {
+			if strings.EqualFold(key, name) && strings.TrimSpace(value) != "" {
+				return strings.TrimSpace(value)
+			}
+		}
+	}
+	return ""
+}
+
+// a leading track number like "01 - " or "1. "
+var trackNumberPattern = regexp.MustCompile(`^\d{1,3}\s*[-.]\s+`)
+
+// AudioTagsFromFileName parses "Artist - Title", a file name without the separator is the title
+func AudioTagsFromFileName(path string) AudioTags {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = strings.TrimSpace(trackNumberPattern.ReplaceAllString(name, ""))
+
+	artist, title, found := strings.Cut(name, " - ")
+	if !found {
+		return AudioTags{Title: name}
+	}
+
+	return AudioTags{
+		Title:  strings.TrimSpace(title),
+		Artist: strings.TrimSpace(artist),
+	}
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var ErrAudioNotFound = errors.New("audio not found")
+var ErrUnknownAudioStore = errors.New("unknown audio store")
+
+// AudioStore archives the mono PCM wav of every ingested song keyed by its id,
+// so a reindex reads it instead of downloading the song again
+type AudioStore interface {
+	Put(ctx context.Context, songId int, wavPath string, logger *slog.Logger) error
+	// Fetch copies the archived wav to a new file in dir and returns its path,
+	// the caller removes the file, ErrAudioNotFound when the song isn`t archived
+	Fetch(ctx context.Context, songId int, dir string, logger *slog.Logger) (string, error)
+	Delete(ctx context.Context, songId int, logger *slog.Logger) error
+	Ping(ctx context.Context, logger *slog.Logger) error
+}
+
+type AudioStoreConfig struct {
+	// Backend is none, local or s3, none keeps nothing and a reindex downloads the song again
+	Backend  string `yaml:"backend" env:"AUDIO_STORE"`
+	LocalDir string `yaml:"local_dir" env:"AUDIO_STORE_DIR"`
+	// S3Endpoint is only set for the S3 compatible stores like MinIO
+	S3Endpoint string `yaml:"s3_endpoint" env:"AUDIO_STORE_S3_ENDPOINT"`
+	S3Bucket   string `yaml:"s3_bucket" env:"AUDIO_STORE_S3_BUCKET"`
+	S3Prefix   string `yaml:"s3_prefix" env:"AUDIO_STORE_S3_PREFIX"`
+	// S3PathStyle addresses the bucket in the path instead of the host, MinIO needs it
+	S3PathStyle bool `yaml:"s3_path_style" env:"AUDIO_STORE_S3_PATH_STYLE"`
+}
+
+func DefaultAudioStoreConfig() AudioStoreConfig {
+	return AudioStoreConfig{
+		Backend:  "none",
+		LocalDir: "audio",
+		S3Prefix: "songs/",
+	}
+}
+
+func NewAudioStore(config AudioStoreConfig, region string, logger *slog.Logger) (AudioStore, error) {
+	logger = logger.With(slog.String("audio_store", config.Backend))
+
+	switch config.Backend {
+	case "none":
+		return nopAudioStore{}, nil
+	case "local":
+		return NewLocalAudioStore(config.LocalDir, logger)
+	case "s3":
+		return NewS3AudioStore(region, config.S3Endpoint, config.S3Bucket, config.S3Prefix, config.S3PathStyle, logger)
+	default:
+		logger.Error("Unknown audio store, expected none, local or s3")
+		return nil, ErrUnknownAudioStore
+	}
+}
+
+func audioKey(songId int) string {
+	return strconv.Itoa(songId) + ".wav"
+}
+
+// copyToTemp writes the reader to a new file in dir, the file is removed when the copy fails
+func copyToTemp(dir string, pattern string, reader io.Reader) (string, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(file, reader)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+type nopAudioStore struct{}
+
+func (nopAudioStore) Put(ctx context.Context, songId int, wavPath string, logger *slog.Logger) error {
+	return nil
+}
+
+func (nopAudioStore) Fetch(ctx context.Context, songId int, dir string, logger *slog.Logger) (string, error) {
+	return "", ErrAudioNotFound
+}
+
+func (nopAudioStore) Delete(ctx context.Context, songId int, logger *slog.Logger) error {
+	return nil
+}
+
+func (nopAudioStore) Ping(ctx context.Context, logger *slog.Logger) error {
+	return nil
+}
+
+type localAudioStore struct {
+	dir string
+}
+
+// NewLocalAudioStore keeps the archive as <dir>/<song_id>.wav, the dir is created when it is missing
+func NewLocalAudioStore(dir string, logger *slog.Logger) (AudioStore, error) {
+	logger = logger.With(slog.String("dir", dir))
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t create the audio store directory")
+		return nil, err
+	}
+
+	logger.Info("Local audio store is created successfully")
+	return &localAudioStore{
+		dir: dir,
+	}, nil
+}
+
+func (store *localAudioStore) Put(ctx context.Context, songId int, wavPath string, logger *slog.Logger) error {
+	logger = logger.With(slog.Int("song_id", songId), slog.String("wav_path", wavPath))
+
+	src, err := os.Open(wavPath)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t open the wav to archive")
+		return err
+	}
+	defer src.Close()
+
+	// the wav is renamed into place, so a crash never leaves a truncated archive
+	tempPath, err := copyToTemp(store.dir, ".archive-*", src)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t copy the wav to the audio store")
+		return err
+	}
+
+	err = os.Rename(tempPath, filepath.Join(store.dir, audioKey(songId)))
+	if err != nil {
+		os.Remove(tempPath)
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t archive the wav")
+		return err
+	}
+
+	logger.Debug("Wav was archived successfully")
+	return nil
+}
+
+func (store *localAudioStore) Fetch(ctx context.Context, songId int, dir string, logger *slog.Logger) (string, error) {
+	logger = logger.With(slog.Int("song_id", songId))
+
+	src, err := os.Open(filepath.Join(store.dir, audioKey(songId)))
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Debug("Song isn`t archived")
+		return "", ErrAudioNotFound
+	}
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t open the archived wav")
+		return "", err
+	}
+	defer src.Close()
+
+	wavPath, err := copyToTemp(dir, fmt.Sprintf("song-%d-*.wav", songId), src)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t copy the archived wav")
+		return "", err
+	}
+
+	return wavPath, nil
+}
+
+func (store *localAudioStore) Delete(ctx context.Context, songId int, logger *slog.Logger) error {
+	err := os.Remove(filepath.Join(store.dir, audioKey(songId)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.With(slog.Int("song_id", songId), slog.String("err", err.Error())).Warn("Couldn`t delete the archived wav")
+		return err
+	}
+
+	return nil
+}
+
+func (store *localAudioStore) Ping(ctx context.Context, logger *slog.Logger) error {
+	return CheckWritableDir(store.dir, logger)
+}
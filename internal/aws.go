@@ -8,11 +8,13 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
-type AWSClient struct {
+type ssmSecretProvider struct {
 	ssmClient *ssm.Client
+	prefix    string
 }
 
-func NewAWSClient(region string, logger *slog.Logger) (*AWSClient, error) {
+// NewSSMSecretProvider reads the parameters from AWS SSM, the name db_host is read from <prefix>db_host
+func NewSSMSecretProvider(region string, prefix string, logger *slog.Logger) (SecretProvider, error) {
 	ctx := context.Background()
 
 	conf, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
@@ -22,44 +24,42 @@ func NewAWSClient(region string, logger *slog.Logger) (*AWSClient, error) {
 		return nil, err
 	}
 
-	return &AWSClient{
+	return &ssmSecretProvider{
 		ssmClient: ssm.NewFromConfig(conf),
+		prefix:    prefix,
 	}, nil
 }
 
-func (client *AWSClient) LoadMysqlDBParameters(logger *slog.Logger) (DBMySqlConnectionOption, error) {
-	ctx := context.Background()
-
-	paramKeys := []string{
-		"/rds/db_host",
-		"/rds/db_port",
-		"/rds/db_username",
-		"/rds/db_password",
-		"/rds/db_name",
+func (provider *ssmSecretProvider) GetParameters(ctx context.Context, names []string, logger *slog.Logger) (map[string]string, error) {
+	paramKeys := make([]string, len(names))
+	for i, name := range names {
+		paramKeys[i] = provider.prefix + name
 	}
 
-	params := make(map[string]string)
-
 	decryption := true
-	result, err := client.ssmClient.GetParameters(ctx, &ssm.GetParametersInput{
+	result, err := provider.ssmClient.GetParameters(ctx, &ssm.GetParametersInput{
 		Names:          paramKeys,
 		WithDecryption: &decryption,
 	})
 
 	if err != nil {
-		logger.With(slog.String("err", err.Error())).Error("Error while extracting db connection params")
-		return DBMySqlConnectionOption{}, err
+		logger.With(slog.String("err", err.Error())).Error("Error while extracting the ssm parameters")
+		return nil, err
 	}
 
+	if len(result.InvalidParameters) > 0 {
+		return nil, missingParameters("ssm", result.InvalidParameters, logger)
+	}
+
+	values := make(map[string]string, len(result.Parameters))
 	for _, param := range result.Parameters {
-		params[*param.Name] = *param.Value
+		values[*param.Name] = *param.Value
+	}
+
+	params := make(map[string]string, len(names))
+	for i, name := range names {
+		params[name] = values[paramKeys[i]]
 	}
 
-	return DBMySqlConnectionOption{
-		Host:     params["/rds/db_host"],
-		Port:     params["/rds/db_port"],
-		Username: params["/rds/db_username"],
-		Password: params["/rds/db_password"],
-		DBName:   params["/rds/db_name"],
-	}, err
+	return params, nil
 }
@@ -0,0 +1,343 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+)
+
+var ErrInvalidCatalog = errors.New("invalid catalog")
+var ErrIncompatibleCatalog = errors.New("incompatible catalog")
+
+// CatalogFormatVersion must be increased on every change of the layout of the catalog
+const CatalogFormatVersion = 1
+
+// the magic and the format version are written before the gzip stream,
+// so a file is recognised without decompressing it
+var catalogMagic = []byte("SRCATLG")
+
+const (
+	catalogEndTag  = 0
+	catalogSongTag = 1
+)
+
+// the limits protect the reader from allocating a corrupted length
+const (
+	maxCatalogHeaderSize = 1 << 20
+	maxCatalogStringSize = 1 << 16
+)
+
+// CatalogHeader describes how the fingerprints of the catalog were made
+type CatalogHeader struct {
+	FormatVersion      int            `json:"format_version"`
+	FingerprintVersion int            `json:"fingerprint_version"`
+	AnalysisConfig     AnalysisConfig `json:"analysis_config"`
+	ExportedAt         time.Time      `json:"exported_at"`
+}
+
+// NewCatalogHeader is the header of a catalog made with the current analysis
+func NewCatalogHeader() CatalogHeader {
+	return CatalogHeader{
+		FormatVersion:      CatalogFormatVersion,
+		FingerprintVersion: FingerprintVersion,
+		AnalysisConfig:     CurrentAnalysisConfig(),
+		ExportedAt:         time.Now().UTC(),
+	}
+}
+
+// CheckCompatible returns ErrIncompatibleCatalog when the fingerprints of the catalog
+// wouldn`t match the fingerprints made by this build
+func (header CatalogHeader) CheckCompatible(logger *slog.Logger) error {
+	logger = logger.With(
+		slog.Int("catalog_fingerprint_version", header.FingerprintVersion),
+		slog.Int("fingerprint_version", FingerprintVersion),
+	)
+
+	if header.FingerprintVersion != FingerprintVersion {
+		logger.Error("Catalog was made with another fingerprint version")
+		return fmt.Errorf("%w: fingerprint version %d, expected %d", ErrIncompatibleCatalog, header.FingerprintVersion, FingerprintVersion)
+	}
+
+	if !reflect.DeepEqual(header.AnalysisConfig, CurrentAnalysisConfig()) {
+		logger.Error("Catalog was made with another analysis config")
+		return fmt.Errorf("%w: analysis config differs", ErrIncompatibleCatalog)
+	}
+
+	return nil
+}
+
+// CatalogSong is a song of the catalog with its fingerprints (hash to timestamp)
+type CatalogSong struct {
+	Song         Song
+	Fingerprints map[uint64]uint32
+}
+
+// CatalogWriter streams the songs into a gzip compressed catalog,
+// Close must be called to write the end of the catalog
+type CatalogWriter struct {
+	gzip *gzip.Writer
+	buf  []byte
+}
+
+func NewCatalogWriter(w io.Writer, header CatalogHeader) (*CatalogWriter, error) {
+	_, err := w.Write(append(slices.Clone(catalogMagic), CatalogFormatVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &CatalogWriter{
+		gzip: gzip.NewWriter(w),
+	}
+
+	writer.buf = binary.AppendUvarint(writer.buf[:0], uint64(len(headerJson)))
+	writer.buf = append(writer.buf, headerJson...)
+	_, err = writer.gzip.Write(writer.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// WriteSong writes the song with its hashes sorted and delta encoded, which keeps them small
+func (writer *CatalogWriter) WriteSong(song Song, fingerprints map[uint64]uint32) error {
+	buf := append(writer.buf[:0], catalogSongTag)
+	buf = binary.AppendUvarint(buf, uint64(song.SongId))
+	buf = appendCatalogString(buf, song.SongTitle)
+	buf = appendCatalogString(buf, song.SongArtist)
+	buf = appendCatalogString(buf, song.SongUrl)
+	buf = appendCatalogTime(buf, song.AddedAt)
+	buf = binary.AppendUvarint(buf, uint64(song.FingerprintVersion))
+	buf = appendCatalogTime(buf, song.IndexedAt)
+	// shifted by one, so -1 (not a duplicate) is zero
+	buf = binary.AppendUvarint(buf, uint64(song.DuplicateOf+1))
+
+	hashes := slices.Sorted(maps.Keys(fingerprints))
+	buf = binary.AppendUvarint(buf, uint64(len(hashes)))
+	var prevHash uint64
+	for _, hash := range hashes {
+		buf = binary.AppendUvarint(buf, hash-prevHash)
+		buf = binary.AppendUvarint(buf, uint64(fingerprints[hash]))
+		prevHash = hash
+	}
+
+	writer.buf = buf
+	_, err := writer.gzip.Write(buf)
+	return err
+}
+
+func (writer *CatalogWriter) Close() error {
+	_, err := writer.gzip.Write([]byte{catalogEndTag})
+	closeErr := writer.gzip.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func appendCatalogString(buf []byte, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// the zero time is written as zero
+func appendCatalogTime(buf []byte, value time.Time) []byte {
+	if value.IsZero() {
+		return binary.AppendUvarint(buf, 0)
+	}
+	return binary.AppendUvarint(buf, uint64(value.UnixMicro()))
+}
+
+// CatalogReader streams the songs of a catalog written by CatalogWriter
+type CatalogReader struct {
+	header CatalogHeader
+	gzip   *gzip.Reader
+	reader *bufio.Reader
+	done   bool
+}
+
+// NewCatalogReader reads the header, the songs are read with Next
+func NewCatalogReader(r io.Reader, logger *slog.Logger) (*CatalogReader, error) {
+	prefix := make([]byte, len(catalogMagic)+1)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil || string(prefix[:len(catalogMagic)]) != string(catalogMagic) {
+		logger.Error("File isn`t a catalog")
+		return nil, ErrInvalidCatalog
+	}
+
+	formatVersion := int(prefix[len(catalogMagic)])
+	if formatVersion != CatalogFormatVersion {
+		logger.With(slog.Int("format_version", formatVersion)).Error("Catalog format isn`t supported")
+		return nil, fmt.Errorf("%w: format version %d, expected %d", ErrIncompatibleCatalog, formatVersion, CatalogFormatVersion)
+	}
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t decompress the catalog")
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCatalog, err)
+	}
+
+	catalogReader := &CatalogReader{
+		gzip:   gzipReader,
+		reader: bufio.NewReader(gzipReader),
+	}
+
+	headerSize, err := binary.ReadUvarint(catalogReader.reader)
+	if err != nil || headerSize > maxCatalogHeaderSize {
+		logger.Error("Catalog header is corrupted")
+		return nil, ErrInvalidCatalog
+	}
+
+	headerJson := make([]byte, headerSize)
+	_, err = io.ReadFull(catalogReader.reader, headerJson)
+	if err == nil {
+		err = json.Unmarshal(headerJson, &catalogReader.header)
+	}
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Catalog header is corrupted")
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCatalog, err)
+	}
+
+	return catalogReader, nil
+}
+
+func (reader *CatalogReader) Header() CatalogHeader {
+	return reader.header
+}
+
+// Next returns io.EOF after the last song, ErrInvalidCatalog when the catalog is truncated or corrupted
+func (reader *CatalogReader) Next() (CatalogSong, error) {
+	if reader.done {
+		return CatalogSong{}, io.EOF
+	}
+
+	song, err := reader.readSong()
+	if err == io.EOF {
+		reader.done = true
+		return CatalogSong{}, io.EOF
+	}
+	if err != nil {
+		reader.done = true
+		return CatalogSong{}, fmt.Errorf("%w: %w", ErrInvalidCatalog, err)
+	}
+
+	return song, nil
+}
+
+func (reader *CatalogReader) readSong() (CatalogSong, error) {
+	tag, err := reader.reader.ReadByte()
+	if err != nil {
+		return CatalogSong{}, noEOF(err)
+	}
+
+	switch tag {
+	case catalogEndTag:
+		return CatalogSong{}, io.EOF
+	case catalogSongTag:
+	default:
+		return CatalogSong{}, fmt.Errorf("unknown record tag %d", tag)
+	}
+
+	var song Song
+	var fields [4]uint64
+
+	fields[0], err = binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return CatalogSong{}, noEOF(err)
+	}
+	song.SongId = int(fields[0])
+
+	for _, field := range []*string{&song.SongTitle, &song.SongArtist, &song.SongUrl} {
+		*field, err = reader.readString()
+		if err != nil {
+			return CatalogSong{}, err
+		}
+	}
+
+	for i := range fields {
+		fields[i], err = binary.ReadUvarint(reader.reader)
+		if err != nil {
+			return CatalogSong{}, noEOF(err)
+		}
+	}
+	song.AddedAt = catalogTime(fields[0])
+	song.FingerprintVersion = int(fields[1])
+	song.IndexedAt = catalogTime(fields[2])
+	song.DuplicateOf = int(fields[3]) - 1
+
+	count, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return CatalogSong{}, noEOF(err)
+	}
+
+	// the count isn`t trusted for the allocation, a corrupted one fails on the reads
+	fingerprints := make(map[uint64]uint32, min(count, 1<<16))
+	var hash uint64
+	for range count {
+		delta, err := binary.ReadUvarint(reader.reader)
+		if err != nil {
+			return CatalogSong{}, noEOF(err)
+		}
+		timestamp, err := binary.ReadUvarint(reader.reader)
+		if err != nil {
+			return CatalogSong{}, noEOF(err)
+		}
+		hash += delta
+		fingerprints[hash] = uint32(timestamp)
+	}
+
+	return CatalogSong{
+		Song:         song,
+		Fingerprints: fingerprints,
+	}, nil
+}
+
+func (reader *CatalogReader) readString() (string, error) {
+	size, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	if size > maxCatalogStringSize {
+		return "", fmt.Errorf("string of %d bytes", size)
+	}
+
+	value := make([]byte, size)
+	_, err = io.ReadFull(reader.reader, value)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	return string(value), nil
+}
+
+func (reader *CatalogReader) Close() error {
+	return reader.gzip.Close()
+}
+
+func catalogTime(micros uint64) time.Time {
+	if micros == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(int64(micros)).UTC()
+}
+
+// a catalog ends with the end tag, so an EOF in the middle of it is a truncation
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
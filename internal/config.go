@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Config is everything the binary can be configured with,
+// it is loaded from the defaults, a YAML file, the env variables and the flags in this order
+type Config struct {
+	Production bool          `yaml:"production" env:"PRODUCTION"`
+	Server     ServerConfig  `yaml:"server"`
+	Paths      PathsConfig   `yaml:"paths"`
+	Tools      ToolsConfig   `yaml:"tools"`
+	DB         DBConfig      `yaml:"db"`
+	Search     SearchOptions `yaml:"search"`
+	// FingerprintIndex serves the hash lookups from a memory mapped file instead of the DB
+	FingerprintIndex FingerprintIndexConfig `yaml:"fingerprint_index"`
+	Timeouts         StageTimeouts          `yaml:"timeouts"`
+	// DuplicateThreshold is the share of aligned fingerprints above which a new song is stored as a duplicate, 0 disables the check
+	DuplicateThreshold float64          `yaml:"duplicate_threshold" env:"DUPLICATE_THRESHOLD"`
+	Log                LogOptions       `yaml:"log"`
+	Tracing            TracingOptions   `yaml:"tracing"`
+	AWS                AWSConfig        `yaml:"aws"`
+	Secrets            SecretsConfig    `yaml:"secrets"`
+	AudioStore         AudioStoreConfig `yaml:"audio_store"`
+}
+
+type ServerConfig struct {
+	// Addr is :3000 by default and :80 in production
+	Addr            string        `yaml:"addr" env:"SERVER_ADDR"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// MaxUploadBytes is the memory limit of the multipart form of a match, the rest goes to temp files
+	MaxUploadBytes  int64 `yaml:"max_upload_bytes" env:"MAX_UPLOAD_BYTES"`
+	DefaultPageSize int   `yaml:"default_page_size" env:"DEFAULT_PAGE_SIZE"`
+}
+
+type PathsConfig struct {
+	DownloadsDir string `yaml:"downloads" env:"DOWNLOADS_DIR"`
+	UploadsDir   string `yaml:"uploads" env:"UPLOADS_DIR"`
+	// WebDir is served outside production
+	WebDir string `yaml:"web" env:"WEB_DIR"`
+}
+
+type ToolsConfig struct {
+	YtDlpPath   string `yaml:"yt_dlp" env:"YT_DLP_PATH"`
+	CookiesPath string `yaml:"cookies" env:"YT_DLP_COOKIES"`
+	FfmpegPath  string `yaml:"ffmpeg" env:"FFMPEG_PATH"`
+	// FfprobePath reads the tags of the ingested files
+	FfprobePath string `yaml:"ffprobe" env:"FFPROBE_PATH"`
+}
+
+type DBConfig struct {
+	// Backend is sqlite, mysql, postgres or memory, sqlite by default and mysql in production
+	Backend    string `yaml:"backend" env:"DB_BACKEND"`
+	SqlitePath string `yaml:"sqlite_path" env:"SQLITE_PATH"`
+	// PostgresUrl is resolved through the secret provider when it is empty
+	PostgresUrl  string `yaml:"postgres_url" env:"POSTGRES_URL"`
+	SnapshotPath string `yaml:"snapshot_path" env:"SNAPSHOT_PATH"`
+	// SnapshotInterval is how long after a change the snapshot is saved, 0 saves it only at exit
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" env:"SNAPSHOT_INTERVAL"`
+	MySql            MySqlOptions  `yaml:"mysql"`
+	// Shards are the comma separated DBs of the fingerprints in the terms of the backend (sqlite files,
+	// postgres urls or mysql host:port/dbname), the songs stay on the primary, empty keeps everything on the primary
+	Shards string `yaml:"shards" env:"DB_SHARDS"`
+}
+
+type AWSConfig struct {
+	Region string `yaml:"region" env:"AWS_REGION"`
+}
+
+func DefaultConfig() Config {
+	log := DefaultLogOptions()
+	// resolved by ResolveDefaults, so production can default to info
+	log.Level = ""
+
+	return Config{
+		Server: ServerConfig{
+			ShutdownTimeout: time.Minute,
+			MaxUploadBytes:  10 << 20,
+			DefaultPageSize: 14,
+		},
+		Paths: PathsConfig{
+			DownloadsDir: "downloads",
+			UploadsDir:   "uploads",
+			WebDir:       "web",
+		},
+		Tools: ToolsConfig{
+			YtDlpPath:   "venv/bin/yt-dlp",
+			CookiesPath: "cookies.txt",
+			FfmpegPath:  "ffmpeg",
+			FfprobePath: "ffprobe",
+		},
+		DB: DBConfig{
+			SqlitePath:       "db.sqlite",
+			SnapshotPath:     "catalog.snapshot",
+			SnapshotInterval: 30 * time.Second,
+			MySql:            DefaultMySqlOptions(),
+		},
+		Search:             DefaultSearchOptions(),
+		FingerprintIndex:   DefaultFingerprintIndexConfig(),
+		Timeouts:           DefaultStageTimeouts(),
+		DuplicateThreshold: 0.3,
+		Log:                log,
+		Tracing: TracingOptions{
+			Exporter: "none",
+			FilePath: "traces.json",
+		},
+		AWS: AWSConfig{
+			Region: "eu-central-1",
+		},
+		Secrets:    DefaultSecretsConfig(),
+		AudioStore: DefaultAudioStoreConfig(),
+	}
+}
+
+// LoadConfigFile overrides the config with the fields present in the YAML file
+func LoadConfigFile(path string, config *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidConfig, path, err)
+	}
+
+	return nil
+}
+
+// ApplyEnv overrides the config with the set env variables named by the env tags
+func ApplyEnv(config *Config, lookupEnv func(key string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(config).Elem(), lookupEnv)
+}
+
+func applyEnv(value reflect.Value, lookupEnv func(key string) (string, bool)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		structField := value.Type().Field(i)
+
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field, lookupEnv)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := structField.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+
+		raw, found := lookupEnv(key)
+		if !found {
+			continue
+		}
+
+		err := setField(field, raw)
+		if err != nil {
+			return fmt.Errorf("%w: env %s: %w", ErrInvalidConfig, key, err)
+		}
+	}
+
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// ResolveDefaults fills the fields whose defaults depend on production
+func (config *Config) ResolveDefaults() {
+	if config.Server.Addr == "" {
+		config.Server.Addr = ":3000"
+		if config.Production {
+			config.Server.Addr = ":80"
+		}
+	}
+
+	if config.DB.Backend == "" {
+		config.DB.Backend = "sqlite"
+		if config.Production {
+			config.DB.Backend = "mysql"
+		}
+	}
+
+	if config.Secrets.Provider == "" {
+		config.Secrets.Provider = "env"
+		if config.Production {
+			config.Secrets.Provider = "ssm"
+		}
+	}
+
+	if config.Log.Level == "" {
+		config.Log.Level = "debug"
+		if config.Production {
+			config.Log.Level = "info"
+		}
+	}
+}
+
+// Validate reports every invalid field at once
+func (config Config) Validate() error {
+	problems := make([]error, 0)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...))
+		}
+	}
+
+	check(config.Server.Addr != "", "server.addr is empty")
+	check(config.Server.ShutdownTimeout >= 0, "server.shutdown_timeout is negative")
+	check(config.Server.MaxUploadBytes > 0, "server.max_upload_bytes must be positive")
+	check(config.Server.DefaultPageSize > 0, "server.default_page_size must be positive")
+	check(config.Paths.DownloadsDir != "", "paths.downloads is empty")
+	check(config.Paths.UploadsDir != "", "paths.uploads is empty")
+	check(config.Tools.YtDlpPath != "", "tools.yt_dlp is empty")
+	check(config.Tools.FfmpegPath != "", "tools.ffmpeg is empty")
+	check(config.Tools.FfprobePath != "", "tools.ffprobe is empty")
+	check(slices.Contains([]string{"sqlite", "mysql", "postgres", "memory"}, config.DB.Backend),
+		"db.backend is %q, expected sqlite, mysql, postgres or memory", config.DB.Backend)
+	check(config.DB.Backend != "sqlite" || config.DB.SqlitePath != "", "db.sqlite_path is empty")
+	check(config.DB.MySql.MaxOpenConns >= 0 && config.DB.MySql.MaxIdleConns >= 0, "db.mysql connection counts can`t be negative")
+	check(config.DB.MySql.ConnMaxLifetime >= 0 && config.DB.MySql.ConnMaxIdleTime >= 0 && config.DB.MySql.DialTimeout >= 0 &&
+		config.DB.MySql.ReadTimeout >= 0 && config.DB.MySql.WriteTimeout >= 0 && config.DB.MySql.ConnectRetryDelay >= 0,
+		"db.mysql durations can`t be negative")
+	check(slices.Contains([]string{"false", "true", "skip-verify", "preferred"}, config.DB.MySql.TLS),
+		"db.mysql.tls is %q, expected false, true, skip-verify or preferred", config.DB.MySql.TLS)
+	check(config.DB.MySql.TLSCAPath == "" || config.DB.MySql.TLS == "true", "db.mysql.tls_ca needs db.mysql.tls true")
+	check(config.DB.MySql.ConnectRetries >= 0, "db.mysql.connect_retries is negative")
+	check(config.DB.SnapshotInterval >= 0, "db.snapshot_interval is negative")
+	check(config.DB.Backend != "memory" || config.DB.Shards == "", "db.shards isn`t supported by the memory backend")
+	check(config.Search.ChunkSize > 0, "search.chunk_size must be positive")
+	check(config.Search.Concurrency > 0, "search.concurrency must be positive")
+	check(config.Search.MaxPostingsPerHash >= 0, "search.max_postings_per_hash is negative")
+	check(config.FingerprintIndex.MergeDelay >= 0, "fingerprint_index.merge_delay is negative")
+	check(config.Timeouts.Download >= 0 && config.Timeouts.Convert >= 0 && config.Timeouts.Analysis >= 0 && config.Timeouts.DB >= 0,
+		"timeouts can`t be negative")
+	check(0 <= config.DuplicateThreshold && config.DuplicateThreshold <= 1, "duplicate_threshold must be between 0 and 1")
+	check(slices.Contains([]string{"text", "json"}, config.Log.Format), "log.format is %q, expected text or json", config.Log.Format)
+	var level slog.Level
+	check(level.UnmarshalText([]byte(config.Log.Level)) == nil, "log.level is %q, expected debug, info, warn or error", config.Log.Level)
+	check(config.Log.DebugSampling > 0, "log.debug_sampling must be positive")
+	check(slices.Contains([]string{"none", "stdout", "file", "otlp"}, config.Tracing.Exporter),
+		"tracing.exporter is %q, expected none, stdout, file or otlp", config.Tracing.Exporter)
+	check(config.Tracing.Exporter != "file" || config.Tracing.FilePath != "", "tracing.file is empty")
+	check(slices.Contains([]string{"ssm", "env", "file", "http"}, config.Secrets.Provider),
+		"secrets.provider is %q, expected ssm, env, file or http", config.Secrets.Provider)
+	check(slices.Contains([]string{"none", "local", "s3"}, config.AudioStore.Backend),
+		"audio_store.backend is %q, expected none, local or s3", config.AudioStore.Backend)
+	check(config.AudioStore.Backend != "local" || config.AudioStore.LocalDir != "", "audio_store.local_dir is empty")
+	check(config.AudioStore.Backend != "s3" || config.AudioStore.S3Bucket != "", "audio_store.s3_bucket is empty")
+
+	return errors.Join(problems...)
+}
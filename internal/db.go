@@ -1,24 +1,363 @@
 package internal
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
+var ErrSongNotFound = errors.New("song not found")
+
 type DB interface {
-	SetupDB(logger *slog.Logger) error
-	InsertSong(songTitle string, songUrl string, logger *slog.Logger) (int, error)
-	InsertFingerprint(hash uint64, songId int, timestamp uint32, logger *slog.Logger) error
-	GetSongsCount(logger *slog.Logger) (int, error)
-	GetSongsPagination(page int, limit int, logger *slog.Logger) ([]Song, error)
-	CheckSongByUrl(songUrl string, logger *slog.Logger) (bool, error)
-	GetSongById(songId int, logger *slog.Logger) (Song, error)
-	SearchFingerprints(hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error)
+	// SetupDB applies the pending schema migrations
+	SetupDB(ctx context.Context, logger *slog.Logger) error
+	MigrationsStatus(ctx context.Context, logger *slog.Logger) ([]MigrationStatus, error)
+	// Ping checks that the db is reachable
+	Ping(ctx context.Context, logger *slog.Logger) error
+	InsertSong(ctx context.Context, songTitle string, songArtist string, songUrl string, logger *slog.Logger) (int, error)
+	// InsertFingerprints stores all fingerprints of the song (hash to timestamp) at once
+	InsertFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error
+	InsertSongDuplicate(ctx context.Context, songId int, duplicateOf int, similarity float64, logger *slog.Logger) error
+	// DeleteSong promotes the most similar duplicate of the song to an original with the fingerprints of the song,
+	// it returns the promoted song or -1
+	DeleteSong(ctx context.Context, songId int, logger *slog.Logger) (int, error)
+	// DeleteFingerprints removes the fingerprints and the duplicate link of the song
+	DeleteFingerprints(ctx context.Context, songId int, logger *slog.Logger) error
+	// ReplaceFingerprints stores the new index of a song in one transaction: the fingerprints or, when duplicateOf
+	// isn`t -1, the duplicate link, and the FingerprintVersion, the old fingerprints and link are dropped
+	ReplaceFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, duplicateOf int, similarity float64, fingerprintVersion int, logger *slog.Logger) error
+	// SetSongIndexed records that the song was fingerprinted with the given FingerprintVersion
+	SetSongIndexed(ctx context.Context, songId int, fingerprintVersion int, logger *slog.Logger) error
+	// SetSongAddedAt overrides the time the song was added, e.g. with the time from an imported catalog
+	SetSongAddedAt(ctx context.Context, songId int, addedAt time.Time, logger *slog.Logger) error
+	GetSongStats(ctx context.Context, songId int, logger *slog.Logger) (SongStats, error)
+	// GetSongFingerprints returns the fingerprints of the song (hash to timestamp)
+	GetSongFingerprints(ctx context.Context, songId int, logger *slog.Logger) (map[uint64]uint32, error)
+	// GetStorageStats reports the footprint of the tables, the SQL servers return estimates
+	GetStorageStats(ctx context.Context, logger *slog.Logger) ([]TableStorage, error)
+	// GetFingerprintsCount is the size of the fingerprint index, the SQL servers return an estimate
+	GetFingerprintsCount(ctx context.Context, logger *slog.Logger) (int, error)
+	GetSongsCount(ctx context.Context, search string, logger *slog.Logger) (int, error)
+	GetSongsPagination(ctx context.Context, query SongsQuery, logger *slog.Logger) ([]Song, error)
+	CheckSongByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (bool, error)
+	// GetSongIdByUrl returns ErrSongNotFound when no song has the url
+	GetSongIdByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (int, error)
+	GetSongById(ctx context.Context, songId int, logger *slog.Logger) (Song, error)
+	SearchFingerprints(ctx context.Context, hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error)
+}
+
+// Closer is implemented by the DBs which keep state to save before the process exits
+type Closer interface {
+	Close(logger *slog.Logger) error
+}
+
+// DBConnectionOptions are the credentials of the SQL server backends,
+// they are resolved through a SecretProvider
+type DBConnectionOptions struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	DBName   string
 }
+
 type Song struct {
-	SongId    int
-	SongTitle string
-	SongUrl   string
+	SongId     int
+	SongTitle  string
+	SongArtist string
+	SongUrl    string
+	// zero for the songs added before the time was tracked
+	AddedAt time.Time
+	// zero for the songs indexed before the version was tracked
+	FingerprintVersion int
+	IndexedAt          time.Time
+	// -1 when the song is not a duplicate of another song
+	DuplicateOf int
+}
+
+type SongStats struct {
+	FingerprintsCount int
+	// the time range in milliseconds covered by the fingerprints
+	FirstTimestamp uint32
+	LastTimestamp  uint32
+}
+
+// TableStorage is the size of a table with its indexes, -1 when the backend can`t tell it
+type TableStorage struct {
+	Table      string
+	Rows       int64
+	DataBytes  int64
+	IndexBytes int64
+}
+
+var storageTables = []string{"songs", "fingerprints", "song_duplicates", "hash_stats"}
+
+// hash_stats keeps the count of songs of every hash (the document frequency),
+// it is changed in the transaction which inserts or deletes the fingerprints of the song
+const (
+	addHashStatsSqlite = `INSERT INTO hash_stats (hash_key, song_count)
+		SELECT hash_key, 1 FROM fingerprints WHERE song_id = ?
+		ON CONFLICT(hash_key) DO UPDATE SET song_count = song_count + 1`
+	// the rows are locked in the order of the hashes, so two ingestions don`t deadlock
+	addHashStatsMySql = `INSERT INTO hash_stats (hash_key, song_count)
+		SELECT hash_key, 1 FROM fingerprints WHERE song_id = ? ORDER BY hash_key
+		ON DUPLICATE KEY UPDATE song_count = song_count + 1`
+	releaseHashStats     = "UPDATE hash_stats SET song_count = song_count - 1 WHERE hash_key IN (SELECT hash_key FROM fingerprints WHERE song_id = ?)"
+	deleteEmptyHashStats = "DELETE FROM hash_stats WHERE song_count <= 0 AND hash_key IN (SELECT hash_key FROM fingerprints WHERE song_id = ?)"
+)
+
+// songStatement is a statement with ? placeholders, Postgres rebinds them
+type songStatement struct {
+	query string
+	args  []any
+}
+
+// selectPromotedDuplicate finds the most similar duplicate of the song with the index info of the song
+const selectPromotedDuplicate = `SELECT song_duplicates.song_id, songs.fingerprint_version, songs.indexed_at
+	FROM song_duplicates JOIN songs ON songs.song_id = song_duplicates.duplicate_of
+	WHERE song_duplicates.duplicate_of = ? ORDER BY song_duplicates.similarity DESC, song_duplicates.song_id LIMIT 1`
+
+// promoteDuplicateStatements give the fingerprints of the deleted original to the promoted duplicate and link
+// the other duplicates to it, the fingerprints are moved, so the hash stats don`t change
+func promoteDuplicateStatements(songId int, promotedId int, fingerprintVersion int, indexedAt int64) []songStatement {
+	return []songStatement{
+		{"UPDATE fingerprints SET song_id = ? WHERE song_id = ?", []any{promotedId, songId}},
+		{"DELETE FROM song_duplicates WHERE song_id = ?", []any{promotedId}},
+		{"UPDATE song_duplicates SET duplicate_of = ? WHERE duplicate_of = ?", []any{promotedId, songId}},
+		{"UPDATE songs SET fingerprint_version = ?, indexed_at = ? WHERE song_id = ?", []any{fingerprintVersion, indexedAt, promotedId}},
+	}
+}
+
+// replaceFingerprintsStatements drop the old index of the song and store the new duplicate link and version,
+// the duplicates of a song which becomes a duplicate itself are linked to its new original,
+// the new fingerprints of an original are inserted after them
+func replaceFingerprintsStatements(songId int, duplicateOf int, similarity float64, fingerprintVersion int) []songStatement {
+	statements := []songStatement{
+		{releaseHashStats, []any{songId}},
+		{deleteEmptyHashStats, []any{songId}},
+		{"DELETE FROM fingerprints WHERE song_id = ?", []any{songId}},
+		{"DELETE FROM song_duplicates WHERE song_id = ?", []any{songId}},
+	}
+
+	if duplicateOf != -1 {
+		statements = append(statements,
+			songStatement{"UPDATE song_duplicates SET duplicate_of = ? WHERE duplicate_of = ?", []any{duplicateOf, songId}},
+			songStatement{"INSERT INTO song_duplicates (song_id, duplicate_of, similarity) VALUES (?, ?, ?)", []any{songId, duplicateOf, similarity}},
+		)
+	}
+
+	return append(statements,
+		songStatement{"UPDATE songs SET fingerprint_version = ?, indexed_at = ? WHERE song_id = ?", []any{fingerprintVersion, time.Now().Unix(), songId}},
+	)
+}
+
+// promoteDuplicateTx promotes the most similar duplicate of the song to be deleted to an original,
+// so the duplicates stay matchable, -1 when the song has no duplicates
+func promoteDuplicateTx(ctx context.Context, tx *sql.Tx, songId int) (int, error) {
+	var promotedId, fingerprintVersion int
+	var indexedAt int64
+	err := tx.QueryRowContext(ctx, selectPromotedDuplicate, songId).Scan(&promotedId, &fingerprintVersion, &indexedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	err = execStatementsTx(ctx, tx, promoteDuplicateStatements(songId, promotedId, fingerprintVersion, indexedAt))
+	if err != nil {
+		return -1, err
+	}
+
+	return promotedId, nil
+}
+
+func execStatementsTx(ctx context.Context, tx *sql.Tx, statements []songStatement) error {
+	for _, statement := range statements {
+		_, err := tx.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const songColumns = `songs.song_id, song_title, song_artist, song_url, added_at, fingerprint_version, indexed_at, song_duplicates.duplicate_of`
+
+type SongsSort string
+
+const (
+	SortSongsById      SongsSort = "id"
+	SortSongsByTitle   SongsSort = "title"
+	SortSongsByAddedAt SongsSort = "added_at"
+)
+
+func ParseSongsSort(raw string) (SongsSort, bool) {
+	switch sort := SongsSort(raw); sort {
+	case SortSongsById, SortSongsByTitle, SortSongsByAddedAt:
+		return sort, true
+	}
+	return "", false
+}
+
+type SongsQuery struct {
+	// full text search over the title and the artist, empty matches every song
+	Search     string
+	Sort       SongsSort
+	Descending bool
+	Page       int
+	Limit      int
+	// when set the songs after the cursor are returned (keyset pagination) and Page is ignored
+	After *SongsCursor
+	// LookAhead returns one song past Limit, so the caller knows whether there is a next page
+	LookAhead bool
+}
+
+// fetchLimit is the count of the songs to select, the offset of a page still follows Limit
+func (query SongsQuery) fetchLimit() int {
+	if query.LookAhead {
+		return query.Limit + 1
+	}
+	return query.Limit
+}
+
+// SongsCursor is the position of the last song of the previous page
+type SongsCursor struct {
+	SongId    int    `json:"id"`
+	SongTitle string `json:"title,omitempty"`
+	AddedAt   int64  `json:"added_at,omitempty"`
+}
+
+func NewSongsCursor(song Song) SongsCursor {
+	cursor := SongsCursor{
+		SongId:    song.SongId,
+		SongTitle: song.SongTitle,
+	}
+
+	if !song.AddedAt.IsZero() {
+		cursor.AddedAt = song.AddedAt.Unix()
+	}
+
+	return cursor
+}
+
+// buildSongsQuery builds the select for the song listing,
+// searchCondition is the backend specific full text search filter
+func buildSongsQuery(query SongsQuery, searchCondition string, searchArgs []any) (string, []any) {
+	var builder strings.Builder
+	args := make([]any, 0, len(searchArgs)+4)
+
+	builder.WriteString(`SELECT ` + songColumns + ` FROM songs
+		LEFT JOIN song_duplicates ON songs.song_id = song_duplicates.song_id`)
+
+	conditions := make([]string, 0, 2)
+	if searchCondition != "" {
+		conditions = append(conditions, searchCondition)
+		args = append(args, searchArgs...)
+	}
+
+	comparison := ">"
+	direction := "ASC"
+	if query.Descending {
+		comparison = "<"
+		direction = "DESC"
+	}
+
+	column := ""
+	var cursorValue any
+	switch query.Sort {
+	case SortSongsByTitle:
+		column = "song_title"
+		if query.After != nil {
+			cursorValue = query.After.SongTitle
+		}
+	case SortSongsByAddedAt:
+		column = "added_at"
+		if query.After != nil {
+			cursorValue = query.After.AddedAt
+		}
+	}
+
+	if query.After != nil {
+		if column == "" {
+			conditions = append(conditions, fmt.Sprintf("songs.song_id %s ?", comparison))
+			args = append(args, query.After.SongId)
+		} else {
+			conditions = append(conditions,
+				fmt.Sprintf("(%s %s ? OR (%s = ? AND songs.song_id %s ?))", column, comparison, column, comparison))
+			args = append(args, cursorValue, cursorValue, query.After.SongId)
+		}
+	}
+
+	if len(conditions) > 0 {
+		builder.WriteString(" WHERE ")
+		builder.WriteString(strings.Join(conditions, " AND "))
+	}
+
+	builder.WriteString(" ORDER BY ")
+	if column != "" {
+		builder.WriteString(column + " " + direction + ", ")
+	}
+	builder.WriteString("songs.song_id " + direction)
+
+	builder.WriteString(" LIMIT ?")
+	args = append(args, query.fetchLimit())
+
+	if query.After == nil {
+		builder.WriteString(" OFFSET ?")
+		args = append(args, (query.Page-1)*query.Limit)
+	}
+
+	return builder.String(), args
+}
+
+// searchTerms splits the search into words and drops the characters
+// which have special meaning in the full text search syntax
+func searchTerms(search string) []string {
+	terms := strings.FieldsFunc(search, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	return terms
+}
+
+// getSongFingerprints is shared by the backends whose driver scans the hash into an uint64
+func getSongFingerprints(ctx context.Context, db *sql.DB, songId int, logger *slog.Logger) (map[uint64]uint32, error) {
+	logger = logger.With(slog.Int("song_id", songId))
+
+	rows, err := db.QueryContext(ctx, "SELECT hash_key, song_timestamp FROM fingerprints WHERE song_id = ?", songId)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while getting the song fingerprints")
+		return nil, err
+	}
+	defer rows.Close()
+
+	fingerprints := make(map[uint64]uint32)
+	for rows.Next() {
+		var hash uint64
+		var timestamp uint32
+		err = rows.Scan(&hash, &timestamp)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Error while scanning a song fingerprint")
+			return nil, err
+		}
+		fingerprints[hash] = timestamp
+	}
+
+	err = rows.Err()
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while getting the song fingerprints")
+		return nil, err
+	}
+
+	return fingerprints, nil
 }
 
 type Fingerprint struct {
@@ -27,15 +366,179 @@ type Fingerprint struct {
 	Timestamp uint32
 }
 
-func joinHashes(hashes []uint64) string {
-	if len(hashes) == 0 {
-		return ""
+type SearchOptions struct {
+	// ChunkSize is the count of hashes bound as parameters of a single lookup query
+	ChunkSize int `yaml:"chunk_size" env:"SEARCH_CHUNK_SIZE"`
+	// Concurrency is the count of lookup queries run at the same time
+	Concurrency int `yaml:"concurrency" env:"SEARCH_CONCURRENCY"`
+	// MaxPostingsPerHash drops the hashes found in more songs (stop-word hashes like silence), 0 disables the cap.
+	// The SQL backends read the song count of the hash from hash_stats, so the postings of a dropped hash aren`t fetched
+	MaxPostingsPerHash int `yaml:"max_postings_per_hash" env:"MAX_POSTINGS_PER_HASH"`
+	// IDFWeighting weights the matches of a hash by its inverse document frequency in the score,
+	// so the hashes common to many songs count less
+	IDFWeighting bool `yaml:"idf_weighting" env:"SEARCH_IDF_WEIGHTING"`
+}
+
+func DefaultSearchOptions() SearchOptions {
+	return SearchOptions{
+		ChunkSize:          500,
+		Concurrency:        4,
+		MaxPostingsPerHash: 1000,
 	}
+}
+
+// searchFingerprintsChunked looks up the hashes in chunks of bound parameters,
+// the chunks are queried concurrently and merged in a single map
+func searchFingerprintsChunked(ctx context.Context, db *sql.DB, hashes []uint64, options SearchOptions, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	chunkSize := max(options.ChunkSize, 1)
+	concurrency := max(options.Concurrency, 1)
+
+	matches := make(map[uint64][]Fingerprint, 0)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	semaphore := make(chan struct{}, concurrency)
+
+	for chunk := range slices.Chunk(hashes, chunkSize) {
+		semaphore <- struct{}{}
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-semaphore
+			break
+		}
 
-	res := fmt.Sprintf("%d", hashes[0])
-	for i := 1; i < len(hashes); i++ {
-		res += fmt.Sprintf(", %d", hashes[i])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			chunkMatches, err := searchFingerprintsChunk(ctx, db, chunk, options.MaxPostingsPerHash)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+
+			for hash, fingerprints := range chunkMatches {
+				matches[hash] = append(matches[hash], fingerprints...)
+			}
+		}()
 	}
 
-	return res
+	wg.Wait()
+
+	if firstErr != nil {
+		logger.With(slog.String("err", firstErr.Error())).Warn("Error while searching for fingerprints")
+		return nil, firstErr
+	}
+
+	return capPostings(matches, options.MaxPostingsPerHash, logger), nil
+}
+
+// searchFingerprintsChunk skips the hashes of more than maxPostings songs by their hash_stats
+func searchFingerprintsChunk(ctx context.Context, db *sql.DB, hashes []uint64, maxPostings int) (map[uint64][]Fingerprint, error) {
+	placeholders := strings.Repeat(", ?", len(hashes))[2:]
+	args := make([]any, len(hashes), len(hashes)+1)
+	for i, hash := range hashes {
+		args[i] = hash
+	}
+
+	query := "SELECT hash_key, song_id, song_timestamp FROM fingerprints WHERE hash_key IN (" + placeholders + ")"
+	if maxPostings > 0 {
+		query = `SELECT fingerprints.hash_key, song_id, song_timestamp FROM hash_stats
+			JOIN fingerprints ON fingerprints.hash_key = hash_stats.hash_key
+			WHERE hash_stats.hash_key IN (` + placeholders + ") AND song_count <= ?"
+		args = append(args, maxPostings)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make(map[uint64][]Fingerprint, 0)
+
+	for rows.Next() {
+		var fingerprint Fingerprint
+		err = rows.Scan(&fingerprint.HashKey, &fingerprint.SongId, &fingerprint.Timestamp)
+
+		if err != nil {
+			return nil, err
+		}
+		matches[fingerprint.HashKey] = append(matches[fingerprint.HashKey], fingerprint)
+	}
+
+	return matches, rows.Err()
+}
+
+// capPostings drops the hashes with more postings than the cap
+func capPostings(matches map[uint64][]Fingerprint, maxPostings int, logger *slog.Logger) map[uint64][]Fingerprint {
+	if maxPostings <= 0 {
+		return matches
+	}
+
+	dropped := 0
+	for hash, fingerprints := range matches {
+		if len(fingerprints) > maxPostings {
+			delete(matches, hash)
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		logger.With(
+			slog.Int("dropped_hashes", dropped),
+			slog.Int("max_postings_per_hash", maxPostings),
+		).Debug("Stop-word hashes were dropped")
+	}
+
+	return matches
+}
+
+func nullableSongId(songId sql.NullInt64) int {
+	if !songId.Valid {
+		return -1
+	}
+	return int(songId.Int64)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanSong scans the songColumns
+func scanSong(row rowScanner) (Song, error) {
+	var song Song
+	var addedAt int64
+	var indexedAt int64
+	var duplicateOf sql.NullInt64
+
+	err := row.Scan(&song.SongId, &song.SongTitle, &song.SongArtist, &song.SongUrl,
+		&addedAt, &song.FingerprintVersion, &indexedAt, &duplicateOf)
+	if err != nil {
+		return song, err
+	}
+
+	song.AddedAt = unixTime(addedAt)
+	song.IndexedAt = unixTime(indexedAt)
+	song.DuplicateOf = nullableSongId(duplicateOf)
+
+	return song, nil
+}
+
+// unixTime maps the zero (not tracked) timestamps to the zero time
+func unixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
 }
@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBackends creates the backends which run without a server, the sqlite one is migrated
+func newTestBackends(t *testing.T) map[string]DB {
+	t.Helper()
+
+	ctx := context.Background()
+	logger := newTestLogger()
+
+	sqlite, err := NewDBSqlite(filepath.Join(t.TempDir(), "db.sqlite"), DefaultSearchOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlite.SetupDB(ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory, err := NewDBMemory("", 0, DefaultSearchOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]DB{
+		"sqlite": sqlite,
+		"memory": memory,
+	}
+}
+
+func insertTestSongs(t *testing.T, db DB, count int) []int {
+	t.Helper()
+
+	songIds := make([]int, count)
+	for i := range songIds {
+		songId, err := db.InsertSong(context.Background(), fmt.Sprintf("Title %d", i), "Artist", fmt.Sprintf("https://example.com/%d", i), newTestLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		songIds[i] = songId
+	}
+	return songIds
+}
+
+func TestDeleteSongPromotesDuplicate(t *testing.T) {
+	for name, db := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := newTestLogger()
+
+			songIds := insertTestSongs(t, db, 4)
+			original, weakDuplicate, strongDuplicate, single := songIds[0], songIds[1], songIds[2], songIds[3]
+
+			fingerprints := map[uint64]uint32{11: 100, 12: 200, 13: 300}
+			err := db.InsertFingerprints(ctx, original, fingerprints, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.SetSongIndexed(ctx, original, 7, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.InsertSongDuplicate(ctx, weakDuplicate, original, 0.6, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.InsertSongDuplicate(ctx, strongDuplicate, original, 0.9, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			promotedId, err := db.DeleteSong(ctx, original, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if promotedId != strongDuplicate {
+				t.Fatalf("DeleteSong promoted %d, want %d", promotedId, strongDuplicate)
+			}
+
+			got, err := db.GetSongFingerprints(ctx, strongDuplicate, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, fingerprints) {
+				t.Errorf("fingerprints of the promoted song = %v, want %v", got, fingerprints)
+			}
+
+			promoted, err := db.GetSongById(ctx, strongDuplicate, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if promoted.DuplicateOf != -1 || promoted.FingerprintVersion != 7 {
+				t.Errorf("promoted song has duplicate_of %d and version %d, want -1 and 7", promoted.DuplicateOf, promoted.FingerprintVersion)
+			}
+
+			weak, err := db.GetSongById(ctx, weakDuplicate, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if weak.DuplicateOf != strongDuplicate {
+				t.Errorf("other duplicate is a duplicate of %d, want %d", weak.DuplicateOf, strongDuplicate)
+			}
+
+			matches, err := db.SearchFingerprints(ctx, []uint64{11}, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches[11]) != 1 || matches[11][0].SongId != strongDuplicate {
+				t.Errorf("postings of a moved hash = %v, want the promoted song", matches[11])
+			}
+
+			promotedId, err = db.DeleteSong(ctx, single, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if promotedId != -1 {
+				t.Errorf("DeleteSong of a song without duplicates promoted %d", promotedId)
+			}
+		})
+	}
+}
+
+func TestReplaceFingerprints(t *testing.T) {
+	for name, db := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := newTestLogger()
+
+			songIds := insertTestSongs(t, db, 3)
+			song, duplicate, newOriginal := songIds[0], songIds[1], songIds[2]
+
+			err := db.InsertFingerprints(ctx, song, map[uint64]uint32{11: 100, 12: 200}, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.InsertSongDuplicate(ctx, duplicate, song, 0.8, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			replaced := map[uint64]uint32{12: 250, 13: 300}
+			err = db.ReplaceFingerprints(ctx, song, replaced, -1, 0, 5, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := db.GetSongFingerprints(ctx, song, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, replaced) {
+				t.Errorf("fingerprints = %v, want %v", got, replaced)
+			}
+
+			matches, err := db.SearchFingerprints(ctx, []uint64{11, 12}, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches[11]) != 0 || len(matches[12]) != 1 || matches[12][0].Timestamp != 250 {
+				t.Errorf("postings after the replace = %v", matches)
+			}
+
+			// the song becomes a duplicate, so its duplicate follows it to the new original
+			err = db.ReplaceFingerprints(ctx, song, replaced, newOriginal, 0.9, 6, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err = db.GetSongFingerprints(ctx, song, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("duplicate keeps %d fingerprints", len(got))
+			}
+
+			wantDuplicateOf := map[int]int{song: newOriginal, duplicate: newOriginal, newOriginal: -1}
+			for songId, duplicateOf := range wantDuplicateOf {
+				stored, err := db.GetSongById(ctx, songId, logger)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.DuplicateOf != duplicateOf {
+					t.Errorf("song %d is a duplicate of %d, want %d", songId, stored.DuplicateOf, duplicateOf)
+				}
+			}
+
+			stored, err := db.GetSongById(ctx, song, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.FingerprintVersion != 6 {
+				t.Errorf("version = %d, want 6", stored.FingerprintVersion)
+			}
+		})
+	}
+}
+
+func TestReplaceFingerprintsFailureKeepsOldIndex(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db := newTestBackends(t)["sqlite"]
+
+	songId := insertTestSongs(t, db, 1)[0]
+	fingerprints := map[uint64]uint32{11: 100, 12: 200}
+	err := db.InsertFingerprints(ctx, songId, fingerprints, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetSongIndexed(ctx, songId, 1, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.(*DBSqlite).db.ExecContext(ctx,
+		"CREATE TRIGGER fail_insert BEFORE INSERT ON fingerprints BEGIN SELECT RAISE(ABORT, 'disk is full'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.ReplaceFingerprints(ctx, songId, map[uint64]uint32{13: 300}, -1, 0, 2, logger)
+	if err == nil {
+		t.Fatal("ReplaceFingerprints succeeded with a failing insert")
+	}
+
+	got, err := db.GetSongFingerprints(ctx, songId, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got, fingerprints) {
+		t.Errorf("fingerprints after the failed replace = %v, want %v", got, fingerprints)
+	}
+
+	song, err := db.GetSongById(ctx, songId, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if song.FingerprintVersion != 1 {
+		t.Errorf("version after the failed replace = %d, want 1", song.FingerprintVersion)
+	}
+}
+
+func TestIngesterReindexSkipsTheSongItself(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db := newTestBackends(t)["sqlite"]
+	ingester := NewIngester(db, 0.5, logger)
+
+	fingerprints := map[uint64]uint32{11: 100, 12: 200, 13: 300}
+	result, err := ingester.Ingest(ctx, "Title", "Artist", "https://example.com/1", fingerprints, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = ingester.Reindex(ctx, result.SongId, fingerprints, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DuplicateOf != -1 {
+		t.Errorf("reindexed song is a duplicate of %d", result.DuplicateOf)
+	}
+
+	got, err := db.GetSongFingerprints(ctx, result.SongId, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got, fingerprints) {
+		t.Errorf("fingerprints after the reindex = %v, want %v", got, fingerprints)
+	}
+}
+
+func TestGetSongIdByUrl(t *testing.T) {
+	for name, db := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := newTestLogger()
+
+			songIds := insertTestSongs(t, db, 2)
+
+			songId, err := db.GetSongIdByUrl(ctx, "https://example.com/1", logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if songId != songIds[1] {
+				t.Errorf("GetSongIdByUrl = %d, want %d", songId, songIds[1])
+			}
+
+			_, err = db.GetSongIdByUrl(ctx, "https://example.com/missing", logger)
+			if !errors.Is(err, ErrSongNotFound) {
+				t.Errorf("GetSongIdByUrl of a missing url: err = %v, want %v", err, ErrSongNotFound)
+			}
+		})
+	}
+}
+
+func TestGetSongsPaginationLookAhead(t *testing.T) {
+	for name, db := range newTestBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			logger := newTestLogger()
+
+			insertTestSongs(t, db, 5)
+
+			tests := []struct {
+				page      int
+				lookAhead bool
+				want      int
+			}{
+				{1, false, 2},
+				{1, true, 3},
+				{2, true, 3},
+				// the last page has no song past the limit
+				{3, true, 1},
+			}
+
+			for _, test := range tests {
+				query := SongsQuery{Sort: SortSongsById, Page: test.page, Limit: 2, LookAhead: test.lookAhead}
+				songs, err := db.GetSongsPagination(ctx, query, logger)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(songs) != test.want {
+					t.Errorf("page %d with look ahead %v has %d songs, want %d", test.page, test.lookAhead, len(songs), test.want)
+				}
+				// the offset of a page doesn`t move with the look ahead
+				if len(songs) > 0 && songs[0].SongId != (test.page-1)*2+1 {
+					t.Errorf("page %d starts at song %d, want %d", test.page, songs[0].SongId, (test.page-1)*2+1)
+				}
+			}
+		})
+	}
+}
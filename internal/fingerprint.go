@@ -2,13 +2,42 @@ package internal
 
 import "math/cmplx"
 
+// FingerprintVersion must be increased on every change of the analysis or the hashing,
+// because fingerprints of different versions don`t match each other
+const FingerprintVersion = 1
+
+const fuzzFactor = 2
+
+var peaksRanges = []peakRange{{40, 80}, {80, 120}, {120, 180}, {180, 300}}
+
 type peakRange struct {
 	min int
 	max int
 }
 
+type AnalysisConfig struct {
+	WindowSize int      `json:"window_size"`
+	HopSize    int      `json:"hop_size"`
+	PeakRanges [][2]int `json:"peak_ranges"`
+	FuzzFactor int      `json:"fuzz_factor"`
+}
+
+// CurrentAnalysisConfig describes the analysis of the current FingerprintVersion
+func CurrentAnalysisConfig() AnalysisConfig {
+	ranges := make([][2]int, len(peaksRanges))
+	for i, peakRange := range peaksRanges {
+		ranges[i] = [2]int{peakRange.min, peakRange.max}
+	}
+
+	return AnalysisConfig{
+		WindowSize: windowSize,
+		HopSize:    hopSize,
+		PeakRanges: ranges,
+		FuzzFactor: fuzzFactor,
+	}
+}
+
 func GenerateFingerprints(spectrogram [][]complex128, timePerColumn float64) map[uint64]uint32 {
-	peaksRanges := []peakRange{{40, 80}, {80, 120}, {120, 180}, {180, 300}}
 	fingerprints := make(map[uint64]uint32)
 
 	maxFreqPerRange := make([]uint64, len(peaksRanges))
@@ -37,8 +66,6 @@ func GenerateFingerprints(spectrogram [][]complex128, timePerColumn float64) map
 }
 
 func hash(p1, p2, p3, p4 uint64) uint64 {
-	const fuzzFactor = 2
-
 	m4 := (p4 - (p4 % fuzzFactor)) << 30
 	m3 := (p3 - (p3 % fuzzFactor)) << 20
 	m2 := (p2 - (p2 % fuzzFactor)) << 10
@@ -0,0 +1,757 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrInvalidFingerprintIndex = errors.New("invalid fingerprint index")
+var ErrStaleFingerprintIndex = errors.New("stale fingerprint index")
+
+// The index file is
+//
+//	header:   magic, format version, FingerprintVersion, hash count, songs count, catalog checksum
+//	table:    (hash, postings offset) per hash sorted by the hash, then the end of the postings
+//	postings: (song_id, timestamp) uvarint pairs sorted by the song id, the song id is delta encoded
+//
+// the table has a fixed entry size, so a hash is found with a binary search in the mapped file
+const fingerprintIndexFormatVersion = 2
+
+var fingerprintIndexMagic = []byte("SRFPIDX")
+
+const (
+	fingerprintIndexHeaderSize = 40
+	fingerprintIndexEntrySize  = 16
+)
+
+// the pending fingerprints are merged into the file during a build once they reach this count,
+// so the build doesn`t keep the whole catalog in memory
+const fingerprintIndexBuildBatch = 5_000_000
+
+type FingerprintIndexConfig struct {
+	// Path of the index file, empty disables the index
+	Path string `yaml:"path" env:"FINGERPRINT_INDEX"`
+	// MergeDelay is how long the ingested songs are collected before they are merged into the file
+	MergeDelay time.Duration `yaml:"merge_delay" env:"FINGERPRINT_INDEX_MERGE_DELAY"`
+}
+
+func DefaultFingerprintIndexConfig() FingerprintIndexConfig {
+	return FingerprintIndexConfig{
+		MergeDelay: 5 * time.Second,
+	}
+}
+
+// FingerprintIndex is a read optimised inverted index from hash to postings in a memory mapped file.
+// The changes are kept in memory and merged into a new file in the background,
+// the searches see them before the merge
+type FingerprintIndex struct {
+	path               string
+	mergeDelay         time.Duration
+	maxPostingsPerHash int
+
+	mu   sync.RWMutex
+	file *indexFile
+	// songsCount is the count of songs in the DB, it detects an index left behind by the DB
+	songsCount int
+	// catalogChecksum is the checksum of the songs in the DB when the index was closed, every change resets it to 0,
+	// so an index which wasn`t closed after its last change, e.g. after a crash, is built again
+	catalogChecksum uint64
+	// every change gets the next seq, the changes up to mergedSeq are in the file
+	seq        uint64
+	mergedSeq  uint64
+	added      map[int]pendingSong
+	removed    map[int]uint64
+	mergeTimer *time.Timer
+	// mergesHeld keeps the changes pending during a rebuild, so they can be replayed on the new index
+	mergesHeld bool
+
+	// a single merge writes the file at a time
+	mergeMu sync.Mutex
+}
+
+// pendingSong replaces the postings of the song in the file
+type pendingSong struct {
+	fingerprints map[uint64]uint32
+	seq          uint64
+}
+
+func newFingerprintIndex(config FingerprintIndexConfig, maxPostingsPerHash int, file *indexFile) *FingerprintIndex {
+	return &FingerprintIndex{
+		path:               config.Path,
+		mergeDelay:         config.MergeDelay,
+		maxPostingsPerHash: maxPostingsPerHash,
+		file:               file,
+		songsCount:         file.songsCount,
+		catalogChecksum:    file.catalogChecksum,
+		added:              make(map[int]pendingSong),
+		removed:            make(map[int]uint64),
+	}
+}
+
+// OpenFingerprintIndex maps an existing index file,
+// ErrStaleFingerprintIndex when it was built with another FingerprintVersion
+func OpenFingerprintIndex(config FingerprintIndexConfig, maxPostingsPerHash int, logger *slog.Logger) (*FingerprintIndex, error) {
+	logger = logger.With(slog.String("fingerprint_index", config.Path))
+
+	file, err := openIndexFile(config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Debug("Fingerprint index doesn`t exist")
+		return nil, err
+	}
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t open the fingerprint index")
+		return nil, err
+	}
+
+	logger.With(
+		slog.Int("hashes_count", file.hashCount),
+		slog.Int("postings_size", len(file.postings)),
+	).Info("Fingerprint index was opened successfully")
+
+	return newFingerprintIndex(config, maxPostingsPerHash, file), nil
+}
+
+// BuildFingerprintIndex writes a new index file from the fingerprints in the DB
+func BuildFingerprintIndex(ctx context.Context, db DB, config FingerprintIndexConfig, maxPostingsPerHash int, logger *slog.Logger) (*FingerprintIndex, error) {
+	const pageSize = 500
+
+	start := time.Now()
+
+	index := newFingerprintIndex(config, maxPostingsPerHash, emptyIndexFile())
+
+	query := SongsQuery{
+		Sort:  SortSongsById,
+		Page:  1,
+		Limit: pageSize,
+	}
+
+	pendingCount := 0
+	for {
+		page, err := db.GetSongsPagination(ctx, query, logger)
+		if err != nil {
+			index.unmap()
+			return nil, err
+		}
+
+		for _, song := range page {
+			fingerprints, err := db.GetSongFingerprints(ctx, song.SongId, logger)
+			if err != nil {
+				index.unmap()
+				return nil, err
+			}
+
+			index.songsCount++
+			if len(fingerprints) == 0 {
+				continue
+			}
+
+			index.seq++
+			index.added[song.SongId] = pendingSong{fingerprints: fingerprints, seq: index.seq}
+			pendingCount += len(fingerprints)
+
+			if pendingCount >= fingerprintIndexBuildBatch {
+				err = index.Merge(logger)
+				if err != nil {
+					index.unmap()
+					return nil, err
+				}
+				pendingCount = 0
+			}
+		}
+
+		if len(page) < pageSize {
+			break
+		}
+
+		cursor := NewSongsCursor(page[len(page)-1])
+		query.After = &cursor
+	}
+
+	// the file is written even for an empty catalog, so the next start doesn`t build it again
+	index.seq++
+	err := index.Merge(logger)
+	if err != nil {
+		index.unmap()
+		return nil, err
+	}
+
+	logger.With(
+		slog.String("fingerprint_index", config.Path),
+		slog.Int("songs_count", index.songsCount),
+		slog.Int("hashes_count", index.file.hashCount),
+		slog.Duration("duration", time.Since(start)),
+	).Info("Fingerprint index was built successfully")
+
+	return index, nil
+}
+
+func (index *FingerprintIndex) SongsCount() int {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return index.songsCount
+}
+
+func (index *FingerprintIndex) CatalogChecksum() uint64 {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return index.catalogChecksum
+}
+
+// SetCatalogChecksum records the checksum of the DB the index matches, it is written by the next merge
+func (index *FingerprintIndex) SetCatalogChecksum(checksum uint64) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.seq++
+	index.catalogChecksum = checksum
+}
+
+// Search has the result of DB.SearchFingerprints
+func (index *FingerprintIndex) Search(hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	replaced := func(songId int) bool {
+		_, removed := index.removed[songId]
+		_, added := index.added[songId]
+		return removed || added
+	}
+
+	matches := make(map[uint64][]Fingerprint)
+	for _, hash := range hashes {
+		postings, err := decodePostings(hash, index.file.find(hash), replaced, nil)
+		if err != nil {
+			logger.With(slog.String("fingerprint_index", index.path), slog.String("err", err.Error())).Error("Fingerprint index is corrupted")
+			return nil, err
+		}
+
+		for songId, song := range index.added {
+			timestamp, found := song.fingerprints[hash]
+			if found {
+				postings = append(postings, Fingerprint{HashKey: hash, SongId: songId, Timestamp: timestamp})
+			}
+		}
+
+		if len(postings) > 0 {
+			matches[hash] = postings
+		}
+	}
+
+	return capPostings(matches, index.maxPostingsPerHash, logger), nil
+}
+
+// SetFingerprints replaces the postings of the song, the map must not be changed after the call
+func (index *FingerprintIndex) SetFingerprints(songId int, fingerprints map[uint64]uint32, logger *slog.Logger) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.seq++
+	index.added[songId] = pendingSong{fingerprints: fingerprints, seq: index.seq}
+	index.catalogChecksum = 0
+	index.scheduleMerge(logger)
+}
+
+// RemoveFingerprints drops the postings of the song
+func (index *FingerprintIndex) RemoveFingerprints(songId int, logger *slog.Logger) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.seq++
+	index.removed[songId] = index.seq
+	delete(index.added, songId)
+	index.catalogChecksum = 0
+	index.scheduleMerge(logger)
+}
+
+// AddSongsCount follows the count of songs in the DB
+func (index *FingerprintIndex) AddSongsCount(delta int, logger *slog.Logger) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.seq++
+	index.songsCount += delta
+	index.catalogChecksum = 0
+	index.scheduleMerge(logger)
+}
+
+// scheduleMerge must be called with the lock held
+func (index *FingerprintIndex) scheduleMerge(logger *slog.Logger) {
+	if index.mergeTimer != nil {
+		return
+	}
+
+	index.mergeTimer = time.AfterFunc(index.mergeDelay, func() {
+		index.mu.Lock()
+		index.mergeTimer = nil
+		index.mu.Unlock()
+
+		// a failed merge keeps the changes in memory, the next change tries again
+		index.Merge(logger)
+	})
+}
+
+// Merge writes the file again with the pending changes and maps it instead of the old one
+func (index *FingerprintIndex) Merge(logger *slog.Logger) error {
+	index.mergeMu.Lock()
+	defer index.mergeMu.Unlock()
+
+	logger = logger.With(slog.String("fingerprint_index", index.path))
+
+	index.mu.RLock()
+	held := index.mergesHeld
+	base := index.file
+	seq := index.seq
+	songsCount := index.songsCount
+	catalogChecksum := index.catalogChecksum
+	added := maps.Clone(index.added)
+	removed := maps.Clone(index.removed)
+	index.mu.RUnlock()
+
+	if held || seq == index.mergedSeq {
+		return nil
+	}
+
+	start := time.Now()
+	file, err := writeIndexFile(index.path, base, added, removed, songsCount, catalogChecksum)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t merge the changes into the fingerprint index")
+		return err
+	}
+
+	index.mu.Lock()
+	index.file = file
+	index.mergedSeq = seq
+	for songId, song := range index.added {
+		if song.seq <= seq {
+			delete(index.added, songId)
+		}
+	}
+	for songId, removedSeq := range index.removed {
+		if removedSeq <= seq {
+			delete(index.removed, songId)
+		}
+	}
+	index.mu.Unlock()
+
+	// the searches hold the read lock, so none of them reads the old mapping anymore
+	err = base.unmap()
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t unmap the old fingerprint index")
+	}
+
+	logger.With(
+		slog.Int("merged_songs", len(added)),
+		slog.Int("removed_songs", len(removed)),
+		slog.Int("hashes_count", file.hashCount),
+		slog.Duration("duration", time.Since(start)),
+	).Debug("Changes were merged into the fingerprint index")
+
+	return nil
+}
+
+// holdMerges keeps the changes in memory until resumeMerges or until a new index takes them over
+func (index *FingerprintIndex) holdMerges() {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.mergesHeld = true
+}
+
+func (index *FingerprintIndex) resumeMerges(logger *slog.Logger) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.mergesHeld = false
+	if index.seq != index.mergedSeq {
+		index.scheduleMerge(logger)
+	}
+}
+
+// takeOver moves the file of the index over the file of the old index and replays the pending changes of the old one,
+// the old index keeps its merges held, so it never writes its file again
+func (index *FingerprintIndex) takeOver(old *FingerprintIndex, logger *slog.Logger) error {
+	// waits for a merge of the old index which started before its merges were held
+	old.mergeMu.Lock()
+	defer old.mergeMu.Unlock()
+
+	err := os.Rename(index.path, old.path)
+	if err != nil {
+		logger.With(
+			slog.String("fingerprint_index", old.path),
+			slog.String("err", err.Error()),
+		).Error("Couldn`t replace the fingerprint index file")
+		return err
+	}
+	index.path = old.path
+
+	old.mu.Lock()
+	if old.mergeTimer != nil {
+		old.mergeTimer.Stop()
+		old.mergeTimer = nil
+	}
+	added := old.added
+	removed := old.removed
+	old.mu.Unlock()
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	// a pending song always has a later seq than its removal, so the removals go first
+	for songId := range removed {
+		index.seq++
+		index.removed[songId] = index.seq
+		delete(index.added, songId)
+	}
+	for songId, song := range added {
+		index.seq++
+		index.added[songId] = pendingSong{fingerprints: song.fingerprints, seq: index.seq}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		index.scheduleMerge(logger)
+	}
+
+	return nil
+}
+
+// Close merges the pending changes and unmaps the file
+func (index *FingerprintIndex) Close(logger *slog.Logger) error {
+	index.mu.Lock()
+	if index.mergeTimer != nil {
+		index.mergeTimer.Stop()
+		index.mergeTimer = nil
+	}
+	index.mergesHeld = false
+	index.mu.Unlock()
+
+	err := index.Merge(logger)
+
+	index.unmap()
+	return err
+}
+
+func (index *FingerprintIndex) unmap() {
+	index.mergeMu.Lock()
+	defer index.mergeMu.Unlock()
+
+	index.file.unmap()
+	index.file = emptyIndexFile()
+}
+
+type indexFile struct {
+	hashCount       int
+	songsCount      int
+	catalogChecksum uint64
+	// table ends with the end offset of the postings
+	table    []byte
+	postings []byte
+	unmap    func() error
+}
+
+func emptyIndexFile() *indexFile {
+	return &indexFile{
+		table: make([]byte, 8),
+		unmap: func() error {
+			return nil
+		},
+	}
+}
+
+func openIndexFile(path string) (*indexFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	if size < fingerprintIndexHeaderSize+8 {
+		return nil, ErrInvalidFingerprintIndex
+	}
+
+	data, unmap, err := mapFile(file, int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile, err := parseIndexFile(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	indexFile.unmap = unmap
+
+	return indexFile, nil
+}
+
+func parseIndexFile(data []byte) (*indexFile, error) {
+	header := data[:fingerprintIndexHeaderSize]
+	if string(header[:len(fingerprintIndexMagic)]) != string(fingerprintIndexMagic) ||
+		header[len(fingerprintIndexMagic)] != fingerprintIndexFormatVersion {
+		return nil, ErrInvalidFingerprintIndex
+	}
+
+	fingerprintVersion := binary.LittleEndian.Uint32(header[8:])
+	if fingerprintVersion != FingerprintVersion {
+		return nil, fmt.Errorf("%w: fingerprint version %d, expected %d", ErrStaleFingerprintIndex, fingerprintVersion, FingerprintVersion)
+	}
+
+	hashCount := binary.LittleEndian.Uint64(header[16:])
+	songsCount := binary.LittleEndian.Uint64(header[24:])
+	catalogChecksum := binary.LittleEndian.Uint64(header[32:])
+
+	rest := data[fingerprintIndexHeaderSize:]
+	if hashCount > uint64(len(rest)-8)/fingerprintIndexEntrySize {
+		return nil, ErrInvalidFingerprintIndex
+	}
+
+	tableSize := int(hashCount)*fingerprintIndexEntrySize + 8
+	file := &indexFile{
+		hashCount:       int(hashCount),
+		songsCount:      int(songsCount),
+		catalogChecksum: catalogChecksum,
+		table:           rest[:tableSize],
+		postings:        rest[tableSize:],
+	}
+
+	if file.offset(file.hashCount) != uint64(len(file.postings)) {
+		return nil, ErrInvalidFingerprintIndex
+	}
+
+	return file, nil
+}
+
+func (file *indexFile) hash(i int) uint64 {
+	return binary.LittleEndian.Uint64(file.table[i*fingerprintIndexEntrySize:])
+}
+
+// offset of the postings of the i-th hash, the hash count gives the end of the postings
+func (file *indexFile) offset(i int) uint64 {
+	if i == file.hashCount {
+		return binary.LittleEndian.Uint64(file.table[i*fingerprintIndexEntrySize:])
+	}
+	return binary.LittleEndian.Uint64(file.table[i*fingerprintIndexEntrySize+8:])
+}
+
+func (file *indexFile) postingsAt(i int) []byte {
+	start, end := file.offset(i), file.offset(i+1)
+	if start > end || end > uint64(len(file.postings)) {
+		return nil
+	}
+	return file.postings[start:end]
+}
+
+// find returns the encoded postings of the hash, nil when the hash isn`t indexed
+func (file *indexFile) find(hash uint64) []byte {
+	i := sort.Search(file.hashCount, func(i int) bool {
+		return file.hash(i) >= hash
+	})
+
+	if i == file.hashCount || file.hash(i) != hash {
+		return nil
+	}
+
+	return file.postingsAt(i)
+}
+
+func decodePostings(hash uint64, data []byte, skip func(songId int) bool, postings []Fingerprint) ([]Fingerprint, error) {
+	songId := uint64(0)
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 {
+			return postings, ErrInvalidFingerprintIndex
+		}
+		data = data[n:]
+
+		timestamp, n := binary.Uvarint(data)
+		if n <= 0 {
+			return postings, ErrInvalidFingerprintIndex
+		}
+		data = data[n:]
+
+		songId += delta
+		if !skip(int(songId)) {
+			postings = append(postings, Fingerprint{HashKey: hash, SongId: int(songId), Timestamp: uint32(timestamp)})
+		}
+	}
+
+	return postings, nil
+}
+
+func appendPostings(buf []byte, postings []Fingerprint) []byte {
+	prevSongId := 0
+	for _, posting := range postings {
+		buf = binary.AppendUvarint(buf, uint64(posting.SongId-prevSongId))
+		buf = binary.AppendUvarint(buf, uint64(posting.Timestamp))
+		prevSongId = posting.SongId
+	}
+	return buf
+}
+
+// writeIndexFile merges the sorted hashes of the base file with the sorted hashes of the added songs.
+// The table and the postings are streamed into two temp files, which are joined and renamed to the path
+func writeIndexFile(path string, base *indexFile, added map[int]pendingSong, removed map[int]uint64, songsCount int, catalogChecksum uint64) (*indexFile, error) {
+	dir := filepath.Dir(path)
+
+	tableFile, err := os.CreateTemp(dir, ".fpindex-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tableFile.Name())
+	defer tableFile.Close()
+
+	postingsFile, err := os.CreateTemp(dir, ".fpindex-postings-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(postingsFile.Name())
+	defer postingsFile.Close()
+
+	pending := make(map[uint64][]Fingerprint)
+	for songId, song := range added {
+		for hash, timestamp := range song.fingerprints {
+			pending[hash] = append(pending[hash], Fingerprint{HashKey: hash, SongId: songId, Timestamp: timestamp})
+		}
+	}
+	pendingHashes := slices.Sorted(maps.Keys(pending))
+
+	replaced := func(songId int) bool {
+		_, isRemoved := removed[songId]
+		_, isAdded := added[songId]
+		return isRemoved || isAdded
+	}
+
+	table := bufio.NewWriter(tableFile)
+	postingsWriter := bufio.NewWriter(postingsFile)
+
+	_, err = table.Write(make([]byte, fingerprintIndexHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry [fingerprintIndexEntrySize]byte
+	var buf []byte
+	var postings []Fingerprint
+	offset := uint64(0)
+	hashCount := 0
+
+	i, j := 0, 0
+	for i < base.hashCount || j < len(pendingHashes) {
+		var hash uint64
+		postings = postings[:0]
+
+		switch {
+		case j == len(pendingHashes) || (i < base.hashCount && base.hash(i) < pendingHashes[j]):
+			hash = base.hash(i)
+			postings, err = decodePostings(hash, base.postingsAt(i), replaced, postings)
+			i++
+		case i == base.hashCount || pendingHashes[j] < base.hash(i):
+			hash = pendingHashes[j]
+			postings = append(postings, pending[hash]...)
+			j++
+		default:
+			hash = pendingHashes[j]
+			postings, err = decodePostings(hash, base.postingsAt(i), replaced, postings)
+			postings = append(postings, pending[hash]...)
+			i++
+			j++
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(postings) == 0 {
+			continue
+		}
+
+		slices.SortFunc(postings, func(a, b Fingerprint) int {
+			return a.SongId - b.SongId
+		})
+
+		binary.LittleEndian.PutUint64(entry[:8], hash)
+		binary.LittleEndian.PutUint64(entry[8:], offset)
+		_, err = table.Write(entry[:])
+		if err != nil {
+			return nil, err
+		}
+
+		buf = appendPostings(buf[:0], postings)
+		_, err = postingsWriter.Write(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		offset += uint64(len(buf))
+		hashCount++
+	}
+
+	binary.LittleEndian.PutUint64(entry[:8], offset)
+	_, err = table.Write(entry[:8])
+	if err != nil {
+		return nil, err
+	}
+
+	err = postingsWriter.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = postingsFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(table, postingsFile)
+	if err == nil {
+		err = table.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, fingerprintIndexHeaderSize)
+	copy(header, fingerprintIndexMagic)
+	header[len(fingerprintIndexMagic)] = fingerprintIndexFormatVersion
+	binary.LittleEndian.PutUint32(header[8:], FingerprintVersion)
+	binary.LittleEndian.PutUint64(header[16:], uint64(hashCount))
+	binary.LittleEndian.PutUint64(header[24:], uint64(songsCount))
+	binary.LittleEndian.PutUint64(header[32:], catalogChecksum)
+
+	_, err = tableFile.WriteAt(header, 0)
+	if err == nil {
+		err = tableFile.Chmod(0o644)
+	}
+	if err == nil {
+		err = tableFile.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the old file stays mapped until the new one replaces it
+	err = os.Rename(tableFile.Name(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	return openIndexFile(path)
+}
@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFingerprints returns fingerprints from a small hash space, so the songs share hashes
+func testFingerprints(seed uint64, count int) map[uint64]uint32 {
+	random := rand.New(rand.NewPCG(seed, 7))
+	fingerprints := make(map[uint64]uint32, count)
+	for len(fingerprints) < count {
+		fingerprints[random.Uint64N(500)] = random.Uint32N(100_000)
+	}
+	return fingerprints
+}
+
+// sortedPostings orders the postings of every hash by the song id, the index and the DBs don`t keep an order
+func sortedPostings(matches map[uint64][]Fingerprint) map[uint64][]Fingerprint {
+	sorted := make(map[uint64][]Fingerprint, len(matches))
+	for hash, postings := range matches {
+		postings = slices.Clone(postings)
+		slices.SortFunc(postings, func(a, b Fingerprint) int {
+			return cmp.Compare(a.SongId, b.SongId)
+		})
+		sorted[hash] = postings
+	}
+	return sorted
+}
+
+func allTestHashes() []uint64 {
+	hashes := make([]uint64, 500)
+	for i := range hashes {
+		hashes[i] = uint64(i)
+	}
+	return hashes
+}
+
+func testIndexConfig(t *testing.T) FingerprintIndexConfig {
+	return FingerprintIndexConfig{
+		Path: filepath.Join(t.TempDir(), "fp.idx"),
+		// the tests merge explicitly
+		MergeDelay: time.Hour,
+	}
+}
+
+// assertSearchMatches compares the index with the DB over every hash of the test fingerprints
+func assertSearchMatches(t *testing.T, index *FingerprintIndex, db DB) {
+	t.Helper()
+
+	logger := newTestLogger()
+	want, err := db.SearchFingerprints(context.Background(), allTestHashes(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := index.Search(allTestHashes(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sortedPostings(got), sortedPostings(want)) {
+		t.Errorf("index search differs from the DB search: %d hashes in the index, %d in the DB", len(got), len(want))
+	}
+}
+
+func insertTestCatalog(t *testing.T, db DB, count int) []int {
+	t.Helper()
+
+	songIds := insertTestSongs(t, db, count)
+	for i, songId := range songIds {
+		err := db.InsertFingerprints(context.Background(), songId, testFingerprints(uint64(i), 50), newTestLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return songIds
+}
+
+func TestFingerprintIndexBuildMatchesDB(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db := newTestBackends(t)["sqlite"]
+	insertTestCatalog(t, db, 6)
+
+	config := testIndexConfig(t)
+	index, err := BuildFingerprintIndex(ctx, db, config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close(logger)
+
+	if index.SongsCount() != 6 {
+		t.Errorf("SongsCount = %d, want 6", index.SongsCount())
+	}
+	assertSearchMatches(t, index, db)
+
+	reopened, err := OpenFingerprintIndex(config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(logger)
+
+	assertSearchMatches(t, reopened, db)
+}
+
+func TestFingerprintIndexMerge(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db := newTestBackends(t)["sqlite"]
+	songIds := insertTestCatalog(t, db, 4)
+
+	config := testIndexConfig(t)
+	index, err := BuildFingerprintIndex(ctx, db, config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close(logger)
+
+	// the same changes go to the DB and to the index, like IndexedDB does
+	removed, readded, replaced := songIds[0], songIds[1], songIds[2]
+
+	_, err = db.DeleteSong(ctx, removed, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.RemoveFingerprints(removed, logger)
+
+	err = db.DeleteFingerprints(ctx, readded, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.RemoveFingerprints(readded, logger)
+	err = db.InsertFingerprints(ctx, readded, testFingerprints(100, 40), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.SetFingerprints(readded, testFingerprints(100, 40), logger)
+
+	err = db.ReplaceFingerprints(ctx, replaced, testFingerprints(200, 30), -1, 0, FingerprintVersion, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.SetFingerprints(replaced, testFingerprints(200, 30), logger)
+
+	added, err := db.InsertSong(ctx, "Added", "Artist", "https://example.com/added", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertFingerprints(ctx, added, testFingerprints(300, 60), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.SetFingerprints(added, testFingerprints(300, 60), logger)
+
+	// the pending changes are searched before the merge
+	assertSearchMatches(t, index, db)
+
+	err = index.Merge(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSearchMatches(t, index, db)
+
+	// a song removed and added again after the merge
+	index.RemoveFingerprints(added, logger)
+	index.SetFingerprints(added, testFingerprints(300, 60), logger)
+	err = index.Merge(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSearchMatches(t, index, db)
+
+	reopened, err := OpenFingerprintIndex(config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(logger)
+
+	assertSearchMatches(t, reopened, db)
+}
+
+func TestOpenFingerprintIndexInvalidFile(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db := newTestBackends(t)["sqlite"]
+	insertTestCatalog(t, db, 3)
+
+	config := testIndexConfig(t)
+	index, err := BuildFingerprintIndex(ctx, db, config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Close(logger)
+
+	valid, err := os.ReadFile(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := func(change func(data []byte) []byte) []byte {
+		return change(slices.Clone(valid))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrInvalidFingerprintIndex},
+		{"header only", valid[:fingerprintIndexHeaderSize], ErrInvalidFingerprintIndex},
+		{"truncated postings", valid[:len(valid)-1], ErrInvalidFingerprintIndex},
+		{"truncated table", valid[:fingerprintIndexHeaderSize+fingerprintIndexEntrySize+8], ErrInvalidFingerprintIndex},
+		{"bad magic", corrupt(func(data []byte) []byte {
+			data[0] = 'X'
+			return data
+		}), ErrInvalidFingerprintIndex},
+		{"old format version", corrupt(func(data []byte) []byte {
+			data[len(fingerprintIndexMagic)] = 1
+			return data
+		}), ErrInvalidFingerprintIndex},
+		{"hash count past the file", corrupt(func(data []byte) []byte {
+			binary.LittleEndian.PutUint64(data[16:], 1<<40)
+			return data
+		}), ErrInvalidFingerprintIndex},
+		{"other fingerprint version", corrupt(func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[8:], FingerprintVersion+1)
+			return data
+		}), ErrStaleFingerprintIndex},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := os.WriteFile(config.Path, test.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			index, err := OpenFingerprintIndex(config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+			if err == nil {
+				index.Close(logger)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("OpenFingerprintIndex: err = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestIndexedDBRebuildWithPendingWrites(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	backend := newTestBackends(t)["sqlite"]
+	insertTestCatalog(t, backend, 3)
+
+	config := testIndexConfig(t)
+	db, err := NewIndexedDB(ctx, backend, config, DefaultSearchOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pending writes stay in memory, the merge delay is an hour
+	pending, err := db.InsertSong(ctx, "Pending", "Artist", "https://example.com/pending", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertFingerprints(ctx, pending, testFingerprints(10, 50), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writes during the rebuild are replayed on the new index
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 5 {
+			songId, err := db.InsertSong(ctx, "During", "Rebuild", fmt.Sprintf("https://example.com/during/%d", i), logger)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			err = db.InsertFingerprints(ctx, songId, testFingerprints(uint64(20+i), 20), logger)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	err = db.Rebuild(ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	assertSearchMatches(t, db.index, backend)
+
+	songsCount, err := backend.GetSongsCount(ctx, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.index.SongsCount() != songsCount {
+		t.Errorf("index songs count = %d, want %d", db.index.SongsCount(), songsCount)
+	}
+
+	// a failed build keeps the old index
+	err = os.Mkdir(config.Path+".rebuild", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(config.Path+".rebuild", "file"), nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Rebuild(ctx, logger)
+	if err == nil {
+		t.Fatal("Rebuild succeeded without a writable build file")
+	}
+	assertSearchMatches(t, db.index, backend)
+
+	err = db.Close(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the closed index matches the DB, so it is opened instead of built
+	reopened, err := OpenFingerprintIndex(config, DefaultSearchOptions().MaxPostingsPerHash, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close(logger)
+
+	checksum, err := catalogChecksum(ctx, backend, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.CatalogChecksum() != checksum {
+		t.Errorf("catalog checksum of the closed index = %d, want %d", reopened.CatalogChecksum(), checksum)
+	}
+	assertSearchMatches(t, reopened, backend)
+}
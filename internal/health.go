@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// CheckBinary reports whether the binary is on the PATH,
+// a path with a slash like venv/bin/yt-dlp is checked directly
+func CheckBinary(name string, logger *slog.Logger) error {
+	_, err := exec.LookPath(name)
+	if err != nil {
+		logger.With(slog.String("binary", name), slog.String("err", err.Error())).Warn("Binary is missing")
+	}
+	return err
+}
+
+// CheckWritableDir creates and removes a file in the dir
+func CheckWritableDir(dir string, logger *slog.Logger) error {
+	logger = logger.With(slog.String("dir", dir))
+
+	file, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Directory is not writable")
+		return err
+	}
+
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// IndexedDB serves SearchFingerprints from a FingerprintIndex instead of the DB,
+// the writes go to the DB and then to the index, the rest is served by the DB
+type IndexedDB struct {
+	DB
+	config FingerprintIndexConfig
+	search SearchOptions
+
+	// the writes hold the read lock from the DB write until the index is updated,
+	// so a rebuild swaps the index between the writes
+	mu    sync.RWMutex
+	index *FingerprintIndex
+}
+
+// NewIndexedDB opens the index file, it is built from the DB when it is missing, made with another FingerprintVersion,
+// or its count of songs or its catalog checksum differs from the DB, e.g. when another process changed the DB
+// or the index wasn`t closed
+func NewIndexedDB(ctx context.Context, db DB, config FingerprintIndexConfig, search SearchOptions, logger *slog.Logger) (*IndexedDB, error) {
+	songsCount, err := db.GetSongsCount(ctx, "", logger)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := OpenFingerprintIndex(config, search.MaxPostingsPerHash, logger)
+	if err == nil && index.SongsCount() != songsCount {
+		logger.With(
+			slog.String("fingerprint_index", config.Path),
+			slog.Int("index_songs_count", index.SongsCount()),
+			slog.Int("songs_count", songsCount),
+		).Warn("Fingerprint index is behind the DB")
+		index.unmap()
+		err = ErrStaleFingerprintIndex
+	}
+
+	if err == nil {
+		checksum, checksumErr := catalogChecksum(ctx, db, logger)
+		if checksumErr != nil {
+			index.unmap()
+			return nil, checksumErr
+		}
+
+		if index.CatalogChecksum() != checksum {
+			logger.With(
+				slog.String("fingerprint_index", config.Path),
+				slog.Uint64("index_catalog_checksum", index.CatalogChecksum()),
+				slog.Uint64("catalog_checksum", checksum),
+			).Warn("Fingerprint index doesn`t match the DB")
+			index.unmap()
+			err = ErrStaleFingerprintIndex
+		}
+	}
+
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrStaleFingerprintIndex) && !errors.Is(err, ErrInvalidFingerprintIndex) {
+			return nil, err
+		}
+
+		logger.With(slog.String("fingerprint_index", config.Path)).Info("Building the fingerprint index from the DB")
+		index, err = BuildFingerprintIndex(ctx, db, config, search.MaxPostingsPerHash, logger)
+		if err != nil {
+			logger.With(slog.String("fingerprint_index", config.Path), slog.String("err", err.Error())).Error("Couldn`t build the fingerprint index")
+			return nil, err
+		}
+	}
+
+	return &IndexedDB{
+		DB:     db,
+		config: config,
+		search: search,
+		index:  index,
+	}, nil
+}
+
+// Rebuild builds the index from the DB again, e.g. after the DB was changed by a process without the index.
+// The old index serves the searches during the build and is kept when the build fails
+func (db *IndexedDB) Rebuild(ctx context.Context, logger *slog.Logger) error {
+	db.mu.RLock()
+	old := db.index
+	db.mu.RUnlock()
+
+	// the changes during the build stay pending in the old index and are replayed on the new one,
+	// the build may have read some of them already, but a change replayed again is harmless
+	old.holdMerges()
+
+	config := db.config
+	config.Path += ".rebuild"
+
+	index, err := BuildFingerprintIndex(ctx, db.DB, config, db.search.MaxPostingsPerHash, logger)
+	if err != nil {
+		logger.With(
+			slog.String("fingerprint_index", db.config.Path),
+			slog.String("err", err.Error()),
+		).Error("Couldn`t rebuild the fingerprint index, the old one is kept")
+		os.Remove(config.Path)
+		old.resumeMerges(logger)
+		return err
+	}
+
+	db.mu.Lock()
+
+	err = db.swapIndex(ctx, old, index, logger)
+	if err != nil {
+		db.mu.Unlock()
+
+		index.unmap()
+		os.Remove(config.Path)
+		old.resumeMerges(logger)
+		return err
+	}
+
+	db.mu.Unlock()
+
+	// nothing reads the old index after the swap
+	old.unmap()
+	return nil
+}
+
+// swapIndex must be called with the lock held
+func (db *IndexedDB) swapIndex(ctx context.Context, old *FingerprintIndex, index *FingerprintIndex, logger *slog.Logger) error {
+	// no write is between the DB and the index, so the count is exact
+	songsCount, err := db.DB.GetSongsCount(ctx, "", logger)
+	if err != nil {
+		return err
+	}
+
+	err = index.takeOver(old, logger)
+	if err != nil {
+		return err
+	}
+
+	if delta := songsCount - index.SongsCount(); delta != 0 {
+		index.AddSongsCount(delta, logger)
+	}
+
+	db.index = index
+	return nil
+}
+
+// Close merges the pending changes with the checksum of the DB into the index file and closes the DB
+func (db *IndexedDB) Close(logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// the writes are done, so the checksum matches the merged index,
+	// without it the next start builds the index again
+	checksum, err := catalogChecksum(context.Background(), db.DB, logger)
+	if err == nil {
+		db.index.SetCatalogChecksum(checksum)
+	}
+
+	err = db.index.Close(logger)
+
+	if closer, ok := db.DB.(Closer); ok {
+		err = errors.Join(err, closer.Close(logger))
+	}
+	return err
+}
+
+// catalogChecksum hashes the id, the FingerprintVersion, the index time and the duplicate link of every song,
+// which change with every ingestion, reindex and delete
+func catalogChecksum(ctx context.Context, db DB, logger *slog.Logger) (uint64, error) {
+	const pageSize = 500
+
+	checksum := fnv.New64a()
+	var buf [32]byte
+
+	query := SongsQuery{
+		Sort:  SortSongsById,
+		Page:  1,
+		Limit: pageSize,
+	}
+
+	for {
+		page, err := db.GetSongsPagination(ctx, query, logger)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Couldn`t compute the catalog checksum")
+			return 0, err
+		}
+
+		for _, song := range page {
+			binary.LittleEndian.PutUint64(buf[0:], uint64(song.SongId))
+			binary.LittleEndian.PutUint64(buf[8:], uint64(song.FingerprintVersion))
+			binary.LittleEndian.PutUint64(buf[16:], uint64(song.IndexedAt.Unix()))
+			binary.LittleEndian.PutUint64(buf[24:], uint64(song.DuplicateOf))
+			checksum.Write(buf[:])
+		}
+
+		if len(page) < pageSize {
+			break
+		}
+
+		cursor := NewSongsCursor(page[len(page)-1])
+		query.After = &cursor
+	}
+
+	// 0 is the checksum of a changed index
+	return max(checksum.Sum64(), 1), nil
+}
+
+func (db *IndexedDB) InsertSong(ctx context.Context, songTitle string, songArtist string, songUrl string, logger *slog.Logger) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	songId, err := db.DB.InsertSong(ctx, songTitle, songArtist, songUrl, logger)
+	if err == nil {
+		db.index.AddSongsCount(1, logger)
+	}
+	return songId, err
+}
+
+func (db *IndexedDB) InsertFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	err := db.DB.InsertFingerprints(ctx, songId, fingerprints, logger)
+	if err == nil {
+		db.index.SetFingerprints(songId, fingerprints, logger)
+	}
+	return err
+}
+
+func (db *IndexedDB) DeleteSong(ctx context.Context, songId int, logger *slog.Logger) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	promotedId, err := db.DB.DeleteSong(ctx, songId, logger)
+	if err != nil {
+		return promotedId, err
+	}
+
+	db.index.RemoveFingerprints(songId, logger)
+	db.index.AddSongsCount(-1, logger)
+
+	if promotedId != -1 {
+		// the promoted duplicate got the fingerprints of the deleted song
+		fingerprints, err := db.DB.GetSongFingerprints(ctx, promotedId, logger)
+		if err != nil {
+			logger.With(
+				slog.String("fingerprint_index", db.config.Path),
+				slog.Int("song_id", promotedId),
+				slog.String("err", err.Error()),
+			).Error("Couldn`t add the promoted duplicate to the fingerprint index, rebuild the index")
+			return promotedId, err
+		}
+		db.index.SetFingerprints(promotedId, fingerprints, logger)
+	}
+
+	return promotedId, nil
+}
+
+func (db *IndexedDB) DeleteFingerprints(ctx context.Context, songId int, logger *slog.Logger) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	err := db.DB.DeleteFingerprints(ctx, songId, logger)
+	if err == nil {
+		db.index.RemoveFingerprints(songId, logger)
+	}
+	return err
+}
+
+func (db *IndexedDB) ReplaceFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, duplicateOf int, similarity float64, fingerprintVersion int, logger *slog.Logger) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	err := db.DB.ReplaceFingerprints(ctx, songId, fingerprints, duplicateOf, similarity, fingerprintVersion, logger)
+	if err != nil {
+		return err
+	}
+
+	if duplicateOf != -1 {
+		db.index.RemoveFingerprints(songId, logger)
+		return nil
+	}
+
+	db.index.SetFingerprints(songId, fingerprints, logger)
+	return nil
+}
+
+func (db *IndexedDB) SearchFingerprints(ctx context.Context, hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.index.Search(hashes, logger)
+}
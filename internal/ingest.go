@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+)
+
+type Ingester struct {
+	db                 DB
+	duplicateThreshold float64
+}
+
+type IngestResult struct {
+	SongId      int
+	DuplicateOf int
+	Similarity  float64
+}
+
+// duplicateThreshold is the share of the song fingerprints that must be time aligned
+// with an existing song for the new one to be stored as its duplicate, 0 disables the check
+func NewIngester(db DB, duplicateThreshold float64, logger *slog.Logger) *Ingester {
+	logger.With(slog.Float64("duplicate_threshold", duplicateThreshold)).Info("Ingester is created successfully")
+	return &Ingester{
+		db:                 db,
+		duplicateThreshold: duplicateThreshold,
+	}
+}
+
+func (ingester *Ingester) Ingest(ctx context.Context, songTitle string, songArtist string, songUrl string, fingerprints map[uint64]uint32, logger *slog.Logger) (IngestResult, error) {
+	songId, err := ingester.db.InsertSong(ctx, songTitle, songArtist, songUrl, logger)
+	if err != nil {
+		return IngestResult{SongId: -1, DuplicateOf: -1}, err
+	}
+
+	return ingester.store(ctx, songId, fingerprints, logger)
+}
+
+// Reindex replaces the fingerprints of an existing song, the duplicate check is repeated without the song itself
+// so a former duplicate can become an original, the old index is replaced in one transaction only after the check,
+// so a failure keeps the song with its old fingerprints
+func (ingester *Ingester) Reindex(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) (IngestResult, error) {
+	logger = logger.With(slog.Int("song_id", songId))
+
+	result, err := ingester.checkDuplicate(ctx, songId, fingerprints, logger)
+	if err != nil {
+		return result, err
+	}
+
+	err = ingester.db.ReplaceFingerprints(ctx, songId, fingerprints, result.DuplicateOf, result.Similarity, FingerprintVersion, logger)
+	if err != nil {
+		return result, err
+	}
+
+	logger.With(
+		slog.Int("duplicate_of", result.DuplicateOf),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Song was reindexed successfully")
+
+	return result, nil
+}
+
+// checkDuplicate looks for an existing song which the fingerprints duplicate, the song itself is skipped
+func (ingester *Ingester) checkDuplicate(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) (IngestResult, error) {
+	result := IngestResult{
+		SongId:      songId,
+		DuplicateOf: -1,
+	}
+
+	if ingester.duplicateThreshold <= 0 || len(fingerprints) == 0 {
+		return result, nil
+	}
+
+	duplicateOf, similarity, err := ingester.findDuplicate(ctx, songId, fingerprints, logger)
+	if err != nil {
+		return result, err
+	}
+
+	if similarity >= ingester.duplicateThreshold {
+		result.DuplicateOf = duplicateOf
+		result.Similarity = similarity
+	}
+
+	return result, nil
+}
+
+func (ingester *Ingester) store(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) (IngestResult, error) {
+	logger = logger.With(slog.Int("song_id", songId))
+
+	result, err := ingester.checkDuplicate(ctx, songId, fingerprints, logger)
+	if err != nil {
+		return result, err
+	}
+
+	// the fingerprints of a duplicate are not stored,
+	// so it doesn`t compete with the original when matching
+	if result.DuplicateOf != -1 {
+		err = ingester.db.InsertSongDuplicate(ctx, songId, result.DuplicateOf, result.Similarity, logger)
+		if err != nil {
+			return result, err
+		}
+
+		err = ingester.db.SetSongIndexed(ctx, songId, FingerprintVersion, logger)
+		if err != nil {
+			return result, err
+		}
+
+		logger.With(
+			slog.Int("duplicate_of", result.DuplicateOf),
+			slog.Float64("similarity", result.Similarity),
+		).Info("Song was linked as a duplicate")
+		return result, nil
+	}
+
+	err = ingester.db.InsertFingerprints(ctx, songId, fingerprints, logger)
+	if err != nil {
+		return result, err
+	}
+
+	err = ingester.db.SetSongIndexed(ctx, songId, FingerprintVersion, logger)
+	if err != nil {
+		return result, err
+	}
+
+	logger.With(slog.Int("fingerprints_count", len(fingerprints))).Debug("Song was ingested successfully")
+
+	return result, nil
+}
+
+// findDuplicate matches the fingerprints against the existing index and returns the most similar song
+// other than songId with the share of aligned fingerprints
+func (ingester *Ingester) findDuplicate(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) (int, float64, error) {
+	dbFingerprints, err := ingester.db.SearchFingerprints(ctx, slices.Collect(maps.Keys(fingerprints)), logger)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	bestSongId := -1
+	bestAligned := 0
+	for candidateId, aligned := range AlignedMatches(fingerprints, dbFingerprints) {
+		// a reindexed song still has its old fingerprints
+		if candidateId == songId {
+			continue
+		}
+		if bestAligned < aligned {
+			bestSongId = candidateId
+			bestAligned = aligned
+		}
+	}
+
+	similarity := float64(bestAligned) / float64(len(fingerprints))
+
+	logger.With(
+		slog.Int("candidate_song_id", bestSongId),
+		slog.Float64("similarity", similarity),
+	).Debug("Duplicate check finished")
+
+	return bestSongId, similarity, nil
+}
@@ -1,12 +1,141 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func NewLogger() *slog.Logger {
-	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	}))
+var ErrInvalidLogFormat = errors.New("invalid log format")
+var ErrInvalidLogLevel = errors.New("invalid log level")
+
+type LogOptions struct {
+	// Format is text or json
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	// Level is debug, info, warn or error
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// FilePath is where the logs are written instead of stdout, empty keeps stdout
+	FilePath string `yaml:"file" env:"LOG_FILE"`
+	// the log file is rotated when it reaches FileMaxSizeMB,
+	// FileMaxBackups rotated files are kept for FileMaxAgeDays
+	FileMaxSizeMB  int `yaml:"file_max_size_mb" env:"LOG_FILE_MAX_SIZE_MB"`
+	FileMaxBackups int `yaml:"file_max_backups" env:"LOG_FILE_MAX_BACKUPS"`
+	FileMaxAgeDays int `yaml:"file_max_age_days" env:"LOG_FILE_MAX_AGE_DAYS"`
+	// DebugSampling keeps every n-th debug line with the same message, 1 keeps all of them
+	DebugSampling int `yaml:"debug_sampling" env:"LOG_DEBUG_SAMPLING"`
+	// Output replaces stdout when FilePath is empty, the CLI commands log to stderr
+	Output io.Writer `yaml:"-"`
+}
+
+func DefaultLogOptions() LogOptions {
+	return LogOptions{
+		Format:         "text",
+		Level:          "info",
+		FileMaxSizeMB:  100,
+		FileMaxBackups: 5,
+		FileMaxAgeDays: 30,
+		DebugSampling:  1,
+	}
+}
+
+// NewLogger builds the logger from the options,
+// the returned closer closes the log file and must be called on exit
+func NewLogger(options LogOptions) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(options.Level))
+	if err != nil {
+		return nil, nil, ErrInvalidLogLevel
+	}
+
+	var output io.WriteCloser = nopCloser{os.Stdout}
+	if options.Output != nil {
+		output = nopCloser{options.Output}
+	}
+	if options.FilePath != "" {
+		output = &lumberjack.Logger{
+			Filename:   options.FilePath,
+			MaxSize:    options.FileMaxSizeMB,
+			MaxBackups: options.FileMaxBackups,
+			MaxAge:     options.FileMaxAgeDays,
+		}
+	}
+
+	handlerOptions := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(options.Format) {
+	case "text":
+		handler = slog.NewTextHandler(output, handlerOptions)
+	case "json":
+		handler = slog.NewJSONHandler(output, handlerOptions)
+	default:
+		return nil, nil, ErrInvalidLogFormat
+	}
+
+	if options.DebugSampling > 1 {
+		handler = &samplingHandler{
+			next:     handler,
+			every:    uint64(options.DebugSampling),
+			counters: &sync.Map{},
+		}
+	}
+
+	return slog.New(handler), output, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// samplingHandler drops the debug lines of the hot paths (requests, queries),
+// it counts the lines per message and keeps the first one and every n-th after it
+type samplingHandler struct {
+	next  slog.Handler
+	every uint64
+	// shared with the handlers derived by WithAttrs and WithGroup
+	counters *sync.Map
+}
+
+func (handler *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return handler.next.Enabled(ctx, level)
+}
+
+func (handler *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level == slog.LevelDebug {
+		counter, _ := handler.counters.LoadOrStore(record.Message, &atomic.Uint64{})
+		if (counter.(*atomic.Uint64).Add(1)-1)%handler.every != 0 {
+			return nil
+		}
+	}
+
+	return handler.next.Handle(ctx, record)
+}
+
+func (handler *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{
+		next:     handler.next.WithAttrs(attrs),
+		every:    handler.every,
+		counters: handler.counters,
+	}
+}
+
+func (handler *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{
+		next:     handler.next.WithGroup(name),
+		every:    handler.every,
+		counters: handler.counters,
+	}
 }
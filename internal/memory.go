@@ -0,0 +1,740 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var ErrSongUrlExists = errors.New("song url already exists")
+
+// DBMemory keeps the whole catalog in memory with an inverted index from hash to postings.
+// When a snapshot path is given the catalog is loaded from it and saved snapshotInterval
+// after a change and on Close, so it fits tests and small single node deployments
+type DBMemory struct {
+	mu               sync.RWMutex
+	snapshotPath     string
+	snapshotInterval time.Duration
+	search           SearchOptions
+
+	// fileMu serializes the snapshot writes, dirtyMu guards dirty and flushTimer
+	fileMu     sync.Mutex
+	dirtyMu    sync.Mutex
+	dirty      bool
+	flushTimer *time.Timer
+
+	songs        map[int]Song
+	duplicates   map[int]memorySongDuplicate
+	fingerprints map[int]map[uint64]uint32
+	postings     map[uint64][]Fingerprint
+	nextSongId   int
+}
+
+type memorySongDuplicate struct {
+	DuplicateOf int
+	Similarity  float64
+}
+
+// memorySnapshot is the gob encoded content of the snapshot file,
+// the postings are rebuilt from the fingerprints on load
+type memorySnapshot struct {
+	Songs        map[int]Song
+	Duplicates   map[int]memorySongDuplicate
+	Fingerprints map[int]map[uint64]uint32
+	NextSongId   int
+}
+
+// NewDBMemory creates an in-memory db, an empty snapshotPath disables the persistence,
+// a zero snapshotInterval saves the snapshot only on Close
+func NewDBMemory(snapshotPath string, snapshotInterval time.Duration, search SearchOptions, logger *slog.Logger) (DB, error) {
+	db := &DBMemory{
+		snapshotPath:     snapshotPath,
+		snapshotInterval: snapshotInterval,
+		search:           search,
+		songs:            make(map[int]Song),
+		duplicates:       make(map[int]memorySongDuplicate),
+		fingerprints:     make(map[int]map[uint64]uint32),
+		postings:         make(map[uint64][]Fingerprint),
+		nextSongId:       1,
+	}
+
+	if snapshotPath != "" {
+		err := db.loadSnapshot(logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.With(slog.String("snapshot_path", snapshotPath)).Info("DB is created successfully")
+	return db, nil
+}
+
+func (db *DBMemory) loadSnapshot(logger *slog.Logger) error {
+	logger = logger.With(slog.String("snapshot_path", db.snapshotPath))
+
+	file, err := os.Open(db.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Info("No snapshot found, starting with an empty catalog")
+		return nil
+	}
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while opening the snapshot")
+		return err
+	}
+	defer file.Close()
+
+	var snapshot memorySnapshot
+	err = gob.NewDecoder(file).Decode(&snapshot)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while decoding the snapshot")
+		return err
+	}
+
+	if snapshot.Songs != nil {
+		db.songs = snapshot.Songs
+	}
+	if snapshot.Duplicates != nil {
+		db.duplicates = snapshot.Duplicates
+	}
+	if snapshot.Fingerprints != nil {
+		db.fingerprints = snapshot.Fingerprints
+	}
+	db.nextSongId = max(snapshot.NextSongId, 1)
+
+	for songId, fingerprints := range db.fingerprints {
+		db.addPostings(songId, fingerprints)
+	}
+
+	logger.With(slog.Int("songs_count", len(db.songs))).Info("Snapshot was loaded successfully")
+
+	return nil
+}
+
+// changed schedules the snapshot of the changed catalog, it is called with the write lock held
+func (db *DBMemory) changed(logger *slog.Logger) {
+	if db.snapshotPath == "" {
+		return
+	}
+
+	db.dirtyMu.Lock()
+	defer db.dirtyMu.Unlock()
+
+	db.dirty = true
+	// the timer isn`t reset by the later changes, so a busy catalog is still saved every interval
+	if db.snapshotInterval > 0 && db.flushTimer == nil {
+		db.flushTimer = time.AfterFunc(db.snapshotInterval, func() {
+			db.saveSnapshot(logger)
+		})
+	}
+}
+
+// saveSnapshot writes the catalog when it changed since the last snapshot, the catalog is encoded
+// under the read lock, the snapshot is written to a temp file and renamed so a crash doesn`t leave a partial snapshot
+func (db *DBMemory) saveSnapshot(logger *slog.Logger) error {
+	db.fileMu.Lock()
+	defer db.fileMu.Unlock()
+
+	db.dirtyMu.Lock()
+	dirty := db.dirty
+	db.dirty = false
+	if db.flushTimer != nil {
+		db.flushTimer.Stop()
+		db.flushTimer = nil
+	}
+	db.dirtyMu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	logger = logger.With(slog.String("snapshot_path", db.snapshotPath))
+
+	err := db.writeSnapshot(logger)
+	if err != nil {
+		// the next snapshot retries
+		db.dirtyMu.Lock()
+		db.dirty = true
+		db.dirtyMu.Unlock()
+		return err
+	}
+
+	logger.Debug("Snapshot was saved successfully")
+	return nil
+}
+
+func (db *DBMemory) writeSnapshot(logger *slog.Logger) error {
+	var buf bytes.Buffer
+
+	db.mu.RLock()
+	snapshot := memorySnapshot{
+		Songs:        db.songs,
+		Duplicates:   db.duplicates,
+		Fingerprints: db.fingerprints,
+		NextSongId:   db.nextSongId,
+	}
+	err := gob.NewEncoder(&buf).Encode(snapshot)
+	db.mu.RUnlock()
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while encoding the snapshot")
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(db.snapshotPath), filepath.Base(db.snapshotPath)+".*.tmp")
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while creating the snapshot")
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = buf.WriteTo(file)
+	if err != nil {
+		file.Close()
+		logger.With(slog.String("err", err.Error())).Warn("Error while writing the snapshot")
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while writing the snapshot")
+		return err
+	}
+
+	err = os.Rename(file.Name(), db.snapshotPath)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while replacing the snapshot")
+		return err
+	}
+
+	return nil
+}
+
+// Close saves the changes which weren`t saved by the snapshot interval yet
+func (db *DBMemory) Close(logger *slog.Logger) error {
+	if db.snapshotPath == "" {
+		return nil
+	}
+	return db.saveSnapshot(logger)
+}
+
+func (db *DBMemory) addPostings(songId int, fingerprints map[uint64]uint32) {
+	for hash, timestamp := range fingerprints {
+		db.postings[hash] = append(db.postings[hash], Fingerprint{
+			HashKey:   hash,
+			SongId:    songId,
+			Timestamp: timestamp,
+		})
+	}
+}
+
+func (db *DBMemory) removePostings(songId int) {
+	for hash := range db.fingerprints[songId] {
+		postings := slices.DeleteFunc(db.postings[hash], func(fingerprint Fingerprint) bool {
+			return fingerprint.SongId == songId
+		})
+
+		if len(postings) == 0 {
+			delete(db.postings, hash)
+			continue
+		}
+		db.postings[hash] = postings
+	}
+
+	delete(db.fingerprints, songId)
+}
+
+func (db *DBMemory) SetupDB(ctx context.Context, logger *slog.Logger) error {
+	logger.Info("Db setup successfully")
+	return nil
+}
+
+// MigrationsStatus is empty, the in-memory db has no schema
+func (db *DBMemory) MigrationsStatus(ctx context.Context, logger *slog.Logger) ([]MigrationStatus, error) {
+	return []MigrationStatus{}, nil
+}
+
+// Ping always succeeds, the in-memory db has no connection
+func (db *DBMemory) Ping(ctx context.Context, logger *slog.Logger) error {
+	return nil
+}
+
+func (db *DBMemory) InsertSong(ctx context.Context, songTitle string, songArtist string, songUrl string, logger *slog.Logger) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, song := range db.songs {
+		if song.SongUrl == songUrl {
+			logger.With(
+				slog.String("song_title", songTitle),
+				slog.String("song_url", songUrl),
+			).Warn("Error while inserting a song")
+			return -1, ErrSongUrlExists
+		}
+	}
+
+	songId := db.nextSongId
+	db.nextSongId++
+
+	db.songs[songId] = Song{
+		SongId:      songId,
+		SongTitle:   songTitle,
+		SongArtist:  songArtist,
+		SongUrl:     songUrl,
+		AddedAt:     time.Unix(time.Now().Unix(), 0),
+		DuplicateOf: -1,
+	}
+
+	db.changed(logger)
+
+	logger.With(
+		slog.Int("song_id", songId),
+		slog.String("song_title", songTitle),
+	).Debug("Song was inserted successfully")
+
+	return songId, nil
+}
+
+func (db *DBMemory) InsertFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	songFingerprints := db.fingerprints[songId]
+	if songFingerprints == nil {
+		songFingerprints = make(map[uint64]uint32, len(fingerprints))
+		db.fingerprints[songId] = songFingerprints
+	}
+
+	for hash, timestamp := range fingerprints {
+		songFingerprints[hash] = timestamp
+	}
+	db.addPostings(songId, fingerprints)
+
+	db.changed(logger)
+
+	logger.With(
+		slog.Int("song_id", songId),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Fingerprints were inserted successfully")
+
+	return nil
+}
+
+func (db *DBMemory) InsertSongDuplicate(ctx context.Context, songId int, duplicateOf int, similarity float64, logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.duplicates[songId] = memorySongDuplicate{
+		DuplicateOf: duplicateOf,
+		Similarity:  similarity,
+	}
+
+	db.changed(logger)
+	return nil
+}
+
+func (db *DBMemory) DeleteSong(ctx context.Context, songId int, logger *slog.Logger) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	song, found := db.songs[songId]
+	if !found {
+		logger.With(slog.Int("song_id", songId)).Debug("Song was not found")
+		return -1, ErrSongNotFound
+	}
+
+	promotedId := db.promoteDuplicate(song)
+
+	db.removePostings(songId)
+	delete(db.duplicates, songId)
+	delete(db.songs, songId)
+
+	db.changed(logger)
+
+	logger.With(slog.Int("song_id", songId), slog.Int("promoted_song_id", promotedId)).Debug("Song was deleted successfully")
+
+	return promotedId, nil
+}
+
+// promoteDuplicate gives the fingerprints of the song to its most similar duplicate and links
+// the other duplicates to it, -1 when the song has no duplicates, it is called with the write lock held
+func (db *DBMemory) promoteDuplicate(song Song) int {
+	promotedId := -1
+	bestSimilarity := 0.0
+	for duplicateId, duplicate := range db.duplicates {
+		if duplicate.DuplicateOf != song.SongId {
+			continue
+		}
+		if promotedId == -1 || duplicate.Similarity > bestSimilarity ||
+			(duplicate.Similarity == bestSimilarity && duplicateId < promotedId) {
+			promotedId = duplicateId
+			bestSimilarity = duplicate.Similarity
+		}
+	}
+
+	if promotedId == -1 {
+		return -1
+	}
+
+	fingerprints := db.fingerprints[song.SongId]
+	db.removePostings(song.SongId)
+	if len(fingerprints) > 0 {
+		db.fingerprints[promotedId] = fingerprints
+		db.addPostings(promotedId, fingerprints)
+	}
+
+	delete(db.duplicates, promotedId)
+	for duplicateId, duplicate := range db.duplicates {
+		if duplicate.DuplicateOf == song.SongId {
+			duplicate.DuplicateOf = promotedId
+			db.duplicates[duplicateId] = duplicate
+		}
+	}
+
+	promoted := db.songs[promotedId]
+	promoted.FingerprintVersion = song.FingerprintVersion
+	promoted.IndexedAt = song.IndexedAt
+	db.songs[promotedId] = promoted
+
+	return promotedId
+}
+
+func (db *DBMemory) DeleteFingerprints(ctx context.Context, songId int, logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.removePostings(songId)
+	delete(db.duplicates, songId)
+
+	db.changed(logger)
+
+	logger.With(slog.Int("song_id", songId)).Debug("Fingerprints were deleted successfully")
+
+	return nil
+}
+
+func (db *DBMemory) ReplaceFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, duplicateOf int, similarity float64, fingerprintVersion int, logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.removePostings(songId)
+	delete(db.duplicates, songId)
+
+	if duplicateOf != -1 {
+		for duplicateId, duplicate := range db.duplicates {
+			if duplicate.DuplicateOf == songId {
+				duplicate.DuplicateOf = duplicateOf
+				db.duplicates[duplicateId] = duplicate
+			}
+		}
+		db.duplicates[songId] = memorySongDuplicate{
+			DuplicateOf: duplicateOf,
+			Similarity:  similarity,
+		}
+	} else if len(fingerprints) > 0 {
+		db.fingerprints[songId] = maps.Clone(fingerprints)
+		db.addPostings(songId, fingerprints)
+	}
+
+	song, found := db.songs[songId]
+	if found {
+		song.FingerprintVersion = fingerprintVersion
+		song.IndexedAt = time.Unix(time.Now().Unix(), 0)
+		db.songs[songId] = song
+	}
+
+	db.changed(logger)
+
+	logger.With(
+		slog.Int("song_id", songId),
+		slog.Int("duplicate_of", duplicateOf),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Fingerprints were replaced successfully")
+
+	return nil
+}
+
+func (db *DBMemory) SetSongIndexed(ctx context.Context, songId int, fingerprintVersion int, logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	song, found := db.songs[songId]
+	if !found {
+		return nil
+	}
+
+	song.FingerprintVersion = fingerprintVersion
+	song.IndexedAt = time.Unix(time.Now().Unix(), 0)
+	db.songs[songId] = song
+
+	db.changed(logger)
+	return nil
+}
+
+// SetSongAddedAt keeps the time a song was added in another db, e.g. by an import
+func (db *DBMemory) SetSongAddedAt(ctx context.Context, songId int, addedAt time.Time, logger *slog.Logger) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	song, found := db.songs[songId]
+	if !found {
+		return nil
+	}
+
+	song.AddedAt = time.Unix(addedAt.Unix(), 0)
+	db.songs[songId] = song
+
+	db.changed(logger)
+	return nil
+}
+
+func (db *DBMemory) GetSongStats(ctx context.Context, songId int, logger *slog.Logger) (SongStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var stats SongStats
+	for _, timestamp := range db.fingerprints[songId] {
+		if stats.FingerprintsCount == 0 || timestamp < stats.FirstTimestamp {
+			stats.FirstTimestamp = timestamp
+		}
+		if stats.FingerprintsCount == 0 || timestamp > stats.LastTimestamp {
+			stats.LastTimestamp = timestamp
+		}
+		stats.FingerprintsCount++
+	}
+
+	return stats, nil
+}
+
+func (db *DBMemory) GetSongFingerprints(ctx context.Context, songId int, logger *slog.Logger) (map[uint64]uint32, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return maps.Clone(db.fingerprints[songId]), nil
+}
+
+// GetStorageStats estimates the memory of the maps, the inverted index is reported as the index of the fingerprints
+func (db *DBMemory) GetStorageStats(ctx context.Context, logger *slog.Logger) ([]TableStorage, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	songsBytes := 0
+	for _, song := range db.songs {
+		songsBytes += int(unsafe.Sizeof(song)) + len(song.SongTitle) + len(song.SongArtist) + len(song.SongUrl)
+	}
+
+	fingerprintsCount := 0
+	for _, fingerprints := range db.fingerprints {
+		fingerprintsCount += len(fingerprints)
+	}
+
+	postingsCount := 0
+	for _, postings := range db.postings {
+		postingsCount += len(postings)
+	}
+
+	return []TableStorage{
+		{
+			Table:     "songs",
+			Rows:      int64(len(db.songs)),
+			DataBytes: int64(songsBytes),
+		},
+		{
+			Table:      "fingerprints",
+			Rows:       int64(fingerprintsCount),
+			DataBytes:  int64(fingerprintsCount * int(unsafe.Sizeof(uint64(0))+unsafe.Sizeof(uint32(0)))),
+			IndexBytes: int64(postingsCount * int(unsafe.Sizeof(Fingerprint{}))),
+		},
+		{
+			Table:     "song_duplicates",
+			Rows:      int64(len(db.duplicates)),
+			DataBytes: int64(len(db.duplicates) * int(unsafe.Sizeof(memorySongDuplicate{}))),
+		},
+	}, nil
+}
+
+func (db *DBMemory) GetFingerprintsCount(ctx context.Context, logger *slog.Logger) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	count := 0
+	for _, fingerprints := range db.fingerprints {
+		count += len(fingerprints)
+	}
+
+	return count, nil
+}
+
+// song must be called with the lock held
+func (db *DBMemory) song(songId int) Song {
+	song := db.songs[songId]
+	song.DuplicateOf = -1
+	if duplicate, found := db.duplicates[songId]; found {
+		song.DuplicateOf = duplicate.DuplicateOf
+	}
+	return song
+}
+
+// searchSongs must be called with the lock held,
+// every search term must be contained in the title or the artist like the LIKE fallback of SQLite
+func (db *DBMemory) searchSongs(search string) []Song {
+	terms := searchTerms(search)
+	for i, term := range terms {
+		terms[i] = strings.ToLower(term)
+	}
+
+	songs := make([]Song, 0, len(db.songs))
+	for songId, song := range db.songs {
+		title := strings.ToLower(song.SongTitle)
+		artist := strings.ToLower(song.SongArtist)
+
+		matches := true
+		for _, term := range terms {
+			if !strings.Contains(title, term) && !strings.Contains(artist, term) {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			songs = append(songs, db.song(songId))
+		}
+	}
+
+	return songs
+}
+
+func (db *DBMemory) GetSongsCount(ctx context.Context, search string, logger *slog.Logger) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	count := len(db.searchSongs(search))
+
+	logger.With(
+		slog.String("search", search),
+		slog.Int("songs_count", count),
+	).Debug("Songs count was got successfully")
+
+	return count, nil
+}
+
+func (db *DBMemory) GetSongsPagination(ctx context.Context, query SongsQuery, logger *slog.Logger) ([]Song, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	songs := db.searchSongs(query.Search)
+
+	compare := func(a, b Song) int {
+		var res int
+		switch query.Sort {
+		case SortSongsByTitle:
+			res = strings.Compare(a.SongTitle, b.SongTitle)
+		case SortSongsByAddedAt:
+			res = cmp.Compare(a.AddedAt.Unix(), b.AddedAt.Unix())
+		}
+
+		if res == 0 {
+			res = cmp.Compare(a.SongId, b.SongId)
+		}
+
+		if query.Descending {
+			return -res
+		}
+		return res
+	}
+
+	slices.SortFunc(songs, compare)
+
+	start := (query.Page - 1) * query.Limit
+	if query.After != nil {
+		after := Song{
+			SongId:    query.After.SongId,
+			SongTitle: query.After.SongTitle,
+			AddedAt:   time.Unix(query.After.AddedAt, 0),
+		}
+
+		start = len(songs)
+		for i, song := range songs {
+			if compare(song, after) > 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	start = min(max(start, 0), len(songs))
+	end := min(start+query.fetchLimit(), len(songs))
+
+	logger.With(
+		slog.Int("page", query.Page),
+		slog.Int("limit", query.Limit),
+		slog.String("search", query.Search),
+	).Debug("Songs was paginated successfully")
+
+	return songs[start:end], nil
+}
+
+func (db *DBMemory) CheckSongByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, song := range db.songs {
+		if song.SongUrl == songUrl {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (db *DBMemory) GetSongIdByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for songId, song := range db.songs {
+		if song.SongUrl == songUrl {
+			return songId, nil
+		}
+	}
+
+	logger.With(slog.String("song_url", songUrl)).Debug("Song was not found")
+	return -1, ErrSongNotFound
+}
+
+func (db *DBMemory) GetSongById(ctx context.Context, songId int, logger *slog.Logger) (Song, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if _, found := db.songs[songId]; !found {
+		logger.With(slog.Int("song_id", songId)).Debug("Song was not found")
+		return Song{}, ErrSongNotFound
+	}
+
+	return db.song(songId), nil
+}
+
+func (db *DBMemory) SearchFingerprints(ctx context.Context, hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	matches := make(map[uint64][]Fingerprint, 0)
+	for _, hash := range hashes {
+		postings, found := db.postings[hash]
+		if found {
+			matches[hash] = slices.Clone(postings)
+		}
+	}
+
+	return capPostings(matches, db.search.MaxPostingsPerHash, logger), nil
+}
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+var ErrInvalidMigration = errors.New("invalid migration")
+
+type migration struct {
+	version int
+	name    string
+	// requires is the feature of the db build the migration needs, from a leading "-- requires: <feature>" line
+	requires   string
+	statements []string
+}
+
+type migrationDialect struct {
+	name                 string
+	tableExistsQuery     string
+	insertMigrationQuery string
+	// alreadyApplied reports the errors of statements whose changes are already in the schema,
+	// they are ignored only while baselining a db created before the migrations existed
+	alreadyApplied func(err error) bool
+	// supports reports whether the db build has the feature a migration requires,
+	// nil when the dialect has no optional features
+	supports func(ctx context.Context, db *sql.DB, feature string) (bool, error)
+}
+
+var sqliteMigrationDialect = migrationDialect{
+	name:                 "sqlite",
+	tableExistsQuery:     "SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = ?",
+	insertMigrationQuery: "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+	alreadyApplied: func(err error) bool {
+		msg := err.Error()
+		return strings.Contains(msg, "already exists") || strings.Contains(msg, "duplicate column name")
+	},
+	// the features are compile options, e.g. FTS5 is only compiled in with the sqlite_fts5 build tag
+	supports: func(ctx context.Context, db *sql.DB, feature string) (bool, error) {
+		var used bool
+		err := db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used(?)", feature).Scan(&used)
+		return used, err
+	},
+}
+
+var mysqlMigrationDialect = migrationDialect{
+	name:                 "mysql",
+	tableExistsQuery:     "SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+	insertMigrationQuery: "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+	alreadyApplied: func(err error) bool {
+		var mysqlErr *mysql.MySQLError
+		if !errors.As(err, &mysqlErr) {
+			return false
+		}
+
+		const tableExists, duplicateColumn, duplicateKey = 1050, 1060, 1061
+		return mysqlErr.Number == tableExists || mysqlErr.Number == duplicateColumn || mysqlErr.Number == duplicateKey
+	},
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+	Applied   bool
+	// Unsupported is set when the db build lacks the feature the pending migration requires
+	Unsupported bool
+	Requires    string
+	// Backend names the db of a sharded setup, e.g. "primary" or "shard 1", it is empty otherwise
+	Backend string
+}
+
+// loadMigrations reads the up migrations of the dialect ordered by version,
+// the files are named <version>_<name>.up.sql
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, found := strings.CutSuffix(fileName, ".up.sql")
+		if !found {
+			continue
+		}
+
+		rawVersion, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMigration, fileName)
+		}
+
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMigration, fileName)
+		}
+
+		content, err := fs.ReadFile(migrationsFS, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		requires := ""
+		firstLine, _, _ := strings.Cut(string(content), "\n")
+		if feature, found := strings.CutPrefix(strings.TrimSpace(firstLine), "-- requires:"); found {
+			requires = strings.TrimSpace(feature)
+		}
+
+		migrations = append(migrations, migration{
+			version:    version,
+			name:       name,
+			requires:   requires,
+			statements: splitStatements(string(content)),
+		})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int {
+		return a.version - b.version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i-1].version == migrations[i].version {
+			return nil, fmt.Errorf("%w: duplicate version %d", ErrInvalidMigration, migrations[i].version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// splitStatements splits on the semicolons which end a line,
+// so every statement can be executed on its own
+func splitStatements(content string) []string {
+	statements := make([]string, 0)
+	var current strings.Builder
+
+	for _, line := range strings.Split(content, "\n") {
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			statement := strings.TrimSpace(current.String())
+			statements = append(statements, statement)
+			current.Reset()
+		}
+	}
+
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+
+	return statements
+}
+
+func tableExists(ctx context.Context, db *sql.DB, dialect migrationDialect, table string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, dialect.tableExistsQuery, table).Scan(&count)
+	return count != 0, err
+}
+
+// runMigrations applies the pending migrations of the dialect in order
+func runMigrations(ctx context.Context, db *sql.DB, dialect migrationDialect, logger *slog.Logger) error {
+	logger = logger.With(slog.String("dialect", dialect.name))
+
+	migrations, err := loadMigrations(dialect.name)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while loading the migrations")
+		return err
+	}
+
+	trackingExists, err := tableExists(ctx, db, dialect, "schema_migrations")
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while checking for the schema migrations table")
+		return err
+	}
+
+	songsExists, err := tableExists(ctx, db, dialect, "songs")
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while checking for the songs table")
+		return err
+	}
+
+	// the db was set up before the migrations existed and may already have some of their changes
+	baselining := !trackingExists && songsExists
+	if baselining {
+		logger.Info("Baselining a db created before the schema migrations")
+	}
+
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at BIGINT NOT NULL
+)`)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while initing the schema migrations table")
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while getting the applied migrations")
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, found := applied[migration.version]; found {
+			continue
+		}
+
+		supported, err := migrationSupported(ctx, db, dialect, migration)
+		if err != nil {
+			logger.With(
+				slog.Int("version", migration.version),
+				slog.String("requires", migration.requires),
+				slog.String("err", err.Error()),
+			).Error("Error while checking the requirement of a migration")
+			return err
+		}
+
+		// it stays pending and is applied by a build with the feature
+		if !supported {
+			logger.With(
+				slog.Int("version", migration.version),
+				slog.String("name", migration.name),
+				slog.String("requires", migration.requires),
+			).Warn("Migration is skipped, the db build lacks the feature it requires")
+			continue
+		}
+
+		err = applyMigration(ctx, db, dialect, migration, baselining)
+		if err != nil {
+			logger.With(
+				slog.Int("version", migration.version),
+				slog.String("name", migration.name),
+				slog.String("err", err.Error()),
+			).Error("Error while applying a migration")
+			return err
+		}
+
+		logger.With(
+			slog.Int("version", migration.version),
+			slog.String("name", migration.name),
+		).Info("Migration was applied successfully")
+	}
+
+	return nil
+}
+
+func migrationSupported(ctx context.Context, db *sql.DB, dialect migrationDialect, migration migration) (bool, error) {
+	if migration.requires == "" || dialect.supports == nil {
+		return true, nil
+	}
+	return dialect.supports(ctx, db, migration.requires)
+}
+
+// applyMigration runs the migration in a transaction,
+// MySQL commits every DDL statement implicitly so there a failed migration can be partially applied
+func applyMigration(ctx context.Context, db *sql.DB, dialect migrationDialect, migration migration, baselining bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range migration.statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil && !(baselining && dialect.alreadyApplied(err)) {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, dialect.insertMigrationQuery, migration.version, migration.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+
+	return applied, rows.Err()
+}
+
+// migrationsStatus lists every known migration and whether it is applied
+func migrationsStatus(ctx context.Context, db *sql.DB, dialect migrationDialect, logger *slog.Logger) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(dialect.name)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while loading the migrations")
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	trackingExists, err := tableExists(ctx, db, dialect, "schema_migrations")
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while checking for the schema migrations table")
+		return nil, err
+	}
+
+	if trackingExists {
+		applied, err = appliedMigrations(ctx, db)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Error("Error while getting the applied migrations")
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		appliedAt, found := applied[migration.version]
+		statuses[i] = MigrationStatus{
+			Version:   migration.version,
+			Name:      migration.name,
+			AppliedAt: appliedAt,
+			Applied:   found,
+			Requires:  migration.requires,
+		}
+
+		if !found {
+			supported, err := migrationSupported(ctx, db, dialect, migration)
+			if err != nil {
+				logger.With(slog.String("err", err.Error())).Error("Error while checking the requirement of a migration")
+				return nil, err
+			}
+			statuses[i].Unsupported = !supported
+		}
+	}
+
+	return statuses, nil
+}
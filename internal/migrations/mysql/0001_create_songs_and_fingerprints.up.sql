@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS songs (
+    song_id INTEGER PRIMARY KEY AUTO_INCREMENT,
+    song_title VARCHAR(512),
+    song_url VARCHAR(512)
+);
+
+CREATE UNIQUE INDEX songs_song_url_index ON songs(song_url);
+
+CREATE TABLE IF NOT EXISTS fingerprints (
+    fingerprint_id INTEGER PRIMARY KEY AUTO_INCREMENT,
+    hash_key BIGINT NOT NULL,
+    song_id INTEGER NOT NULL,
+    song_timestamp BIGINT NOT NULL,
+    FOREIGN KEY(song_id) REFERENCES songs(song_id)
+);
+
+CREATE INDEX fingerprints_hash_key_index ON fingerprints(hash_key);
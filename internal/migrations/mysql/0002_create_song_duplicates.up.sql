@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS song_duplicates (
+    song_id INTEGER PRIMARY KEY,
+    duplicate_of INTEGER NOT NULL,
+    similarity DOUBLE NOT NULL,
+    FOREIGN KEY(song_id) REFERENCES songs(song_id),
+    FOREIGN KEY(duplicate_of) REFERENCES songs(song_id)
+);
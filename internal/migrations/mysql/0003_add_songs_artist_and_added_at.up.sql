@@ -0,0 +1,5 @@
+ALTER TABLE songs ADD COLUMN song_artist VARCHAR(512) NOT NULL DEFAULT '';
+
+ALTER TABLE songs ADD COLUMN added_at BIGINT NOT NULL DEFAULT 0;
+
+CREATE FULLTEXT INDEX songs_fulltext_index ON songs(song_title, song_artist);
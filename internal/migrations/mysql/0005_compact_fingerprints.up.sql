@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS fingerprints_compact (
+    hash_key BIGINT NOT NULL,
+    song_id INTEGER NOT NULL,
+    song_timestamp INTEGER UNSIGNED NOT NULL,
+    PRIMARY KEY (hash_key, song_id),
+    INDEX fingerprints_song_id_index (song_id),
+    FOREIGN KEY(song_id) REFERENCES songs(song_id)
+);
+
+INSERT IGNORE INTO fingerprints_compact (hash_key, song_id, song_timestamp)
+    SELECT hash_key, song_id, song_timestamp FROM fingerprints;
+
+DROP TABLE fingerprints;
+
+RENAME TABLE fingerprints_compact TO fingerprints;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS hash_stats (
+    hash_key BIGINT PRIMARY KEY,
+    song_count INTEGER NOT NULL
+);
+
+INSERT IGNORE INTO hash_stats (hash_key, song_count)
+    SELECT hash_key, COUNT(1) FROM fingerprints GROUP BY hash_key;
@@ -0,0 +1,16 @@
+-- the fingerprints of a sharded db live on other dbs than their songs,
+-- the name of the generated constraint is looked up, because 0005 created it under another table name
+SET @drop_fingerprints_fk = (
+    SELECT CONCAT('ALTER TABLE fingerprints DROP FOREIGN KEY ', constraint_name)
+    FROM information_schema.referential_constraints
+    WHERE constraint_schema = DATABASE() AND table_name = 'fingerprints' AND referenced_table_name = 'songs'
+    LIMIT 1
+);
+
+SET @drop_fingerprints_fk = COALESCE(@drop_fingerprints_fk, 'DO 0');
+
+PREPARE drop_fingerprints_fk FROM @drop_fingerprints_fk;
+
+EXECUTE drop_fingerprints_fk;
+
+DEALLOCATE PREPARE drop_fingerprints_fk;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS songs (
+    song_id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    song_title TEXT,
+    song_url TEXT
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS songs_song_url_index ON songs(song_url);
+
+CREATE TABLE IF NOT EXISTS fingerprints (
+    fingerprint_id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    hash_key BIGINT NOT NULL,
+    song_id INTEGER NOT NULL REFERENCES songs(song_id),
+    song_timestamp BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fingerprints_hash_key_index ON fingerprints(hash_key);
+
+CREATE INDEX IF NOT EXISTS fingerprints_song_id_index ON fingerprints(song_id);
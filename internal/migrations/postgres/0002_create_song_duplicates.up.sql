@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS song_duplicates (
+    song_id INTEGER PRIMARY KEY REFERENCES songs(song_id),
+    duplicate_of INTEGER NOT NULL REFERENCES songs(song_id),
+    similarity DOUBLE PRECISION NOT NULL
+);
@@ -0,0 +1,6 @@
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS song_artist TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS added_at BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS songs_fulltext_index ON songs
+    USING GIN (to_tsvector('simple', coalesce(song_title, '') || ' ' || song_artist));
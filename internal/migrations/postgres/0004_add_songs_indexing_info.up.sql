@@ -0,0 +1,3 @@
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS fingerprint_version INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE songs ADD COLUMN IF NOT EXISTS indexed_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS fingerprints_compact (
+    hash_key BIGINT NOT NULL,
+    song_id INTEGER NOT NULL REFERENCES songs(song_id),
+    song_timestamp INTEGER NOT NULL,
+    PRIMARY KEY (hash_key, song_id)
+);
+
+INSERT INTO fingerprints_compact (hash_key, song_id, song_timestamp)
+    SELECT hash_key, song_id, song_timestamp FROM fingerprints
+    ON CONFLICT DO NOTHING;
+
+DROP TABLE fingerprints;
+
+ALTER TABLE fingerprints_compact RENAME TO fingerprints;
+
+ALTER INDEX fingerprints_compact_pkey RENAME TO fingerprints_pkey;
+
+CREATE INDEX IF NOT EXISTS fingerprints_song_id_index ON fingerprints(song_id);
+
+CLUSTER fingerprints USING fingerprints_pkey;
@@ -0,0 +1,4 @@
+-- the fingerprints of a sharded db live on other dbs than their songs
+ALTER TABLE fingerprints DROP CONSTRAINT IF EXISTS fingerprints_compact_song_id_fkey;
+
+ALTER TABLE fingerprints DROP CONSTRAINT IF EXISTS fingerprints_song_id_fkey;
@@ -4,7 +4,7 @@ CREATE TABLE IF NOT EXISTS songs (
     song_url TEXT
 );
 
-CREATE  UNIQUE INDEX IF NOT EXISTS songs_song_url ON songs(song_url);
+CREATE UNIQUE INDEX IF NOT EXISTS songs_song_url ON songs(song_url);
 
 CREATE TABLE IF NOT EXISTS fingerprints (
     fingerprint_id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -14,4 +14,4 @@ CREATE TABLE IF NOT EXISTS fingerprints (
     FOREIGN KEY(song_id) REFERENCES songs(song_id)
 );
 
-CREATE INDEX IF NOT EXISTS fingerprints_hash_key ON fingerprints(hash_key);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS fingerprints_hash_key ON fingerprints(hash_key);
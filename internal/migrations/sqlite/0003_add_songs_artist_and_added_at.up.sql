@@ -0,0 +1,3 @@
+ALTER TABLE songs ADD COLUMN song_artist TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE songs ADD COLUMN added_at INTEGER NOT NULL DEFAULT 0;
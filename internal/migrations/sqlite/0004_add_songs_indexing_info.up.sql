@@ -0,0 +1,3 @@
+ALTER TABLE songs ADD COLUMN fingerprint_version INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE songs ADD COLUMN indexed_at INTEGER NOT NULL DEFAULT 0;
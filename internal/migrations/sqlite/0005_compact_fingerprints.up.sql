@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS fingerprints_compact (
+    hash_key INTEGER NOT NULL,
+    song_id INTEGER NOT NULL,
+    song_timestamp INTEGER NOT NULL,
+    PRIMARY KEY (hash_key, song_id),
+    FOREIGN KEY(song_id) REFERENCES songs(song_id)
+) WITHOUT ROWID;
+
+INSERT OR IGNORE INTO fingerprints_compact (hash_key, song_id, song_timestamp)
+    SELECT hash_key, CAST(song_id AS INTEGER), song_timestamp FROM fingerprints;
+
+DROP TABLE fingerprints;
+
+ALTER TABLE fingerprints_compact RENAME TO fingerprints;
+
+CREATE INDEX IF NOT EXISTS fingerprints_song_id ON fingerprints(song_id);
@@ -0,0 +1,15 @@
+-- requires: ENABLE_FTS5
+CREATE VIRTUAL TABLE IF NOT EXISTS songs_fts USING fts5(
+    song_title,
+    song_artist,
+    content='songs',
+    content_rowid='song_id'
+);
+
+CREATE TRIGGER IF NOT EXISTS songs_fts_insert AFTER INSERT ON songs BEGIN INSERT INTO songs_fts(rowid, song_title, song_artist) VALUES (new.song_id, new.song_title, new.song_artist); END;
+
+CREATE TRIGGER IF NOT EXISTS songs_fts_delete AFTER DELETE ON songs BEGIN INSERT INTO songs_fts(songs_fts, rowid, song_title, song_artist) VALUES ('delete', old.song_id, old.song_title, old.song_artist); END;
+
+CREATE TRIGGER IF NOT EXISTS songs_fts_update AFTER UPDATE ON songs BEGIN INSERT INTO songs_fts(songs_fts, rowid, song_title, song_artist) VALUES ('delete', old.song_id, old.song_title, old.song_artist); INSERT INTO songs_fts(rowid, song_title, song_artist) VALUES (new.song_id, new.song_title, new.song_artist); END;
+
+INSERT INTO songs_fts(songs_fts) VALUES ('rebuild');
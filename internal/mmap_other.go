@@ -0,0 +1,21 @@
+//go:build !unix
+
+package internal
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the whole file, the platforms without mmap pay for it with memory
+func mapFile(file *os.File, size int) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(file, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error {
+		return nil
+	}, nil
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole file read only, the mapping outlives the closed file
+func mapFile(file *os.File, size int) ([]byte, func() error, error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error {
+		return syscall.Munmap(data)
+	}, nil
+}
@@ -1,189 +1,622 @@
 package internal
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/go-sql-driver/mysql"
 )
 
+var ErrInvalidMySqlTLS = errors.New("invalid mysql tls mode")
+
 type DBSMySql struct {
-	db *sql.DB
+	db     *sql.DB
+	search SearchOptions
 }
 
-type DBMySqlConnectionOption struct {
-	Host     string
-	Port     string
-	Username string
-	Password string
-	DBName   string
+// MySqlOptions tune the driver and the connection pool,
+// RDS closes the idle connections, so they are recycled before it does
+type MySqlOptions struct {
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"MYSQL_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"MYSQL_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"MYSQL_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"MYSQL_CONN_MAX_IDLE_TIME"`
+	DialTimeout     time.Duration `yaml:"dial_timeout" env:"MYSQL_DIAL_TIMEOUT"`
+	// ReadTimeout applies to every query, the migrations included, 0 leaves the queries to the stage timeouts
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"MYSQL_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"MYSQL_WRITE_TIMEOUT"`
+	// TLS is false, true, skip-verify or preferred, with true the server certificate is verified
+	// against TLSCAPath when it is set, the other modes don`t take a CA
+	TLS       string `yaml:"tls" env:"MYSQL_TLS"`
+	TLSCAPath string `yaml:"tls_ca" env:"MYSQL_TLS_CA"`
+	// InterpolateParams builds the queries on the client, which saves the prepare round trip
+	InterpolateParams bool `yaml:"interpolate_params" env:"MYSQL_INTERPOLATE_PARAMS"`
+	ParseTime         bool `yaml:"parse_time" env:"MYSQL_PARSE_TIME"`
+	// ConnectRetries is how many times the startup ping is retried, the delay doubles after every attempt
+	ConnectRetries    int           `yaml:"connect_retries" env:"MYSQL_CONNECT_RETRIES"`
+	ConnectRetryDelay time.Duration `yaml:"connect_retry_delay" env:"MYSQL_CONNECT_RETRY_DELAY"`
 }
 
-func NewDBMysql(options DBMySqlConnectionOption, logger *slog.Logger) (DB, error) {
+func DefaultMySqlOptions() MySqlOptions {
+	return MySqlOptions{
+		MaxOpenConns:      20,
+		MaxIdleConns:      10,
+		ConnMaxLifetime:   5 * time.Minute,
+		ConnMaxIdleTime:   time.Minute,
+		DialTimeout:       5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		TLS:               "false",
+		InterpolateParams: true,
+		ParseTime:         true,
+		ConnectRetries:    5,
+		ConnectRetryDelay: time.Second,
+	}
+}
+
+func NewDBMysql(options DBConnectionOptions, mysqlOptions MySqlOptions, search SearchOptions, logger *slog.Logger) (DB, error) {
 	loggerNew := logger.With(slog.String("db_host", options.Host), slog.String("db_name", options.DBName))
 
-	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", options.Username, options.Password, options.Host, options.Port, options.DBName)
-	db, err := sql.Open("mysql", connectionString)
+	config, err := mysqlConfig(options, mysqlOptions)
+	if err != nil {
+		loggerNew.With(slog.String("err", err.Error())).Error("Error while building the connection config")
+		return nil, err
+	}
 
+	connector, err := mysql.NewConnector(config)
 	if err != nil {
 		loggerNew.With(slog.String("err", err.Error())).Error("Error while creating a db")
 		return nil, err
 	}
 
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(mysqlOptions.MaxOpenConns)
+	db.SetMaxIdleConns(mysqlOptions.MaxIdleConns)
+	db.SetConnMaxLifetime(mysqlOptions.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(mysqlOptions.ConnMaxIdleTime)
+
+	err = pingWithRetry(db, mysqlOptions.ConnectRetries, mysqlOptions.ConnectRetryDelay, mysqlOptions.DialTimeout, loggerNew)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	loggerNew.Info("DB is created successfully")
 	return &DBSMySql{
-		db: db,
+		db:     db,
+		search: search,
 	}, nil
 }
 
-func (db *DBSMySql) SetupDB(logger *slog.Logger) error {
-	_, err := db.db.Exec(`CREATE TABLE IF NOT EXISTS songs (
-    song_id INTEGER PRIMARY KEY AUTO_INCREMENT,
-    song_title VARCHAR(512),
-    song_url VARCHAR(512)
-	);`)
+func mysqlConfig(options DBConnectionOptions, mysqlOptions MySqlOptions) (*mysql.Config, error) {
+	config := mysql.NewConfig()
+	config.User = options.Username
+	config.Passwd = options.Password
+	config.Net = "tcp"
+	config.Addr = net.JoinHostPort(options.Host, options.Port)
+	config.DBName = options.DBName
+	config.Timeout = mysqlOptions.DialTimeout
+	config.ReadTimeout = mysqlOptions.ReadTimeout
+	config.WriteTimeout = mysqlOptions.WriteTimeout
+	config.InterpolateParams = mysqlOptions.InterpolateParams
+	config.ParseTime = mysqlOptions.ParseTime
+
+	switch mysqlOptions.TLS {
+	case "", "false":
+	case "true", "skip-verify", "preferred":
+		config.TLSConfig = mysqlOptions.TLS
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMySqlTLS, mysqlOptions.TLS)
+	}
+
+	if mysqlOptions.TLSCAPath != "" {
+		// the CA replaces the mode, so it would turn false and preferred into a verified TLS
+		if mysqlOptions.TLS != "true" {
+			return nil, fmt.Errorf("%w: tls_ca needs tls true, got %q", ErrInvalidMySqlTLS, mysqlOptions.TLS)
+		}
+
+		ca, err := os.ReadFile(mysqlOptions.TLSCAPath)
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: no certificates in %s", ErrInvalidMySqlTLS, mysqlOptions.TLSCAPath)
+		}
+
+		config.TLS = &tls.Config{
+			RootCAs:    rootCAs,
+			ServerName: options.Host,
+		}
+	}
+
+	return config, nil
+}
+
+// pingWithRetry waits for the db at startup, e.g. when it starts together with the server
+func pingWithRetry(db *sql.DB, retries int, delay time.Duration, timeout time.Duration, logger *slog.Logger) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := WithStageTimeout(context.Background(), timeout)
+		err = db.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= retries {
+			break
+		}
+
+		logger.With(
+			slog.Int("attempt", attempt+1),
+			slog.Duration("retry_in", delay),
+			slog.String("err", err.Error()),
+		).Warn("Error while pinging the db, retrying")
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	logger.With(
+		slog.Int("attempts", retries+1),
+		slog.String("err", err.Error()),
+	).Error("DB is unreachable")
+	return err
+}
+
+// SetupDB applies the pending schema migrations
+func (db *DBSMySql) SetupDB(ctx context.Context, logger *slog.Logger) error {
+	err := runMigrations(ctx, db.db, mysqlMigrationDialect, logger)
 
 	if err != nil {
 		logger.With(
 			slog.String("err", err.Error()),
-		).Error("Error while initing the songs table")
+		).Error("Error while setuping the db")
 		return err
 	}
 
-	_, err = db.db.Exec(`CREATE TABLE IF NOT EXISTS fingerprints (
-    fingerprint_id INTEGER PRIMARY KEY AUTO_INCREMENT,
-    hash_key BIGINT NOT NULL,
-    song_id INTEGER NOT NULL,
-    song_timestamp BIGINT NOT NULL,
-    FOREIGN KEY(song_id) REFERENCES songs(song_id)
-	);`)
+	logger.Info("Db setup successfully")
+
+	return err
+}
+
+func (db *DBSMySql) MigrationsStatus(ctx context.Context, logger *slog.Logger) ([]MigrationStatus, error) {
+	return migrationsStatus(ctx, db.db, mysqlMigrationDialect, logger)
+}
+
+func (db *DBSMySql) Ping(ctx context.Context, logger *slog.Logger) error {
+	err := db.db.PingContext(ctx)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while pinging the db")
+	}
+	return err
+}
+
+func (db *DBSMySql) searchCondition(search string) (string, []any) {
+	terms := searchTerms(search)
+	if len(terms) == 0 {
+		return "", nil
+	}
+
+	// every term is required and matched as a prefix
+	for i, term := range terms {
+		terms[i] = "+" + term + "*"
+	}
+
+	return "MATCH(song_title, song_artist) AGAINST (? IN BOOLEAN MODE)", []any{strings.Join(terms, " ")}
+}
+
+func (db *DBSMySql) InsertSong(ctx context.Context, songTitle string, songArtist string, songUrl string, logger *slog.Logger) (int, error) {
+	res, err := db.db.ExecContext(ctx, "INSERT INTO songs (song_title, song_artist, song_url, added_at) VALUES (?, ?, ?, ?)",
+		songTitle, songArtist, songUrl, time.Now().Unix())
+
+	if err != nil {
+		logger.With(
+			slog.String("song_title", songTitle),
+			slog.String("song_url", songUrl),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting a song")
+		return -1, err
+	}
+
+	songId, err := res.LastInsertId()
 
 	if err != nil {
 		logger.With(
+			slog.String("song_title", songTitle),
+			slog.String("song_url", songUrl),
 			slog.String("err", err.Error()),
-		).Error("Error while initing the fingerprints table")
+		).Warn("Error while inserting a song")
+		return -1, err
+	}
+
+	logger.With(
+		slog.Int("song_id", int(songId)),
+		slog.String("song_title", songTitle),
+	).Debug("Song was inserted successfully")
+
+	return int(songId), nil
+}
+
+// InsertFingerprints inserts the fingerprints in batches of multi row inserts
+func (db *DBSMySql) InsertFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting fingerprints")
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertFingerprintsMySql(ctx, tx, songId, fingerprints, logger)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting fingerprints")
+		return err
+	}
+
+	logger.With(
+		slog.Int("song_id", songId),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Fingerprints were inserted successfully")
+
+	return nil
+}
+
+// insertFingerprintsMySql inserts the fingerprints and counts them in the hash stats in the transaction
+func insertFingerprintsMySql(ctx context.Context, tx *sql.Tx, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	const batchSize = 1000
+
+	values := make([]string, 0, batchSize)
+	args := make([]any, 0, 3*batchSize)
+	var err error
+
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+
+		query := "INSERT INTO fingerprints (hash_key, song_id, song_timestamp) VALUES " + strings.Join(values, ", ")
+		_, err := tx.ExecContext(ctx, query, args...)
+
+		values = values[:0]
+		args = args[:0]
 		return err
 	}
 
-	var existsSongsSongUrlIndex int
-	checkSongsSongUrlIndexQuery := `
-			SELECT COUNT(1)
-			FROM information_schema.statistics
-			WHERE table_schema = DATABASE()
-			  AND table_name = "songs"
-			  AND index_name = "songs_song_url_index"`
+	for hash, timestamp := range fingerprints {
+		values = append(values, "(?, ?, ?)")
+		args = append(args, hash, songId, timestamp)
+
+		if len(values) == batchSize {
+			err = flush()
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err == nil {
+		err = flush()
+	}
 
-	err = db.db.QueryRow(checkSongsSongUrlIndexQuery).Scan(&existsSongsSongUrlIndex)
 	if err != nil {
 		logger.With(
+			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
-		).Error("Error while checking for song url unique index")
+		).Warn("Error while inserting fingerprints")
 		return err
 	}
 
-	if existsSongsSongUrlIndex == 0 {
-		createSongsUrlIndexQuery := "CREATE UNIQUE INDEX songs_song_url_index ON songs(song_url)"
-		_, err = db.db.Exec(createSongsUrlIndexQuery)
+	_, err = tx.ExecContext(ctx, addHashStatsMySql, songId)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while updating the hash stats")
+		return err
+	}
+
+	return nil
+}
+
+func (db *DBSMySql) InsertSongDuplicate(ctx context.Context, songId int, duplicateOf int, similarity float64, logger *slog.Logger) error {
+	_, err := db.db.ExecContext(ctx, "INSERT INTO song_duplicates (song_id, duplicate_of, similarity) VALUES (?, ?, ?)",
+		songId, duplicateOf, similarity)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.Int("duplicate_of", duplicateOf),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting a song duplicate")
+		return err
+	}
+
+	return nil
+}
+
+func (db *DBSMySql) DeleteSong(ctx context.Context, songId int, logger *slog.Logger) (int, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	promotedId, err := promoteDuplicateTx(ctx, tx, songId)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while promoting a duplicate of the deleted song")
+		return -1, err
+	}
+
+	// the fingerprints of a song with a promoted duplicate were moved, so these don`t change them
+	queries := []string{
+		releaseHashStats,
+		deleteEmptyHashStats,
+		"DELETE FROM fingerprints WHERE song_id = ?",
+		"DELETE FROM song_duplicates WHERE song_id = ?",
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query, songId)
 		if err != nil {
 			logger.With(
+				slog.Int("song_id", songId),
 				slog.String("err", err.Error()),
-			).Error("Error while initting the song url unique index")
-			return err
+			).Warn("Error while deleting a song")
+			return -1, err
 		}
 	}
 
-	var existsFingerprintsHashKeyIndex int
-	checkFingerprintsHashKeyIndexQuery := `
-			SELECT COUNT(1)
-			FROM information_schema.statistics
-			WHERE table_schema = DATABASE()
-			  AND table_name = "fingerprints"
-			  AND index_name = "fingerprints_hash_key_index"`
+	res, err := tx.ExecContext(ctx, "DELETE FROM songs WHERE song_id = ?", songId)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
 
-	err = db.db.QueryRow(checkFingerprintsHashKeyIndexQuery).Scan(&existsFingerprintsHashKeyIndex)
+	deleted, err := res.RowsAffected()
 	if err != nil {
 		logger.With(
+			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
-		).Error("Error while checking for fingerprints hash key index")
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+
+	if deleted == 0 {
+		logger.With(slog.Int("song_id", songId)).Debug("Song was not found")
+		return -1, ErrSongNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+
+	logger.With(slog.Int("song_id", songId), slog.Int("promoted_song_id", promotedId)).Debug("Song was deleted successfully")
+
+	return promotedId, nil
+}
+
+func (db *DBSMySql) DeleteFingerprints(ctx context.Context, songId int, logger *slog.Logger) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting fingerprints")
 		return err
 	}
+	defer tx.Rollback()
 
-	if existsFingerprintsHashKeyIndex == 0 {
-		createFingerprintsHashKeyIndexQuery := "CREATE INDEX fingerprints_hash_key_index ON fingerprints(hash_key)"
-		_, err = db.db.Exec(createFingerprintsHashKeyIndexQuery)
+	queries := []string{
+		releaseHashStats,
+		deleteEmptyHashStats,
+		"DELETE FROM fingerprints WHERE song_id = ?",
+		"DELETE FROM song_duplicates WHERE song_id = ?",
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query, songId)
 		if err != nil {
 			logger.With(
+				slog.Int("song_id", songId),
 				slog.String("err", err.Error()),
-			).Error("Error while initting the fingerprints hash key index")
+			).Warn("Error while deleting fingerprints")
 			return err
 		}
 	}
 
-	logger.Info("Db setup successfully")
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting fingerprints")
+		return err
+	}
 
-	return err
+	logger.With(slog.Int("song_id", songId)).Debug("Fingerprints were deleted successfully")
+
+	return nil
 }
 
-func (db *DBSMySql) InsertSong(songTitle string, songUrl string, logger *slog.Logger) (int, error) {
-	res, err := db.db.Exec("INSERT INTO songs (song_title, song_url) VALUES (?, ?)",
-		songTitle, songUrl)
+func (db *DBSMySql) ReplaceFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, duplicateOf int, similarity float64, fingerprintVersion int, logger *slog.Logger) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while replacing fingerprints")
+		return err
+	}
+	defer tx.Rollback()
 
+	err = execStatementsTx(ctx, tx, replaceFingerprintsStatements(songId, duplicateOf, similarity, fingerprintVersion))
 	if err != nil {
 		logger.With(
-			slog.String("song_title", songTitle),
-			slog.String("song_url", songUrl),
+			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
-		).Warn("Error while inserting a song")
-		return -1, err
+		).Warn("Error while replacing fingerprints")
+		return err
 	}
 
-	songId, err := res.LastInsertId()
+	if duplicateOf == -1 {
+		err = insertFingerprintsMySql(ctx, tx, songId, fingerprints, logger)
+		if err != nil {
+			return err
+		}
+	}
 
+	err = tx.Commit()
 	if err != nil {
 		logger.With(
-			slog.String("song_title", songTitle),
-			slog.String("song_url", songUrl),
+			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
-		).Warn("Error while inserting a song")
-		return -1, err
+		).Warn("Error while replacing fingerprints")
+		return err
 	}
 
 	logger.With(
-		slog.Int("song_id", int(songId)),
-		slog.String("song_title", songTitle),
-	).Debug("Song was inserted successfully")
+		slog.Int("song_id", songId),
+		slog.Int("duplicate_of", duplicateOf),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Fingerprints were replaced successfully")
 
-	return int(songId), nil
+	return nil
 }
 
-func (db *DBSMySql) InsertFingerprint(hash uint64, songId int, timestamp uint32, logger *slog.Logger) error {
-	_, err := db.db.Exec("INSERT INTO fingerprints (hash_key, song_id, song_timestamp) VALUES (?, ?, ?)",
-		hash, songId, timestamp)
+func (db *DBSMySql) SetSongIndexed(ctx context.Context, songId int, fingerprintVersion int, logger *slog.Logger) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE songs SET fingerprint_version = ?, indexed_at = ? WHERE song_id = ?",
+		fingerprintVersion, time.Now().Unix(), songId)
 
 	if err != nil {
 		logger.With(
-			slog.String("hash", fmt.Sprintf("%x", hash)),
 			slog.Int("song_id", songId),
+			slog.Int("fingerprint_version", fingerprintVersion),
 			slog.String("err", err.Error()),
-		).Warn("Error while inserting a fingerprint")
+		).Warn("Error while marking a song as indexed")
 		return err
 	}
 
-	// logger.With(
-	// 	slog.String("hash", fmt.Sprintf("%x", hash)),
-	// 	slog.Int("song_id", songId),
-	// ).Debug("FIngerprint was inserted successfully")
+	return nil
+}
+
+// SetSongAddedAt keeps the time a song was added in another db, e.g. by an import
+func (db *DBSMySql) SetSongAddedAt(ctx context.Context, songId int, addedAt time.Time, logger *slog.Logger) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE songs SET added_at = ? WHERE song_id = ?", addedAt.Unix(), songId)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while setting the added time of a song")
+		return err
+	}
 
 	return nil
 }
 
-func (db *DBSMySql) GetSongsCount(logger *slog.Logger) (int, error) {
-	row := db.db.QueryRow("SELECT COUNT(song_id) FROM songs")
+func (db *DBSMySql) GetSongStats(ctx context.Context, songId int, logger *slog.Logger) (SongStats, error) {
+	var stats SongStats
+	row := db.db.QueryRowContext(ctx, `SELECT COUNT(1), COALESCE(MIN(song_timestamp), 0), COALESCE(MAX(song_timestamp), 0)
+		FROM fingerprints WHERE song_id = ?`, songId)
+
+	err := row.Scan(&stats.FingerprintsCount, &stats.FirstTimestamp, &stats.LastTimestamp)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while getting song stats")
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func (db *DBSMySql) GetSongFingerprints(ctx context.Context, songId int, logger *slog.Logger) (map[uint64]uint32, error) {
+	return getSongFingerprints(ctx, db.db, songId, logger)
+}
+
+// GetStorageStats is the InnoDB estimate, the data of a table is its clustered primary key
+func (db *DBSMySql) GetStorageStats(ctx context.Context, logger *slog.Logger) ([]TableStorage, error) {
+	stats := make([]TableStorage, len(storageTables))
+	for i, table := range storageTables {
+		stats[i] = TableStorage{Table: table}
+
+		err := db.db.QueryRowContext(ctx, `SELECT COALESCE(TABLE_ROWS, 0), COALESCE(DATA_LENGTH, 0), COALESCE(INDEX_LENGTH, 0)
+			FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`, table).
+			Scan(&stats[i].Rows, &stats[i].DataBytes, &stats[i].IndexBytes)
+		if err != nil {
+			logger.With(slog.String("table", table), slog.String("err", err.Error())).Warn("Error while getting the size of a table")
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// GetFingerprintsCount is the InnoDB estimate, counting the rows of the table is too slow
+func (db *DBSMySql) GetFingerprintsCount(ctx context.Context, logger *slog.Logger) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, `SELECT COALESCE(TABLE_ROWS, 0) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = 'fingerprints'`).Scan(&count)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while getting the fingerprints count")
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (db *DBSMySql) GetSongsCount(ctx context.Context, search string, logger *slog.Logger) (int, error) {
+	query := "SELECT COUNT(song_id) FROM songs"
+	condition, args := db.searchCondition(search)
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+
+	row := db.db.QueryRowContext(ctx, query, args...)
 
 	err := row.Err()
 	if err != nil {
 		logger.With(
+			slog.String("search", search),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs count")
 		return 0, err
@@ -194,39 +627,48 @@ func (db *DBSMySql) GetSongsCount(logger *slog.Logger) (int, error) {
 
 	if err != nil {
 		logger.With(
+			slog.String("search", search),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs count")
 		return 0, err
 	}
 
 	logger.With(
+		slog.String("search", search),
 		slog.Int("songs_count", count),
 	).Debug("Songs count was got successfully")
 
 	return count, nil
 }
 
-func (db *DBSMySql) GetSongsPagination(page int, limit int, logger *slog.Logger) ([]Song, error) {
-	rows, err := db.db.Query("SELECT song_id, song_title, song_url FROM songs LIMIT ? OFFSET ?", limit, (page-1)*limit)
+func (db *DBSMySql) GetSongsPagination(ctx context.Context, query SongsQuery, logger *slog.Logger) ([]Song, error) {
+	logger = logger.With(
+		slog.Int("page", query.Page),
+		slog.Int("limit", query.Limit),
+		slog.String("search", query.Search),
+		slog.String("sort", string(query.Sort)),
+		slog.Bool("descending", query.Descending),
+	)
+
+	condition, searchArgs := db.searchCondition(query.Search)
+	sqlQuery, args := buildSongsQuery(query, condition, searchArgs)
+
+	rows, err := db.db.QueryContext(ctx, sqlQuery, args...)
 
 	if err != nil {
 		logger.With(
-			slog.Int("page", page),
-			slog.Int("limit", limit),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs with pagination")
 		return nil, err
 	}
+	defer rows.Close()
 
 	songs := make([]Song, 0)
 	for rows.Next() {
-		var song Song
-		err := rows.Scan(&song.SongId, &song.SongTitle, &song.SongUrl)
+		song, err := scanSong(rows)
 
 		if err != nil {
 			logger.With(
-				slog.Int("page", page),
-				slog.Int("limit", limit),
 				slog.String("err", err.Error()),
 			).Warn("Error while getting songs with pagination")
 			return nil, err
@@ -236,23 +678,18 @@ func (db *DBSMySql) GetSongsPagination(page int, limit int, logger *slog.Logger)
 
 	if err := rows.Err(); err != nil {
 		logger.With(
-			slog.Int("page", page),
-			slog.Int("limit", limit),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs with pagination")
 		return nil, err
 	}
 
-	logger.With(
-		slog.Int("page", page),
-		slog.Int("limit", limit),
-	).Debug("Songs was paginated successfully")
+	logger.Debug("Songs was paginated successfully")
 
 	return songs, nil
 }
 
-func (db *DBSMySql) CheckSongByUrl(songUrl string, logger *slog.Logger) (bool, error) {
-	row := db.db.QueryRow("SELECT 1 FROM songs WHERE song_url = ?", songUrl)
+func (db *DBSMySql) CheckSongByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (bool, error) {
+	row := db.db.QueryRowContext(ctx, "SELECT 1 FROM songs WHERE song_url = ?", songUrl)
 
 	err := row.Err()
 	if err != nil {
@@ -273,9 +710,29 @@ func (db *DBSMySql) CheckSongByUrl(songUrl string, logger *slog.Logger) (bool, e
 	return found, nil
 }
 
-func (db *DBSMySql) GetSongById(songId int, logger *slog.Logger) (Song, error) {
-	var song Song
-	row := db.db.QueryRow("SELECT song_id, song_title, song_url FROM songs WHERE song_id = ?", songId)
+func (db *DBSMySql) GetSongIdByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (int, error) {
+	var songId int
+	err := db.db.QueryRowContext(ctx, "SELECT song_id FROM songs WHERE song_url = ?", songUrl).Scan(&songId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.With(slog.String("song_url", songUrl)).Debug("Song was not found")
+		return -1, ErrSongNotFound
+	}
+
+	if err != nil {
+		logger.With(
+			slog.String("song_url", songUrl),
+			slog.String("err", err.Error()),
+		).Warn("Error while getting a song_id by song_url")
+		return -1, err
+	}
+
+	return songId, nil
+}
+
+func (db *DBSMySql) GetSongById(ctx context.Context, songId int, logger *slog.Logger) (Song, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+songColumns+` FROM songs
+		LEFT JOIN song_duplicates ON songs.song_id = song_duplicates.song_id WHERE songs.song_id = ?`, songId)
 
 	err := row.Err()
 	if err != nil {
@@ -283,10 +740,15 @@ func (db *DBSMySql) GetSongById(songId int, logger *slog.Logger) (Song, error) {
 			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting song by song_id")
-		return song, err
+		return Song{}, err
 	}
 
-	err = row.Scan(&song.SongId, &song.SongTitle, &song.SongUrl)
+	song, err := scanSong(row)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.With(slog.Int("song_id", songId)).Debug("Song was not found")
+		return song, ErrSongNotFound
+	}
 
 	if err != nil {
 		logger.With(
@@ -299,33 +761,6 @@ func (db *DBSMySql) GetSongById(songId int, logger *slog.Logger) (Song, error) {
 	return song, nil
 }
 
-func (db *DBSMySql) SearchFingerprints(hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
-	joined := joinHashes(hashes)
-	query := fmt.Sprintf("SELECT hash_key, song_id, song_timestamp FROM fingerprints WHERE hash_key IN (%s)", joined)
-	rows, err := db.db.Query(query)
-	if err != nil {
-		logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints")
-		return nil, err
-	}
-	defer rows.Close()
-
-	matches := make(map[uint64][]Fingerprint, 0)
-
-	for rows.Next() {
-		var fingerprint Fingerprint
-		err = rows.Scan(&fingerprint.HashKey, &fingerprint.SongId, &fingerprint.Timestamp)
-
-		if err != nil {
-			logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints")
-			return nil, err
-		}
-		matches[fingerprint.HashKey] = append(matches[fingerprint.HashKey], fingerprint)
-	}
-
-	if err = rows.Err(); err != nil {
-		logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints")
-		return nil, err
-	}
-
-	return matches, nil
+func (db *DBSMySql) SearchFingerprints(ctx context.Context, hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	return searchFingerprintsChunked(ctx, db.db, hashes, db.search, logger)
 }
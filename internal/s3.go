@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type s3AudioStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3AudioStore keeps the archive as <prefix><song_id>.wav in the bucket,
+// the credentials are read from the default chain, e.g. AWS_ACCESS_KEY_ID for MinIO
+func NewS3AudioStore(region string, endpoint string, bucket string, prefix string, pathStyle bool, logger *slog.Logger) (AudioStore, error) {
+	logger = logger.With(slog.String("bucket", bucket), slog.String("endpoint", endpoint))
+
+	conf, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while loading default config")
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(conf, func(options *s3.Options) {
+		if endpoint != "" {
+			options.BaseEndpoint = aws.String(endpoint)
+		}
+		options.UsePathStyle = pathStyle
+	})
+
+	logger.Info("S3 audio store is created successfully")
+	return &s3AudioStore{
+		client: client,
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (store *s3AudioStore) Put(ctx context.Context, songId int, wavPath string, logger *slog.Logger) error {
+	logger = logger.With(slog.Int("song_id", songId), slog.String("wav_path", wavPath))
+
+	file, err := os.Open(wavPath)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t open the wav to archive")
+		return err
+	}
+	defer file.Close()
+
+	_, err = store.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(store.bucket),
+		Key:         aws.String(store.prefix + audioKey(songId)),
+		Body:        file,
+		ContentType: aws.String("audio/wav"),
+	})
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t upload the wav to S3")
+		return err
+	}
+
+	logger.Debug("Wav was archived successfully")
+	return nil
+}
+
+func (store *s3AudioStore) Fetch(ctx context.Context, songId int, dir string, logger *slog.Logger) (string, error) {
+	logger = logger.With(slog.Int("song_id", songId))
+
+	result, err := store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.prefix + audioKey(songId)),
+	})
+
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		logger.Debug("Song isn`t archived")
+		return "", ErrAudioNotFound
+	}
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t download the archived wav from S3")
+		return "", err
+	}
+	defer result.Body.Close()
+
+	wavPath, err := copyToTemp(dir, fmt.Sprintf("song-%d-*.wav", songId), result.Body)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Couldn`t copy the archived wav")
+		return "", err
+	}
+
+	return wavPath, nil
+}
+
+func (store *s3AudioStore) Delete(ctx context.Context, songId int, logger *slog.Logger) error {
+	_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(store.prefix + audioKey(songId)),
+	})
+	if err != nil {
+		logger.With(slog.Int("song_id", songId), slog.String("err", err.Error())).Warn("Couldn`t delete the archived wav from S3")
+		return err
+	}
+
+	return nil
+}
+
+func (store *s3AudioStore) Ping(ctx context.Context, logger *slog.Logger) error {
+	_, err := store.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(store.bucket),
+	})
+	if err != nil {
+		logger.With(slog.String("bucket", store.bucket), slog.String("err", err.Error())).Warn("Bucket is unreachable")
+	}
+	return err
+}
@@ -2,31 +2,45 @@ package internal
 
 import "math"
 
-func ScoreFingerprints(recordingFingerprints map[uint64]uint32, dbFingerprints map[uint64][]Fingerprint) map[int]int {
-	songsMatches := make(map[int][][2]uint32)
+// ScoreFingerprints counts for every song the pairs of matches with the same time distance
+// in the recording and in the song, a pair counts the mean weight of its hashes,
+// without weights (nil) every pair counts 1
+func ScoreFingerprints(recordingFingerprints map[uint64]uint32, dbFingerprints map[uint64][]Fingerprint, weights map[uint64]float64) map[int]float64 {
+	type match struct {
+		recordingTime uint32
+		songTime      uint32
+		weight        float64
+	}
+
+	songsMatches := make(map[int][]match)
 
 	for hash, fingerprints := range dbFingerprints {
+		weight := 1.0
+		if weights != nil {
+			weight = weights[hash]
+		}
+
 		for _, fingerprint := range fingerprints {
 			recordingTime, found := recordingFingerprints[hash]
 
 			if found {
 				songsMatches[fingerprint.SongId] = append(songsMatches[fingerprint.SongId],
-					[2]uint32{recordingTime, fingerprint.Timestamp})
+					match{recordingTime, fingerprint.Timestamp, weight})
 			}
 		}
 	}
 
-	songsScores := make(map[int]int)
+	songsScores := make(map[int]float64)
 
 	for songId, matches := range songsMatches {
-		score := 0
+		score := 0.0
 
 		for i := 0; i < len(matches); i++ {
 			for j := i + 1; j < len(matches); j++ {
-				diff1 := math.Abs(float64(matches[i][0]) - float64(matches[j][0]))
-				diff2 := math.Abs(float64(matches[i][1]) - float64(matches[j][1]))
+				diff1 := math.Abs(float64(matches[i].recordingTime) - float64(matches[j].recordingTime))
+				diff2 := math.Abs(float64(matches[i].songTime) - float64(matches[j].songTime))
 				if math.Abs(diff1-diff2) < 50 {
-					score++
+					score += (matches[i].weight + matches[j].weight) / 2
 				}
 			}
 		}
@@ -36,3 +50,56 @@ func ScoreFingerprints(recordingFingerprints map[uint64]uint32, dbFingerprints m
 
 	return songsScores
 }
+
+// IDFWeights weights every hash by its inverse document frequency log(1 + N/df),
+// the songs of the hash (df) are its postings, because a song has a hash at most once
+func IDFWeights(dbFingerprints map[uint64][]Fingerprint, songsCount int) map[uint64]float64 {
+	weights := make(map[uint64]float64, len(dbFingerprints))
+
+	for hash, fingerprints := range dbFingerprints {
+		if len(fingerprints) == 0 {
+			continue
+		}
+		weights[hash] = math.Log1p(float64(songsCount) / float64(len(fingerprints)))
+	}
+
+	return weights
+}
+
+// AlignedMatches returns for every song the biggest count of matching fingerprints
+// that share the same time offset (with 50ms tolerance) to the recording
+func AlignedMatches(recordingFingerprints map[uint64]uint32, dbFingerprints map[uint64][]Fingerprint) map[int]int {
+	const offsetBucket = 50
+
+	offsets := make(map[int]map[int64]int)
+
+	for hash, fingerprints := range dbFingerprints {
+		recordingTime, found := recordingFingerprints[hash]
+		if !found {
+			continue
+		}
+
+		for _, fingerprint := range fingerprints {
+			offset := (int64(fingerprint.Timestamp) - int64(recordingTime)) / offsetBucket
+
+			if offsets[fingerprint.SongId] == nil {
+				offsets[fingerprint.SongId] = make(map[int64]int)
+			}
+			offsets[fingerprint.SongId][offset]++
+		}
+	}
+
+	songsAligned := make(map[int]int)
+
+	for songId, songOffsets := range offsets {
+		for offset, count := range songOffsets {
+			// neighbouring buckets are merged, because the offset can fall on the edge of a bucket
+			aligned := count + songOffsets[offset+1]
+			if songsAligned[songId] < aligned {
+				songsAligned[songId] = aligned
+			}
+		}
+	}
+
+	return songsAligned
+}
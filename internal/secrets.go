@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrMissingParameters = errors.New("missing parameters")
+var ErrUnknownSecretProvider = errors.New("unknown secret provider")
+
+// SecretProvider resolves named parameters like db_password,
+// every provider maps the name to its own key (an SSM path, an env variable, ...)
+type SecretProvider interface {
+	// GetParameters returns the values of all names or ErrMissingParameters with the missing ones
+	GetParameters(ctx context.Context, names []string, logger *slog.Logger) (map[string]string, error)
+}
+
+type SecretsConfig struct {
+	// Provider is ssm, env, file or http, ssm by default in production and env otherwise
+	Provider string `yaml:"provider" env:"SECRETS_PROVIDER"`
+	// SSMPrefix is prepended to the names, db_host is read from /rds/db_host by default
+	SSMPrefix string `yaml:"ssm_prefix" env:"SECRETS_SSM_PREFIX"`
+	// EnvPrefix is prepended to the upper cased names, db_host is read from DB_HOST by default
+	EnvPrefix string `yaml:"env_prefix" env:"SECRETS_ENV_PREFIX"`
+	// FilePath is a YAML or JSON file with the names as keys
+	FilePath string `yaml:"file" env:"SECRETS_FILE"`
+	// HTTPUrl serves every parameter as a plain text body at <url>/<name>
+	HTTPUrl string `yaml:"http_url" env:"SECRETS_HTTP_URL"`
+}
+
+func DefaultSecretsConfig() SecretsConfig {
+	return SecretsConfig{
+		SSMPrefix: "/rds/",
+		FilePath:  "secrets.yaml",
+		HTTPUrl:   "http://localhost:8200/parameters",
+	}
+}
+
+func NewSecretProvider(config SecretsConfig, region string, logger *slog.Logger) (SecretProvider, error) {
+	logger = logger.With(slog.String("secret_provider", config.Provider))
+
+	switch config.Provider {
+	case "ssm":
+		return NewSSMSecretProvider(region, config.SSMPrefix, logger)
+	case "env":
+		return &envSecretProvider{prefix: config.EnvPrefix, lookupEnv: os.LookupEnv}, nil
+	case "file":
+		return NewFileSecretProvider(config.FilePath, logger)
+	case "http":
+		return &httpSecretProvider{baseUrl: strings.TrimSuffix(config.HTTPUrl, "/"), client: http.DefaultClient}, nil
+	default:
+		logger.Error("Unknown secret provider, expected ssm, env, file or http")
+		return nil, ErrUnknownSecretProvider
+	}
+}
+
+func missingParameters(provider string, missing []string, logger *slog.Logger) error {
+	logger.With(
+		slog.String("provider", provider),
+		slog.String("missing", strings.Join(missing, ", ")),
+	).Error("Parameters are missing")
+	return fmt.Errorf("%w in %s: %s", ErrMissingParameters, provider, strings.Join(missing, ", "))
+}
+
+type envSecretProvider struct {
+	prefix    string
+	lookupEnv func(key string) (string, bool)
+}
+
+func (provider *envSecretProvider) GetParameters(ctx context.Context, names []string, logger *slog.Logger) (map[string]string, error) {
+	params := make(map[string]string, len(names))
+	missing := make([]string, 0)
+
+	for _, name := range names {
+		key := provider.prefix + strings.ToUpper(name)
+		value, found := provider.lookupEnv(key)
+		if !found {
+			missing = append(missing, key)
+			continue
+		}
+		params[name] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, missingParameters("env", missing, logger)
+	}
+
+	return params, nil
+}
+
+type fileSecretProvider struct {
+	path   string
+	params map[string]string
+}
+
+// NewFileSecretProvider reads the file once, it suits the secrets mounted by docker-compose
+func NewFileSecretProvider(path string, logger *slog.Logger) (SecretProvider, error) {
+	logger = logger.With(slog.String("secrets_file", path))
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while reading the secrets file")
+		return nil, err
+	}
+
+	params := make(map[string]string)
+	err = yaml.Unmarshal(content, &params)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while parsing the secrets file")
+		return nil, err
+	}
+
+	return &fileSecretProvider{
+		path:   path,
+		params: params,
+	}, nil
+}
+
+func (provider *fileSecretProvider) GetParameters(ctx context.Context, names []string, logger *slog.Logger) (map[string]string, error) {
+	params := make(map[string]string, len(names))
+	missing := make([]string, 0)
+
+	for _, name := range names {
+		value, found := provider.params[name]
+		if !found {
+			missing = append(missing, name)
+			continue
+		}
+		params[name] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, missingParameters(provider.path, missing, logger)
+	}
+
+	return params, nil
+}
+
+// httpSecretProvider reads the parameters from a local stand-in of a parameter store,
+// a 404 is a missing parameter
+type httpSecretProvider struct {
+	baseUrl string
+	client  *http.Client
+}
+
+func (provider *httpSecretProvider) GetParameters(ctx context.Context, names []string, logger *slog.Logger) (map[string]string, error) {
+	params := make(map[string]string, len(names))
+	missing := make([]string, 0)
+
+	for _, name := range names {
+		value, found, err := provider.getParameter(ctx, name)
+		if err != nil {
+			logger.With(
+				slog.String("name", name),
+				slog.String("err", err.Error()),
+			).Error("Error while getting a parameter over http")
+			return nil, err
+		}
+
+		if !found {
+			missing = append(missing, name)
+			continue
+		}
+		params[name] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, missingParameters(provider.baseUrl, missing, logger)
+	}
+
+	return params, nil
+}
+
+func (provider *httpSecretProvider) getParameter(ctx context.Context, name string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.baseUrl+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+
+	return strings.TrimSpace(string(body)), true, nil
+}
+
+// dbParameterNames hold the connection options of the SQL server backends
+var dbParameterNames = []string{"db_host", "db_port", "db_username", "db_password", "db_name"}
+
+func LoadDBConnectionOptions(ctx context.Context, provider SecretProvider, logger *slog.Logger) (DBConnectionOptions, error) {
+	params, err := provider.GetParameters(ctx, dbParameterNames, logger)
+	if err != nil {
+		return DBConnectionOptions{}, err
+	}
+
+	return DBConnectionOptions{
+		Host:     params["db_host"],
+		Port:     params["db_port"],
+		Username: params["db_username"],
+		Password: params["db_password"],
+		DBName:   params["db_name"],
+	}, nil
+}
@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+var ErrNoShards = errors.New("sharded db without shards")
+
+// ShardedDB keeps the songs and the duplicate links on the primary and partitions
+// the fingerprints by hash range across the shards, the shards share the schema of the primary.
+// The range of a shard depends on the count of shards and on the hash layout of the FingerprintVersion,
+// so a catalog is moved to another count of shards with an export and an import
+type ShardedDB struct {
+	DB
+	shards []DB
+	// the hashes of the analysis lie in [firstHash, firstHash + len(shards) * rangeWidth)
+	firstHash  uint64
+	rangeWidth uint64
+}
+
+func NewShardedDB(primary DB, shards []DB, logger *slog.Logger) (*ShardedDB, error) {
+	if len(shards) == 0 {
+		logger.Error("Sharded DB needs at least one shard")
+		return nil, ErrNoShards
+	}
+
+	// the last peak range holds the most significant bits of the hash, so the ranges split its frequencies
+	firstHash, lastHash := analysisHashRange()
+
+	db := &ShardedDB{
+		DB:         primary,
+		shards:     shards,
+		firstHash:  firstHash,
+		rangeWidth: (lastHash-firstHash)/uint64(len(shards)) + 1,
+	}
+
+	logger.With(
+		slog.Int("shards", len(shards)),
+		slog.Uint64("hashes_per_shard", db.rangeWidth),
+	).Info("Sharded DB is created successfully")
+
+	return db, nil
+}
+
+// analysisHashRange returns the smallest and the biggest hash of the peak ranges
+func analysisHashRange() (uint64, uint64) {
+	first := make([]uint64, len(peaksRanges))
+	last := make([]uint64, len(peaksRanges))
+	for i, peakRange := range peaksRanges {
+		first[i] = uint64(peakRange.min)
+		last[i] = uint64(peakRange.max - 1)
+	}
+
+	return hash(first[0], first[1], first[2], first[3]), hash(last[0], last[1], last[2], last[3])
+}
+
+// shardOf returns the shard of the hash, the hashes outside of the range go to the first or the last shard
+func (db *ShardedDB) shardOf(hash uint64) int {
+	if hash < db.firstHash {
+		return 0
+	}
+
+	return int(min((hash-db.firstHash)/db.rangeWidth, uint64(len(db.shards)-1)))
+}
+
+// fanOut calls fn for every shard concurrently and returns the first error
+func (db *ShardedDB) fanOut(fn func(shard int) error) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for shard := range db.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := fn(shard)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// backends returns the primary and the shards without repeating the primary when it is also a shard
+func (db *ShardedDB) backends() []DB {
+	backends := []DB{db.DB}
+	for _, shard := range db.shards {
+		if shard != db.DB {
+			backends = append(backends, shard)
+		}
+	}
+	return backends
+}
+
+// SetupDB applies the pending schema migrations on the primary and on every shard
+func (db *ShardedDB) SetupDB(ctx context.Context, logger *slog.Logger) error {
+	err := db.DB.SetupDB(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	for i, shard := range db.shards {
+		err = shard.SetupDB(ctx, logger.With(slog.Int("shard", i)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrationsStatus lists the migrations of the primary and then of every shard, as each db is migrated on its own
+func (db *ShardedDB) MigrationsStatus(ctx context.Context, logger *slog.Logger) ([]MigrationStatus, error) {
+	statuses, err := db.DB.MigrationsStatus(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+	for i := range statuses {
+		statuses[i].Backend = "primary"
+	}
+
+	for i, shard := range db.shards {
+		if shard == db.DB {
+			continue
+		}
+
+		shardStatuses, err := shard.MigrationsStatus(ctx, logger.With(slog.Int("shard", i)))
+		if err != nil {
+			return nil, err
+		}
+		for j := range shardStatuses {
+			shardStatuses[j].Backend = fmt.Sprintf("shard %d", i)
+		}
+		statuses = append(statuses, shardStatuses...)
+	}
+
+	return statuses, nil
+}
+
+func (db *ShardedDB) Ping(ctx context.Context, logger *slog.Logger) error {
+	err := db.DB.Ping(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	return db.fanOut(func(shard int) error {
+		return db.shards[shard].Ping(ctx, logger.With(slog.Int("shard", shard)))
+	})
+}
+
+// InsertFingerprints splits the fingerprints by shard, the shards aren`t a single transaction,
+// so the fingerprints already inserted are deleted again when a shard fails
+func (db *ShardedDB) InsertFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	parts := db.splitFingerprints(fingerprints)
+
+	err := db.fanOut(func(shard int) error {
+		if len(parts[shard]) == 0 {
+			return nil
+		}
+		return db.shards[shard].InsertFingerprints(ctx, songId, parts[shard], logger.With(slog.Int("shard", shard)))
+	})
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting fingerprints into the shards, the inserted ones are deleted")
+
+		cleanupErr := db.deleteShardFingerprints(ctx, songId, logger)
+		if cleanupErr != nil {
+			logger.With(
+				slog.Int("song_id", songId),
+				slog.String("err", cleanupErr.Error()),
+			).Error("Couldn`t delete the fingerprints of the failed insert, reindex the song")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// splitFingerprints returns the fingerprints of every shard
+func (db *ShardedDB) splitFingerprints(fingerprints map[uint64]uint32) []map[uint64]uint32 {
+	parts := make([]map[uint64]uint32, len(db.shards))
+	for i := range parts {
+		parts[i] = make(map[uint64]uint32, len(fingerprints)/len(db.shards)+1)
+	}
+	for hash, timestamp := range fingerprints {
+		parts[db.shardOf(hash)][hash] = timestamp
+	}
+	return parts
+}
+
+// ReplaceFingerprints replaces the fingerprints on every shard in a transaction of the shard and then the duplicate link
+// and the version on the primary, so when a shard fails the song keeps its old version and is reindexed again
+func (db *ShardedDB) ReplaceFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, duplicateOf int, similarity float64, fingerprintVersion int, logger *slog.Logger) error {
+	// a duplicate keeps no fingerprints, so they are only deleted from the shards
+	if duplicateOf != -1 {
+		fingerprints = nil
+	}
+	parts := db.splitFingerprints(fingerprints)
+
+	var primaryFingerprints map[uint64]uint32
+	err := db.fanOut(func(shard int) error {
+		if db.shards[shard] == db.DB {
+			primaryFingerprints = parts[shard]
+			return nil
+		}
+		return db.shards[shard].ReplaceFingerprints(ctx, songId, parts[shard], -1, 0, fingerprintVersion, logger.With(slog.Int("shard", shard)))
+	})
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Error("Error while replacing fingerprints on the shards, reindex the song again")
+		return err
+	}
+
+	return db.DB.ReplaceFingerprints(ctx, songId, primaryFingerprints, duplicateOf, similarity, fingerprintVersion, logger)
+}
+
+func (db *ShardedDB) deleteShardFingerprints(ctx context.Context, songId int, logger *slog.Logger) error {
+	return db.fanOut(func(shard int) error {
+		if db.shards[shard] == db.DB {
+			return nil
+		}
+		return db.shards[shard].DeleteFingerprints(ctx, songId, logger.With(slog.Int("shard", shard)))
+	})
+}
+
+// DeleteSong deletes the song on the primary, which may promote a duplicate, then the fingerprints of the song
+// are moved to the promoted duplicate or deleted on every shard
+func (db *ShardedDB) DeleteSong(ctx context.Context, songId int, logger *slog.Logger) (int, error) {
+	promotedId, err := db.DB.DeleteSong(ctx, songId, logger)
+	if err != nil {
+		return promotedId, err
+	}
+
+	if promotedId == -1 {
+		err = db.deleteShardFingerprints(ctx, songId, logger)
+	} else {
+		err = db.moveShardFingerprints(ctx, songId, promotedId, logger)
+	}
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.Int("promoted_song_id", promotedId),
+			slog.String("err", err.Error()),
+		).Error("Song was deleted, but its fingerprints weren`t changed on every shard")
+		return promotedId, err
+	}
+
+	return promotedId, nil
+}
+
+// moveShardFingerprints gives the fingerprints of the song to another song on every shard
+func (db *ShardedDB) moveShardFingerprints(ctx context.Context, songId int, toSongId int, logger *slog.Logger) error {
+	return db.fanOut(func(shard int) error {
+		if db.shards[shard] == db.DB {
+			return nil
+		}
+
+		logger := logger.With(slog.Int("shard", shard))
+		fingerprints, err := db.shards[shard].GetSongFingerprints(ctx, songId, logger)
+		if err != nil {
+			return err
+		}
+
+		if len(fingerprints) > 0 {
+			err = db.shards[shard].InsertFingerprints(ctx, toSongId, fingerprints, logger)
+			if err != nil {
+				return err
+			}
+		}
+
+		return db.shards[shard].DeleteFingerprints(ctx, songId, logger)
+	})
+}
+
+func (db *ShardedDB) DeleteFingerprints(ctx context.Context, songId int, logger *slog.Logger) error {
+	err := db.deleteShardFingerprints(ctx, songId, logger)
+	if err != nil {
+		return err
+	}
+
+	// the duplicate link is on the primary
+	return db.DB.DeleteFingerprints(ctx, songId, logger)
+}
+
+func (db *ShardedDB) GetSongStats(ctx context.Context, songId int, logger *slog.Logger) (SongStats, error) {
+	shardsStats := make([]SongStats, len(db.shards))
+	err := db.fanOut(func(shard int) error {
+		var err error
+		shardsStats[shard], err = db.shards[shard].GetSongStats(ctx, songId, logger.With(slog.Int("shard", shard)))
+		return err
+	})
+	if err != nil {
+		return SongStats{}, err
+	}
+
+	var stats SongStats
+	for _, shardStats := range shardsStats {
+		if shardStats.FingerprintsCount == 0 {
+			continue
+		}
+
+		if stats.FingerprintsCount == 0 || shardStats.FirstTimestamp < stats.FirstTimestamp {
+			stats.FirstTimestamp = shardStats.FirstTimestamp
+		}
+		stats.LastTimestamp = max(stats.LastTimestamp, shardStats.LastTimestamp)
+		stats.FingerprintsCount += shardStats.FingerprintsCount
+	}
+
+	return stats, nil
+}
+
+func (db *ShardedDB) GetSongFingerprints(ctx context.Context, songId int, logger *slog.Logger) (map[uint64]uint32, error) {
+	var mu sync.Mutex
+	fingerprints := make(map[uint64]uint32)
+
+	err := db.fanOut(func(shard int) error {
+		shardFingerprints, err := db.shards[shard].GetSongFingerprints(ctx, songId, logger.With(slog.Int("shard", shard)))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for hash, timestamp := range shardFingerprints {
+			fingerprints[hash] = timestamp
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fingerprints, nil
+}
+
+// GetStorageStats sums every table over the primary and the shards
+func (db *ShardedDB) GetStorageStats(ctx context.Context, logger *slog.Logger) ([]TableStorage, error) {
+	var stats []TableStorage
+	tables := make(map[string]int)
+
+	for _, backend := range db.backends() {
+		backendStats, err := backend.GetStorageStats(ctx, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, table := range backendStats {
+			i, found := tables[table.Table]
+			if !found {
+				tables[table.Table] = len(stats)
+				stats = append(stats, table)
+				continue
+			}
+
+			stats[i].Rows += table.Rows
+			stats[i].DataBytes = addKnownBytes(stats[i].DataBytes, table.DataBytes)
+			stats[i].IndexBytes = addKnownBytes(stats[i].IndexBytes, table.IndexBytes)
+		}
+	}
+
+	return stats, nil
+}
+
+// addKnownBytes keeps the sum unknown (-1) when a part is unknown
+func addKnownBytes(a int64, b int64) int64 {
+	if a < 0 || b < 0 {
+		return -1
+	}
+	return a + b
+}
+
+func (db *ShardedDB) GetFingerprintsCount(ctx context.Context, logger *slog.Logger) (int, error) {
+	counts := make([]int, len(db.shards))
+	err := db.fanOut(func(shard int) error {
+		var err error
+		counts[shard], err = db.shards[shard].GetFingerprintsCount(ctx, logger.With(slog.Int("shard", shard)))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, shardCount := range counts {
+		count += shardCount
+	}
+	return count, nil
+}
+
+// SearchFingerprints looks up every hash on its shard, the shards are queried concurrently,
+// a hash lives on a single shard, so the cap of the postings is applied by the shard
+func (db *ShardedDB) SearchFingerprints(ctx context.Context, hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	parts := make([][]uint64, len(db.shards))
+	for _, hash := range hashes {
+		shard := db.shardOf(hash)
+		parts[shard] = append(parts[shard], hash)
+	}
+
+	var mu sync.Mutex
+	matches := make(map[uint64][]Fingerprint, 0)
+
+	err := db.fanOut(func(shard int) error {
+		if len(parts[shard]) == 0 {
+			return nil
+		}
+
+		shardMatches, err := db.shards[shard].SearchFingerprints(ctx, parts[shard], logger.With(slog.Int("shard", shard)))
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for hash, fingerprints := range shardMatches {
+			matches[hash] = fingerprints
+		}
+		return nil
+	})
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints in the shards")
+		return nil, err
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestShardedDB creates a sqlite primary and the sqlite shards in a temp dir and migrates them
+func newTestShardedDB(t *testing.T, shardsCount int) (*ShardedDB, []DB) {
+	t.Helper()
+
+	ctx := context.Background()
+	logger := newTestLogger()
+	dir := t.TempDir()
+
+	primary, err := NewDBSqlite(filepath.Join(dir, "primary.sqlite"), DefaultSearchOptions(), logger)
+	if err != nil {
+		t.Fatalf("create the primary: %v", err)
+	}
+
+	shards := make([]DB, shardsCount)
+	for i := range shards {
+		shards[i], err = NewDBSqlite(filepath.Join(dir, fmt.Sprintf("shard%d.sqlite", i)), DefaultSearchOptions(), logger)
+		if err != nil {
+			t.Fatalf("create shard %d: %v", i, err)
+		}
+	}
+
+	db, err := NewShardedDB(primary, shards, logger)
+	if err != nil {
+		t.Fatalf("create the sharded db: %v", err)
+	}
+
+	err = db.SetupDB(ctx, logger)
+	if err != nil {
+		t.Fatalf("setup the sharded db: %v", err)
+	}
+
+	return db, shards
+}
+
+// shardHash returns a hash in the range of the shard
+func shardHash(db *ShardedDB, shard int, offset uint64) uint64 {
+	return db.firstHash + uint64(shard)*db.rangeWidth + offset
+}
+
+func TestShardedDBShardOf(t *testing.T) {
+	db, err := NewShardedDB(nil, make([]DB, 3), newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstHash, lastHash := analysisHashRange()
+
+	tests := []struct {
+		hash  uint64
+		shard int
+	}{
+		{0, 0},
+		{firstHash - 1, 0},
+		{firstHash, 0},
+		{shardHash(db, 1, 0) - 1, 0},
+		{shardHash(db, 1, 0), 1},
+		{shardHash(db, 2, 0) - 1, 1},
+		{shardHash(db, 2, 0), 2},
+		{lastHash, 2},
+		{lastHash + 1, 2},
+		{^uint64(0), 2},
+	}
+
+	for _, test := range tests {
+		shard := db.shardOf(test.hash)
+		if shard != test.shard {
+			t.Errorf("shardOf(%d) = %d, want %d", test.hash, shard, test.shard)
+		}
+	}
+
+	_, err = NewShardedDB(nil, nil, newTestLogger())
+	if !errors.Is(err, ErrNoShards) {
+		t.Errorf("NewShardedDB without shards: err = %v, want %v", err, ErrNoShards)
+	}
+}
+
+func TestShardedDBFingerprints(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db, shards := newTestShardedDB(t, 3)
+
+	songId, err := db.InsertSong(ctx, "Title", "Artist", "https://example.com/1", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSongId, err := db.InsertSong(ctx, "Other", "Artist", "https://example.com/2", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints := make(map[uint64]uint32)
+	for shard := range shards {
+		for offset := range uint64(4) {
+			fingerprints[shardHash(db, shard, offset)] = uint32(100*shard) + uint32(offset) + 10
+		}
+	}
+
+	err = db.InsertFingerprints(ctx, songId, fingerprints, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharedHash := shardHash(db, 1, 0)
+	err = db.InsertFingerprints(ctx, otherSongId, map[uint64]uint32{sharedHash: 7}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for shard := range shards {
+		shardFingerprints, err := shards[shard].GetSongFingerprints(ctx, songId, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shardFingerprints) != 4 {
+			t.Errorf("shard %d has %d fingerprints of the song, want 4", shard, len(shardFingerprints))
+		}
+		for hash := range shardFingerprints {
+			if db.shardOf(hash) != shard {
+				t.Errorf("hash %d of shard %d belongs to shard %d", hash, shard, db.shardOf(hash))
+			}
+		}
+	}
+
+	got, err := db.GetSongFingerprints(ctx, songId, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got, fingerprints) {
+		t.Errorf("GetSongFingerprints = %v, want %v", got, fingerprints)
+	}
+
+	stats, err := db.GetSongStats(ctx, songId, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStats := SongStats{FingerprintsCount: 12, FirstTimestamp: 10, LastTimestamp: 213}
+	if stats != wantStats {
+		t.Errorf("GetSongStats = %+v, want %+v", stats, wantStats)
+	}
+
+	count, err := db.GetFingerprintsCount(ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 13 {
+		t.Errorf("GetFingerprintsCount = %d, want 13", count)
+	}
+
+	hashes := slices.Collect(maps.Keys(fingerprints))
+	matches, err := db.SearchFingerprints(ctx, hashes, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != len(fingerprints) {
+		t.Errorf("SearchFingerprints matched %d hashes, want %d", len(matches), len(fingerprints))
+	}
+	for hash, timestamp := range fingerprints {
+		songs := make(map[int]uint32)
+		for _, fingerprint := range matches[hash] {
+			if fingerprint.HashKey != hash {
+				t.Errorf("hash %d has a posting of hash %d", hash, fingerprint.HashKey)
+			}
+			songs[fingerprint.SongId] = fingerprint.Timestamp
+		}
+
+		want := map[int]uint32{songId: timestamp}
+		if hash == sharedHash {
+			want[otherSongId] = 7
+		}
+		if !maps.Equal(songs, want) {
+			t.Errorf("postings of hash %d = %v, want %v", hash, songs, want)
+		}
+	}
+
+	_, err = db.DeleteSong(ctx, songId, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for shard := range shards {
+		shardFingerprints, err := shards[shard].GetSongFingerprints(ctx, songId, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shardFingerprints) != 0 {
+			t.Errorf("shard %d keeps %d fingerprints of the deleted song", shard, len(shardFingerprints))
+		}
+	}
+
+	_, err = db.GetSongById(ctx, songId, logger)
+	if !errors.Is(err, ErrSongNotFound) {
+		t.Errorf("GetSongById of the deleted song: err = %v, want %v", err, ErrSongNotFound)
+	}
+
+	count, err = db.GetFingerprintsCount(ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("GetFingerprintsCount after the delete = %d, want 1", count)
+	}
+}
+
+func TestShardedDBInsertFingerprintsCleanup(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db, shards := newTestShardedDB(t, 3)
+
+	_, err := shards[2].(*DBSqlite).db.ExecContext(ctx,
+		"CREATE TRIGGER fail_insert BEFORE INSERT ON fingerprints BEGIN SELECT RAISE(ABORT, 'shard is down'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	songId, err := db.InsertSong(ctx, "Title", "Artist", "https://example.com/1", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints := make(map[uint64]uint32)
+	for shard := range shards {
+		fingerprints[shardHash(db, shard, 0)] = uint32(shard)
+	}
+
+	err = db.InsertFingerprints(ctx, songId, fingerprints, logger)
+	if err == nil {
+		t.Fatal("InsertFingerprints succeeded with a failing shard")
+	}
+
+	for shard := range shards {
+		shardFingerprints, err := shards[shard].GetSongFingerprints(ctx, songId, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shardFingerprints) != 0 {
+			t.Errorf("shard %d keeps %d fingerprints of the failed insert", shard, len(shardFingerprints))
+		}
+	}
+}
+
+func TestShardedDBMigrationsStatus(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db, shards := newTestShardedDB(t, 2)
+
+	primaryStatuses, err := db.DB.MigrationsStatus(ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := db.MigrationsStatus(ctx, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statuses) != (len(shards)+1)*len(primaryStatuses) {
+		t.Fatalf("MigrationsStatus has %d statuses, want %d", len(statuses), (len(shards)+1)*len(primaryStatuses))
+	}
+
+	for i, status := range statuses {
+		backend := "primary"
+		if i >= len(primaryStatuses) {
+			backend = fmt.Sprintf("shard %d", i/len(primaryStatuses)-1)
+		}
+		if status.Backend != backend {
+			t.Errorf("status %d is of %q, want %q", i, status.Backend, backend)
+		}
+		if status.Version != primaryStatuses[i%len(primaryStatuses)].Version {
+			t.Errorf("status %d has version %d, want %d", i, status.Version, primaryStatuses[i%len(primaryStatuses)].Version)
+		}
+	}
+}
+
+func TestShardedDBDeleteSongPromotesDuplicate(t *testing.T) {
+	ctx := context.Background()
+	logger := newTestLogger()
+	db, shards := newTestShardedDB(t, 3)
+
+	original, err := db.InsertSong(ctx, "Title", "Artist", "https://example.com/1", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate, err := db.InsertSong(ctx, "Title", "Artist", "https://example.com/2", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints := make(map[uint64]uint32)
+	for shard := range shards {
+		fingerprints[shardHash(db, shard, 0)] = uint32(shard)
+	}
+
+	err = db.InsertFingerprints(ctx, original, fingerprints, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertSongDuplicate(ctx, duplicate, original, 0.9, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	promotedId, err := db.DeleteSong(ctx, original, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promotedId != duplicate {
+		t.Fatalf("DeleteSong promoted %d, want %d", promotedId, duplicate)
+	}
+
+	for shard := range shards {
+		moved, err := shards[shard].GetSongFingerprints(ctx, duplicate, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		left, err := shards[shard].GetSongFingerprints(ctx, original, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(moved) != 1 || len(left) != 0 {
+			t.Errorf("shard %d has %d fingerprints of the promoted song and %d of the deleted one, want 1 and 0", shard, len(moved), len(left))
+		}
+	}
+}
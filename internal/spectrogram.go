@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"image"
 	"image/color"
 	"image/jpeg"
@@ -10,19 +11,27 @@ import (
 	"os"
 )
 
+const windowSize = 1024
+const hopSize = 512
+
+// how many windows are transformed between the checks for a cancelled context
+const cancelCheckInterval = 256
+
 // Spectogram slice of frequencies for window
-func STFT(wavPath string, logger *slog.Logger) ([][]complex128, float64) {
+func STFT(ctx context.Context, wavPath string, logger *slog.Logger) ([][]complex128, float64, error) {
 	wavParser, err := NewWavParser(wavPath, logger)
 	if err != nil {
 		logger.With(slog.String("wav_path", wavPath)).Debug("Couldn`t create the wav parser")
-		return nil, 0
+		return nil, 0, err
 	}
 	defer wavParser.Close()
 
-	const windowSize = 1024
-	const hopSize = 512
-
 	numWindows := wavParser.WindowsCount(windowSize, hopSize)
+	if numWindows < 1 {
+		logger.With(slog.String("wav_path", wavPath)).Debug("The wav is shorter than a window")
+		return nil, 0, ErrTooBigWindowSize
+	}
+
 	stftRes := make([][]complex128, numWindows)
 	windowFunction := hammingWindow(windowSize)
 
@@ -30,17 +39,25 @@ func STFT(wavPath string, logger *slog.Logger) ([][]complex128, float64) {
 
 	if err != nil {
 		logger.With(slog.String("wav_path", wavPath)).Debug("Couldn`t create an iterator for the sample data")
-		return nil, 0
+		return nil, 0, err
 	}
 
 	for i, sample := range iter {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			logger.With(
+				slog.String("wav_path", wavPath),
+				slog.String("err", ctx.Err().Error()),
+			).Debug("STFT was cancelled")
+			return nil, 0, ctx.Err()
+		}
+
 		applyWindowFunction(sample, windowFunction)
 		stftRes[i] = fft(sample, 0, len(sample)-1, 1)[:windowSize/2]
 	}
 
 	timePerColumn := float64(hopSize) / float64(wavParser.wavHeader.sampleRate)
 
-	return stftRes, timePerColumn
+	return stftRes, timePerColumn, nil
 }
 
 // https://en.wikipedia.org/wiki/Window_function#Hann_and_Hamming_windows
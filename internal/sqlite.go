@@ -1,18 +1,27 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 type DBSqlite struct {
-	db *sql.DB
+	db     *sql.DB
+	search SearchOptions
+	// false when SQLite is built without FTS5 (the sqlite_fts5 build tag),
+	// then the song search falls back to LIKE
+	fts bool
 }
 
-func NewDBSqlite(dbPath string, logger *slog.Logger) (DB, error) {
+func NewDBSqlite(dbPath string, search SearchOptions, logger *slog.Logger) (DB, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 
 	if err != nil {
@@ -28,28 +37,15 @@ func NewDBSqlite(dbPath string, logger *slog.Logger) (DB, error) {
 
 	logger.With(slog.String("db_path", dbPath)).Info("DB is created successfully")
 	return &DBSqlite{
-		db: db,
+		db:     db,
+		search: search,
 	}, nil
 }
 
-func (db *DBSqlite) SetupDB(logger *slog.Logger) error {
-	_, err := db.db.Exec(`CREATE TABLE IF NOT EXISTS songs (
-    song_id INTEGER PRIMARY KEY AUTOINCREMENT,
-    song_title TEXT,
-    song_url TEXT
-);
-
-CREATE  UNIQUE INDEX IF NOT EXISTS songs_song_url ON songs(song_url);
-
-CREATE TABLE IF NOT EXISTS fingerprints (
-    fingerprint_id INTEGER PRIMARY KEY AUTOINCREMENT,
-    hash_key INTEGER NOT NULL,
-    song_id TEXT NOT NULL,
-    song_timestamp INTEGER NOT NULL,
-    FOREIGN KEY(song_id) REFERENCES songs(song_id)
-);
-
-CREATE INDEX IF NOT EXISTS fingerprints_hash_key ON fingerprints(hash_key);`)
+// SetupDB applies the pending schema migrations,
+// the full text search migration is applied only by a SQLite build with FTS5
+func (db *DBSqlite) SetupDB(ctx context.Context, logger *slog.Logger) error {
+	err := runMigrations(ctx, db.db, sqliteMigrationDialect, logger)
 
 	if err != nil {
 		logger.With(
@@ -58,14 +54,86 @@ CREATE INDEX IF NOT EXISTS fingerprints_hash_key ON fingerprints(hash_key);`)
 		return err
 	}
 
+	err = db.detectFullTextSearch(ctx, logger)
+	if err != nil {
+		return err
+	}
+
 	logger.Info("Db setup successfully")
 
 	return err
 }
 
-func (db *DBSqlite) InsertSong(songTitle string, songUrl string, logger *slog.Logger) (int, error) {
-	res, err := db.db.Exec("INSERT INTO songs (song_title, song_url) VALUES (?, ?)",
-		songTitle, songUrl)
+func (db *DBSqlite) MigrationsStatus(ctx context.Context, logger *slog.Logger) ([]MigrationStatus, error) {
+	return migrationsStatus(ctx, db.db, sqliteMigrationDialect, logger)
+}
+
+func (db *DBSqlite) Ping(ctx context.Context, logger *slog.Logger) error {
+	err := db.db.PingContext(ctx)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while pinging the db")
+	}
+	return err
+}
+
+// detectFullTextSearch enables the FTS5 search when the songs_fts migration was applied
+// and the SQLite build has FTS5, the songs_fts triggers fail without it
+func (db *DBSqlite) detectFullTextSearch(ctx context.Context, logger *slog.Logger) error {
+	enabled, err := sqliteMigrationDialect.supports(ctx, db.db, "ENABLE_FTS5")
+	if err != nil {
+		logger.With(
+			slog.String("err", err.Error()),
+		).Error("Error while checking for FTS5 support")
+		return err
+	}
+
+	if !enabled {
+		logger.Warn("SQLite is built without FTS5, the song search falls back to LIKE")
+		return nil
+	}
+
+	exists, err := tableExists(ctx, db.db, sqliteMigrationDialect, "songs_fts")
+	if err != nil {
+		logger.With(
+			slog.String("err", err.Error()),
+		).Error("Error while checking for the songs full text search table")
+		return err
+	}
+
+	db.fts = exists
+
+	return nil
+}
+
+func (db *DBSqlite) searchCondition(search string) (string, []any) {
+	terms := searchTerms(search)
+	if len(terms) == 0 {
+		return "", nil
+	}
+
+	if !db.fts {
+		conditions := make([]string, len(terms))
+		args := make([]any, 0, 2*len(terms))
+		for i, term := range terms {
+			conditions[i] = "(song_title LIKE ? OR song_artist LIKE ?)"
+			pattern := "%" + term + "%"
+			args = append(args, pattern, pattern)
+		}
+
+		return strings.Join(conditions, " AND "), args
+	}
+
+	// every term is matched as a prefix
+	for i, term := range terms {
+		terms[i] = `"` + term + `"*`
+	}
+
+	return "songs.song_id IN (SELECT rowid FROM songs_fts WHERE songs_fts MATCH ?)", []any{strings.Join(terms, " ")}
+}
+
+func (db *DBSqlite) InsertSong(ctx context.Context, songTitle string, songArtist string, songUrl string, logger *slog.Logger) (int, error) {
+	res, err := db.db.ExecContext(ctx, "INSERT INTO songs (song_title, song_artist, song_url, added_at) VALUES (?, ?, ?, ?)",
+		songTitle, songArtist, songUrl, time.Now().Unix())
 
 	if err != nil {
 		logger.With(
@@ -95,33 +163,376 @@ func (db *DBSqlite) InsertSong(songTitle string, songUrl string, logger *slog.Lo
 	return int(songId), nil
 }
 
-func (db *DBSqlite) InsertFingerprint(hash uint64, songId int, timestamp uint32, logger *slog.Logger) error {
-	_, err := db.db.Exec("INSERT INTO fingerprints (hash_key, song_id, song_timestamp) VALUES (?, ?, ?)",
-		hash, songId, timestamp)
+func (db *DBSqlite) InsertFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting fingerprints")
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertFingerprintsSqlite(ctx, tx, songId, fingerprints, logger)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting fingerprints")
+		return err
+	}
+
+	logger.With(
+		slog.Int("song_id", songId),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Fingerprints were inserted successfully")
+
+	return nil
+}
+
+// insertFingerprintsSqlite inserts the fingerprints and counts them in the hash stats in the transaction
+func insertFingerprintsSqlite(ctx context.Context, tx *sql.Tx, songId int, fingerprints map[uint64]uint32, logger *slog.Logger) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO fingerprints (hash_key, song_id, song_timestamp) VALUES (?, ?, ?)")
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting fingerprints")
+		return err
+	}
+	defer stmt.Close()
+
+	for hash, timestamp := range fingerprints {
+		_, err = stmt.ExecContext(ctx, hash, songId, timestamp)
+
+		if err != nil {
+			logger.With(
+				slog.String("hash", fmt.Sprintf("%x", hash)),
+				slog.Int("song_id", songId),
+				slog.String("err", err.Error()),
+			).Warn("Error while inserting a fingerprint")
+			return err
+		}
+	}
 
+	_, err = tx.ExecContext(ctx, addHashStatsSqlite, songId)
 	if err != nil {
 		logger.With(
-			slog.String("hash", fmt.Sprintf("%x", hash)),
 			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
-		).Warn("Error while inserting a fingerprint")
+		).Warn("Error while updating the hash stats")
 		return err
 	}
 
-	// logger.With(
-	// 	slog.String("hash", fmt.Sprintf("%x", hash)),
-	// 	slog.Int("song_id", songId),
-	// ).Debug("FIngerprint was inserted successfully")
+	return nil
+}
+
+func (db *DBSqlite) InsertSongDuplicate(ctx context.Context, songId int, duplicateOf int, similarity float64, logger *slog.Logger) error {
+	_, err := db.db.ExecContext(ctx, "INSERT INTO song_duplicates (song_id, duplicate_of, similarity) VALUES (?, ?, ?)",
+		songId, duplicateOf, similarity)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.Int("duplicate_of", duplicateOf),
+			slog.String("err", err.Error()),
+		).Warn("Error while inserting a song duplicate")
+		return err
+	}
 
 	return nil
 }
 
-func (db *DBSqlite) GetSongsCount(logger *slog.Logger) (int, error) {
-	row := db.db.QueryRow("SELECT COUNT(song_id) FROM songs")
+func (db *DBSqlite) DeleteSong(ctx context.Context, songId int, logger *slog.Logger) (int, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	promotedId, err := promoteDuplicateTx(ctx, tx, songId)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while promoting a duplicate of the deleted song")
+		return -1, err
+	}
+
+	// the fingerprints of a song with a promoted duplicate were moved, so these don`t change them
+	queries := []string{
+		releaseHashStats,
+		deleteEmptyHashStats,
+		"DELETE FROM fingerprints WHERE song_id = ?",
+		"DELETE FROM song_duplicates WHERE song_id = ?",
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query, songId)
+		if err != nil {
+			logger.With(
+				slog.Int("song_id", songId),
+				slog.String("err", err.Error()),
+			).Warn("Error while deleting a song")
+			return -1, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM songs WHERE song_id = ?", songId)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+
+	if deleted == 0 {
+		logger.With(slog.Int("song_id", songId)).Debug("Song was not found")
+		return -1, ErrSongNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting a song")
+		return -1, err
+	}
+
+	logger.With(slog.Int("song_id", songId), slog.Int("promoted_song_id", promotedId)).Debug("Song was deleted successfully")
+
+	return promotedId, nil
+}
+
+func (db *DBSqlite) DeleteFingerprints(ctx context.Context, songId int, logger *slog.Logger) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting fingerprints")
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		releaseHashStats,
+		deleteEmptyHashStats,
+		"DELETE FROM fingerprints WHERE song_id = ?",
+		"DELETE FROM song_duplicates WHERE song_id = ?",
+	}
+
+	for _, query := range queries {
+		_, err = tx.ExecContext(ctx, query, songId)
+		if err != nil {
+			logger.With(
+				slog.Int("song_id", songId),
+				slog.String("err", err.Error()),
+			).Warn("Error while deleting fingerprints")
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while deleting fingerprints")
+		return err
+	}
+
+	logger.With(slog.Int("song_id", songId)).Debug("Fingerprints were deleted successfully")
+
+	return nil
+}
+
+func (db *DBSqlite) ReplaceFingerprints(ctx context.Context, songId int, fingerprints map[uint64]uint32, duplicateOf int, similarity float64, fingerprintVersion int, logger *slog.Logger) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while replacing fingerprints")
+		return err
+	}
+	defer tx.Rollback()
+
+	err = execStatementsTx(ctx, tx, replaceFingerprintsStatements(songId, duplicateOf, similarity, fingerprintVersion))
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while replacing fingerprints")
+		return err
+	}
+
+	if duplicateOf == -1 {
+		err = insertFingerprintsSqlite(ctx, tx, songId, fingerprints, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while replacing fingerprints")
+		return err
+	}
+
+	logger.With(
+		slog.Int("song_id", songId),
+		slog.Int("duplicate_of", duplicateOf),
+		slog.Int("fingerprints_count", len(fingerprints)),
+	).Debug("Fingerprints were replaced successfully")
+
+	return nil
+}
+
+func (db *DBSqlite) SetSongIndexed(ctx context.Context, songId int, fingerprintVersion int, logger *slog.Logger) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE songs SET fingerprint_version = ?, indexed_at = ? WHERE song_id = ?",
+		fingerprintVersion, time.Now().Unix(), songId)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.Int("fingerprint_version", fingerprintVersion),
+			slog.String("err", err.Error()),
+		).Warn("Error while marking a song as indexed")
+		return err
+	}
+
+	return nil
+}
+
+// SetSongAddedAt keeps the time a song was added in another db, e.g. by an import
+func (db *DBSqlite) SetSongAddedAt(ctx context.Context, songId int, addedAt time.Time, logger *slog.Logger) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE songs SET added_at = ? WHERE song_id = ?", addedAt.Unix(), songId)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while setting the added time of a song")
+		return err
+	}
+
+	return nil
+}
+
+func (db *DBSqlite) GetSongStats(ctx context.Context, songId int, logger *slog.Logger) (SongStats, error) {
+	var stats SongStats
+	row := db.db.QueryRowContext(ctx, `SELECT COUNT(1), COALESCE(MIN(song_timestamp), 0), COALESCE(MAX(song_timestamp), 0)
+		FROM fingerprints WHERE song_id = ?`, songId)
+
+	err := row.Scan(&stats.FingerprintsCount, &stats.FirstTimestamp, &stats.LastTimestamp)
+
+	if err != nil {
+		logger.With(
+			slog.Int("song_id", songId),
+			slog.String("err", err.Error()),
+		).Warn("Error while getting song stats")
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func (db *DBSqlite) GetSongFingerprints(ctx context.Context, songId int, logger *slog.Logger) (map[uint64]uint32, error) {
+	return getSongFingerprints(ctx, db.db, songId, logger)
+}
+
+// GetStorageStats reads the sizes from the dbstat table, which needs sqlite compiled with
+// SQLITE_ENABLE_DBSTAT_VTAB, without it only the rows are counted
+func (db *DBSqlite) GetStorageStats(ctx context.Context, logger *slog.Logger) ([]TableStorage, error) {
+	stats := make([]TableStorage, len(storageTables))
+	for i, table := range storageTables {
+		stats[i] = TableStorage{Table: table, DataBytes: -1, IndexBytes: -1}
+
+		err := db.db.QueryRowContext(ctx, "SELECT COUNT(1) FROM "+table).Scan(&stats[i].Rows)
+		if err != nil {
+			logger.With(slog.String("table", table), slog.String("err", err.Error())).Warn("Error while counting the rows of a table")
+			return nil, err
+		}
+	}
+
+	rows, err := db.db.QueryContext(ctx, `SELECT m.tbl_name,
+		SUM(CASE WHEN m.type = 'table' THEN s.pgsize ELSE 0 END),
+		SUM(CASE WHEN m.type = 'index' THEN s.pgsize ELSE 0 END)
+		FROM dbstat s JOIN sqlite_master m ON m.name = s.name GROUP BY m.tbl_name`)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Debug("dbstat isn`t available, the sizes are unknown")
+		return stats, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		var dataBytes, indexBytes int64
+		err = rows.Scan(&table, &dataBytes, &indexBytes)
+		if err != nil {
+			logger.With(slog.String("err", err.Error())).Warn("Error while reading the table sizes")
+			return nil, err
+		}
+
+		i := slices.Index(storageTables, table)
+		if i != -1 {
+			stats[i].DataBytes = dataBytes
+			stats[i].IndexBytes = indexBytes
+		}
+	}
+
+	return stats, rows.Err()
+}
+
+func (db *DBSqlite) GetFingerprintsCount(ctx context.Context, logger *slog.Logger) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(1) FROM fingerprints").Scan(&count)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while getting the fingerprints count")
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (db *DBSqlite) GetSongsCount(ctx context.Context, search string, logger *slog.Logger) (int, error) {
+	query := "SELECT COUNT(song_id) FROM songs"
+	condition, args := db.searchCondition(search)
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+
+	row := db.db.QueryRowContext(ctx, query, args...)
 
 	err := row.Err()
 	if err != nil {
 		logger.With(
+			slog.String("search", search),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs count")
 		return 0, err
@@ -132,39 +543,48 @@ func (db *DBSqlite) GetSongsCount(logger *slog.Logger) (int, error) {
 
 	if err != nil {
 		logger.With(
+			slog.String("search", search),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs count")
 		return 0, err
 	}
 
 	logger.With(
+		slog.String("search", search),
 		slog.Int("songs_count", count),
 	).Debug("Songs count was got successfully")
 
 	return count, nil
 }
 
-func (db *DBSqlite) GetSongsPagination(page int, limit int, logger *slog.Logger) ([]Song, error) {
-	rows, err := db.db.Query("SELECT song_id, song_title, song_url FROM songs LIMIT ? OFFSET ?", limit, (page-1)*limit)
+func (db *DBSqlite) GetSongsPagination(ctx context.Context, query SongsQuery, logger *slog.Logger) ([]Song, error) {
+	logger = logger.With(
+		slog.Int("page", query.Page),
+		slog.Int("limit", query.Limit),
+		slog.String("search", query.Search),
+		slog.String("sort", string(query.Sort)),
+		slog.Bool("descending", query.Descending),
+	)
+
+	condition, searchArgs := db.searchCondition(query.Search)
+	sqlQuery, args := buildSongsQuery(query, condition, searchArgs)
+
+	rows, err := db.db.QueryContext(ctx, sqlQuery, args...)
 
 	if err != nil {
 		logger.With(
-			slog.Int("page", page),
-			slog.Int("limit", limit),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs with pagination")
 		return nil, err
 	}
+	defer rows.Close()
 
 	songs := make([]Song, 0)
 	for rows.Next() {
-		var song Song
-		err := rows.Scan(&song.SongId, &song.SongTitle, &song.SongUrl)
+		song, err := scanSong(rows)
 
 		if err != nil {
 			logger.With(
-				slog.Int("page", page),
-				slog.Int("limit", limit),
 				slog.String("err", err.Error()),
 			).Warn("Error while getting songs with pagination")
 			return nil, err
@@ -174,23 +594,18 @@ func (db *DBSqlite) GetSongsPagination(page int, limit int, logger *slog.Logger)
 
 	if err := rows.Err(); err != nil {
 		logger.With(
-			slog.Int("page", page),
-			slog.Int("limit", limit),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting songs with pagination")
 		return nil, err
 	}
 
-	logger.With(
-		slog.Int("page", page),
-		slog.Int("limit", limit),
-	).Debug("Songs was paginated successfully")
+	logger.Debug("Songs was paginated successfully")
 
 	return songs, nil
 }
 
-func (db *DBSqlite) CheckSongByUrl(songUrl string, logger *slog.Logger) (bool, error) {
-	row := db.db.QueryRow("SELECT 1 FROM songs WHERE song_url = ?", songUrl)
+func (db *DBSqlite) CheckSongByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (bool, error) {
+	row := db.db.QueryRowContext(ctx, "SELECT 1 FROM songs WHERE song_url = ?", songUrl)
 
 	err := row.Err()
 	if err != nil {
@@ -211,9 +626,29 @@ func (db *DBSqlite) CheckSongByUrl(songUrl string, logger *slog.Logger) (bool, e
 	return found, nil
 }
 
-func (db *DBSqlite) GetSongById(songId int, logger *slog.Logger) (Song, error) {
-	var song Song
-	row := db.db.QueryRow("SELECT song_id, song_title, song_url FROM songs WHERE song_id = ?", songId)
+func (db *DBSqlite) GetSongIdByUrl(ctx context.Context, songUrl string, logger *slog.Logger) (int, error) {
+	var songId int
+	err := db.db.QueryRowContext(ctx, "SELECT song_id FROM songs WHERE song_url = ?", songUrl).Scan(&songId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.With(slog.String("song_url", songUrl)).Debug("Song was not found")
+		return -1, ErrSongNotFound
+	}
+
+	if err != nil {
+		logger.With(
+			slog.String("song_url", songUrl),
+			slog.String("err", err.Error()),
+		).Warn("Error while getting a song_id by song_url")
+		return -1, err
+	}
+
+	return songId, nil
+}
+
+func (db *DBSqlite) GetSongById(ctx context.Context, songId int, logger *slog.Logger) (Song, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+songColumns+` FROM songs
+		LEFT JOIN song_duplicates ON songs.song_id = song_duplicates.song_id WHERE songs.song_id = ?`, songId)
 
 	err := row.Err()
 	if err != nil {
@@ -221,10 +656,15 @@ func (db *DBSqlite) GetSongById(songId int, logger *slog.Logger) (Song, error) {
 			slog.Int("song_id", songId),
 			slog.String("err", err.Error()),
 		).Warn("Error while getting song by song_id")
-		return song, err
+		return Song{}, err
 	}
 
-	err = row.Scan(&song.SongId, &song.SongTitle, &song.SongUrl)
+	song, err := scanSong(row)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		logger.With(slog.Int("song_id", songId)).Debug("Song was not found")
+		return song, ErrSongNotFound
+	}
 
 	if err != nil {
 		logger.With(
@@ -237,33 +677,6 @@ func (db *DBSqlite) GetSongById(songId int, logger *slog.Logger) (Song, error) {
 	return song, nil
 }
 
-func (db *DBSqlite) SearchFingerprints(hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
-	joined := joinHashes(hashes)
-	query := fmt.Sprintf("SELECT hash_key, song_id, song_timestamp FROM fingerprints WHERE hash_key IN (%s)", joined)
-	rows, err := db.db.Query(query)
-	if err != nil {
-		logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints")
-		return nil, err
-	}
-	defer rows.Close()
-
-	matches := make(map[uint64][]Fingerprint, 0)
-
-	for rows.Next() {
-		var fingerprint Fingerprint
-		err = rows.Scan(&fingerprint.HashKey, &fingerprint.SongId, &fingerprint.Timestamp)
-
-		if err != nil {
-			logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints")
-			return nil, err
-		}
-		matches[fingerprint.HashKey] = append(matches[fingerprint.HashKey], fingerprint)
-	}
-
-	if err = rows.Err(); err != nil {
-		logger.With(slog.String("err", err.Error())).Warn("Error while searching for fingerprints")
-		return nil, err
-	}
-
-	return matches, nil
+func (db *DBSqlite) SearchFingerprints(ctx context.Context, hashes []uint64, logger *slog.Logger) (map[uint64][]Fingerprint, error) {
+	return searchFingerprintsChunked(ctx, db.db, hashes, db.search, logger)
 }
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// StageTimeouts bounds every stage of adding and matching a song,
+// a zero timeout leaves the stage bounded only by its parent context
+type StageTimeouts struct {
+	Download time.Duration `yaml:"download" env:"DOWNLOAD_TIMEOUT"`
+	Convert  time.Duration `yaml:"convert" env:"CONVERT_TIMEOUT"`
+	Analysis time.Duration `yaml:"analysis" env:"ANALYSIS_TIMEOUT"`
+	DB       time.Duration `yaml:"db" env:"DB_TIMEOUT"`
+}
+
+func DefaultStageTimeouts() StageTimeouts {
+	return StageTimeouts{
+		Download: 10 * time.Minute,
+		Convert:  time.Minute,
+		Analysis: 2 * time.Minute,
+		DB:       30 * time.Second,
+	}
+}
+
+// WithStageTimeout derives the context of a single stage from the parent one
+func WithStageTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+
+	return context.WithTimeout(parent, timeout)
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RemoveTempFiles deletes the files left in a temp directory by a process
+// which was killed in the middle of a download or a match, it must run before
+// the server starts using the directory, the files changed in the last olderThan
+// are kept, because they can belong to a CLI command running at the same time
+func RemoveTempFiles(dir string, olderThan time.Duration, logger *slog.Logger) error {
+	logger = logger.With(slog.String("dir", dir))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Couldn`t read the temp directory")
+		return err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		// hidden files like .gitkeep are not temp files
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		filePath := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			// the file was removed by its process in the meantime
+			continue
+		}
+		if time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+
+		err = os.Remove(filePath)
+		if err != nil {
+			logger.With(slog.String("path", filePath), slog.String("err", err.Error())).Warn("Couldn`t remove an orphaned temp file")
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		logger.With(slog.Int("removed", removed)).Info("Orphaned temp files were removed")
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	files := []struct {
+		name string
+		age  time.Duration
+		kept bool
+	}{
+		{"orphaned.wav", 2 * time.Hour, false},
+		{"in-use.wav", time.Minute, true},
+		{".gitkeep", 2 * time.Hour, true},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		err := os.WriteFile(path, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-file.age)
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := RemoveTempFiles(dir, time.Hour, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file.name))
+		if kept := err == nil; kept != file.kept {
+			t.Errorf("%s kept = %v, want %v", file.name, kept, file.kept)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+var ErrUnknownTraceExporter = errors.New("unknown trace exporter")
+
+type TracingOptions struct {
+	// Exporter is none, stdout, file or otlp,
+	// otlp is configured with the standard OTEL_EXPORTER_OTLP_* env variables
+	Exporter string `yaml:"exporter" env:"TRACE_EXPORTER"`
+	// FilePath is where the file exporter appends the spans as JSON
+	FilePath string `yaml:"file" env:"TRACE_FILE"`
+	// set by the binary, not configurable
+	ServiceName string `yaml:"-"`
+	Version     string `yaml:"-"`
+}
+
+// Tracing owns the tracer provider, Shutdown flushes the spans which aren`t exported yet
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	file     *os.File
+}
+
+// NewTracing registers the global tracer provider,
+// with the none exporter the spans are created but dropped
+func NewTracing(options TracingOptions, logger *slog.Logger) (*Tracing, error) {
+	logger = logger.With(slog.String("exporter", options.Exporter))
+
+	tracing := &Tracing{}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch options.Exporter {
+	case "", "none":
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		tracing.file, err = os.OpenFile(options.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(io.Writer(tracing.file)))
+		}
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	default:
+		logger.Error("Unknown trace exporter, expected none, stdout, file or otlp")
+		return nil, ErrUnknownTraceExporter
+	}
+
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while creating the trace exporter")
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(options.ServiceName),
+		semconv.ServiceVersion(options.Version),
+		attribute.Int("fingerprint.version", FingerprintVersion),
+	))
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Error("Error while creating the trace resource")
+		return nil, err
+	}
+
+	providerOptions := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if exporter != nil {
+		providerOptions = append(providerOptions, sdktrace.WithBatcher(exporter))
+	}
+
+	tracing.provider = sdktrace.NewTracerProvider(providerOptions...)
+	otel.SetTracerProvider(tracing.provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	logger.Info("Tracing is set up successfully")
+	return tracing, nil
+}
+
+func (tracing *Tracing) Shutdown(ctx context.Context, logger *slog.Logger) error {
+	err := tracing.provider.Shutdown(ctx)
+	if err != nil {
+		logger.With(slog.String("err", err.Error())).Warn("Error while flushing the spans")
+	}
+
+	if tracing.file != nil {
+		tracing.file.Close()
+	}
+
+	return err
+}
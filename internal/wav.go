@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"iter"
@@ -10,6 +11,8 @@ import (
 	"os/exec"
 )
 
+var ErrInvalidWav = errors.New("invalid wav file")
+
 type wavHeader struct {
 	sampleRate uint32
 	dataSize   uint32
@@ -34,7 +37,10 @@ func NewWavParser(wavPath string, logger *slog.Logger) (*WavParser, error) {
 		wavFile: wavFile,
 	}
 
-	parser.parseHeader(logger)
+	if !parser.parseHeader(logger) {
+		wavFile.Close()
+		return nil, ErrInvalidWav
+	}
 
 	return parser, nil
 }
@@ -155,7 +161,7 @@ func (parser *WavParser) NewWindowIter(windowSize int, hopSize int, logger *slog
 
 var ErrInvalidPathFormat = errors.New("invalid path format")
 
-func ConvertWebmToWav(webmPath string, logger *slog.Logger) (string, error) {
+func ConvertWebmToWav(ctx context.Context, ffmpegPath string, webmPath string, logger *slog.Logger) (string, error) {
 	logger = logger.With(slog.String("webmPath", webmPath))
 
 	_, err := os.Stat(webmPath)
@@ -173,9 +179,14 @@ func ConvertWebmToWav(webmPath string, logger *slog.Logger) (string, error) {
 	}
 
 	dest := string(webPathBytes[:extInd]) + ".wav"
+	// a .wav input is converted to the mono 48kHz too, so the output needs another name
+	if dest == webmPath {
+		dest = string(webPathBytes[:extInd]) + ".mono.wav"
+	}
 
-	cmd := exec.Command(
-		"ffmpeg",
+	cmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
 		"-i",
 		webmPath,
 		"-ar", "48000",
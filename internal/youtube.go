@@ -1,13 +1,14 @@
 package internal
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"log/slog"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 var ErrInvalidDownloadUrl = errors.New("invalid download youtube url")
@@ -15,14 +16,24 @@ var ErrInvalidDirPath = errors.New("invalid directory")
 var ErrUnsuccessfulDownload = errors.New("unsuccessful download")
 
 type YouTubeDownloader interface {
-	DownloadWav(url string, logger *slog.Logger) (string, string, error)
+	DownloadWav(ctx context.Context, url string, logger *slog.Logger) (DownloadedAudio, error)
+}
+
+type DownloadedAudio struct {
+	Title string
+	// the artist of the track or the uploader when YouTube doesn`t know the artist
+	Artist  string
+	WavPath string
 }
 
 type ytdlpDownloader struct {
-	outputDir string
+	ytdlpPath   string
+	cookiesPath string
+	outputDir   string
 }
 
-func NewYtDlpDownloader(outputDir string, logger *slog.Logger) (YouTubeDownloader, error) {
+// an empty cookiesPath downloads without cookies
+func NewYtDlpDownloader(ytdlpPath string, cookiesPath string, outputDir string, logger *slog.Logger) (YouTubeDownloader, error) {
 	logger = logger.With(slog.String("output_dir", outputDir))
 
 	st, err := os.Stat(outputDir)
@@ -39,7 +50,9 @@ func NewYtDlpDownloader(outputDir string, logger *slog.Logger) (YouTubeDownloade
 
 	logger.Info("YtDlp downloader is created successfully")
 	return &ytdlpDownloader{
-		outputDir: outputDir,
+		ytdlpPath:   ytdlpPath,
+		cookiesPath: cookiesPath,
+		outputDir:   outputDir,
 	}, nil
 }
 
@@ -68,45 +81,57 @@ func StripUrl(raw string) (string, bool) {
 	return u.String(), true
 }
 
-func (downloader *ytdlpDownloader) DownloadWav(rawUrl string, logger *slog.Logger) (string, string, error) {
+func (downloader *ytdlpDownloader) DownloadWav(ctx context.Context, rawUrl string, logger *slog.Logger) (DownloadedAudio, error) {
 	if !ValidateUrl(rawUrl) {
 		logger.Debug("Invalid download youtube url")
-		return "", "", ErrInvalidDownloadUrl
+		return DownloadedAudio{}, ErrInvalidDownloadUrl
 	}
 
-	cmd := exec.Command(
-		"venv/bin/yt-dlp",
+	args := []string{
 		"--print", `"%(title)s"`,
+		"--print", `"%(artist,creator,uploader|)s"`,
 		"--print", `after_move:"%(filepath)s"`,
 		"-x",
 		"--audio-format", "wav",
-		"--cookies", "cookies.txt",
 		"-o", filepath.Join(downloader.outputDir, "%(title)s.%(ext)s"),
 		"--postprocessor-args", "-ac 1",
-		rawUrl,
-	)
+	}
+	if downloader.cookiesPath != "" {
+		args = append(args, "--cookies", downloader.cookiesPath)
+	}
+	args = append(args, rawUrl)
+
+	cmd := exec.CommandContext(ctx, downloader.ytdlpPath, args...)
 
 	cmdOutput, err := cmd.Output()
+	if ctx.Err() != nil {
+		logger.With(slog.String("err", ctx.Err().Error())).Debug("YtDlp was cancelled")
+		return DownloadedAudio{}, ctx.Err()
+	}
+
 	if err != nil {
 		logger.With(slog.String("err", err.Error())).Error("YtDlp failed")
-		return "", "", ErrUnsuccessfulDownload
+		return DownloadedAudio{}, ErrUnsuccessfulDownload
 	}
 
-	// skip last newline with len
-	ind := bytes.IndexByte(cmdOutput, '\n')
-	if ind == -1 {
-		logger.With(slog.String("ytdlp_output", string(cmdOutput))).Error("No new line found")
-		return "", "", ErrUnsuccessfulDownload
+	// every printed field is on its own line and wrapped in quotes
+	lines := strings.Split(strings.TrimSpace(string(cmdOutput)), "\n")
+	if len(lines) != 3 {
+		logger.With(slog.String("ytdlp_output", string(cmdOutput))).Error("Unexpected count of output lines")
+		return DownloadedAudio{}, ErrUnsuccessfulDownload
 	}
 
-	title := string(cmdOutput[1 : ind-1])
-	// skip last newline with len
-	outputPath := string(cmdOutput[ind+2 : len(cmdOutput)-2])
+	audio := DownloadedAudio{
+		Title:   strings.Trim(lines[0], `"`),
+		Artist:  strings.Trim(lines[1], `"`),
+		WavPath: strings.Trim(lines[2], `"`),
+	}
 
 	logger.With(
-		slog.String("title", title),
-		slog.String("output_path", outputPath),
+		slog.String("title", audio.Title),
+		slog.String("artist", audio.Artist),
+		slog.String("output_path", audio.WavPath),
 	).Debug("Successful audio download")
 
-	return title, outputPath, nil
+	return audio, nil
 }
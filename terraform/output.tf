@@ -8,4 +8,8 @@ output "ec2_public_ip" {
 
 output "api_gateway_url" {
     value = aws_apigatewayv2_api.http_api.api_endpoint
-}
\ No newline at end of file
+}
+
+output "readiness_url" {
+    value = "${aws_apigatewayv2_api.http_api.api_endpoint}/readyz"
+}
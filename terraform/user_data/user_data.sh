@@ -46,5 +46,5 @@ echo 'export GOCACHE=/root/.cache/go-build' >> /root/.bash_profile
 mkdir downloads
 mkdir uploads
 
-CGO_ENABLED=1 go build -o main cmd/main.go cmd/routes.go 2> build.log
+CGO_ENABLED=1 go build -o main ./cmd 2> build.log
 ./main -region="eu-central-1" -prod > run.log
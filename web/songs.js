@@ -12,11 +12,16 @@ const songsDialog = document.getElementById("songs-dialog");
 const songUrlInput = document.getElementById("song-url");
 const addSongBtn = document.getElementById("add-song");
 const errorDialog = document.getElementById("error-dialog");
+const songSearchInput = document.getElementById("song-search");
 
 const apiUrl = API_URL;
 const limit = 14;
 const url = new URL("/songs", apiUrl);
 
+let currentPage = 1;
+let searchQuery = "";
+let searchTimeout;
+
 const params = {
   page: 1,
   limit: limit,
@@ -70,9 +75,10 @@ function renderSongsTable(songs, limit) {
     const node = document.createElement("tr");
     if (i < songs.length) {
       const song = songs[i];
-      node.innerHTML = `<td>${song.song_id}.</td><td>${song.song_title}</td><td>${song.song_url}</td>`;
+      node.innerHTML = `<td>${song.song_id}.</td><td>${song.song_title}</td><td>${song.song_artist}</td><td>${song.song_url}</td><td><button class="delete-song">Delete</button></td>`;
+      node.querySelector(".delete-song").onclick = createOnDelete(song.song_id);
     } else {
-      node.innerHTML = "<td>&nbsp;</td><td>&nbsp;</td><td>&nbsp;</td>";
+      node.innerHTML = "<td>&nbsp;</td><td>&nbsp;</td><td>&nbsp;</td><td>&nbsp;</td><td>&nbsp;</td>";
     }
     songsTableBody.append(node);
   }
@@ -141,6 +147,9 @@ function createOnClick(num) {
       page: num,
       limit: limit,
     };
+    if (searchQuery !== "") {
+      params.q = searchQuery;
+    }
     const url = new URL("/songs", apiUrl);
     Object.entries(params).forEach(([key, value]) => {
       url.searchParams.append(key, value);
@@ -163,7 +172,7 @@ function createOnClick(num) {
       spinner.hidden = true;
       songsTable.style.opacity = 1;
 
-      const num = (data.page - 1) * data.limit + 1;
+      currentPage = data.page;
       renderSongsTable(data.songs, data.limit);
 
       const pageCount = Math.ceil(data.total / data.limit);
@@ -174,8 +183,36 @@ function createOnClick(num) {
   };
 }
 
+function createOnDelete(songId) {
+  return () => {
+    const deleteUrl = new URL(`/songs/${songId}`, apiUrl);
+    const deleteHandler = new ApiHandler(deleteUrl.toString(), "delete");
+
+    deleteHandler.onSuccess(() => {
+      createOnClick(currentPage)();
+    });
+
+    deleteHandler.onError((statusCode, err) => {
+      errorDisplay.innerText = `Status code - ${statusCode}, error - ${err.error}`;
+    });
+
+    deleteHandler.onFail(() => {
+      errorDisplay.innerText = "Couldn`t connect to the server";
+    });
+
+    deleteHandler.initiateFetch();
+  };
+}
+
 function renderSongHeaders() {
   songsHeader.childNodes.forEach((el) => (el.hidden = false));
+  songSearchInput.oninput = () => {
+    clearTimeout(searchTimeout);
+    searchTimeout = setTimeout(() => {
+      searchQuery = songSearchInput.value.trim();
+      createOnClick(1)();
+    }, 300);
+  };
   openDialogButton.onclick = () => {
     errorDialog.innerText = "";
     errorDialog.hidden = true;